@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"mars/goproxy/cert"
+	"mars/internal/app/config"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	caOpts       cert.CAOptions
+	caForce      bool
+	caFormat     string
+	caOutput     string
+	caPassword   string
+	caIncludeKey bool
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "根证书管理, 证书路径读取配置文件[Certificate]",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+		err := config.CreateConfig(ConfigFile, Env)
+		if err != nil {
+			log.Fatalf("读取配置文件错误: %s", err)
+		}
+	},
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "生成新的根证书",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := config.Conf.Certificate
+		if !caForce {
+			for _, filename := range []string{conf.BasePrivate, conf.CaPrivate} {
+				if _, err := os.Stat(filename); err == nil {
+					log.Fatalf("根证书已存在: %s, 使用--force覆盖", filename)
+				}
+			}
+		}
+		err := cert.CreateCA(conf.BasePrivate, conf.CaPrivate, caOpts)
+		if err != nil {
+			log.Fatalf("生成根证书错误: %s", err)
+		}
+		copyUserCertificate(conf)
+		cmd.Printf("根证书: %s\n私钥: %s\n", conf.BasePrivate, conf.CaPrivate)
+		cmd.Println("客户端需重新安装根证书")
+	},
+}
+
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "导出根证书, 用于在设备上安装",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := config.Conf.Certificate
+		format := strings.ToLower(caFormat)
+		if caIncludeKey && format != cert.FormatP12 {
+			log.Fatal("只有p12格式可以包含私钥")
+		}
+		ca, key := loadCA(conf, caIncludeKey)
+		data, err := cert.ExportCA(ca, key, format, caPassword)
+		if err != nil {
+			log.Fatalf("导出根证书错误: %s", err)
+		}
+		output := caOutput
+		if output == "" {
+			ext := format
+			if ext == cert.FormatPEM {
+				ext = "crt"
+			}
+			output = "mars-ca." + ext
+		}
+		if output == "-" {
+			os.Stdout.Write(data)
+			return
+		}
+		perm := os.FileMode(0644)
+		if caIncludeKey {
+			perm = 0600
+		}
+		err = ioutil.WriteFile(output, data, perm)
+		if err != nil {
+			log.Fatalf("写入文件错误: %s", err)
+		}
+		cmd.Printf("已导出: %s\n", output)
+	},
+}
+
+var caInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "查看根证书信息",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := config.Conf.Certificate
+		ca, err := cert.LoadCACertificate(conf.BasePrivate)
+		if err != nil {
+			log.Fatalf("加载根证书错误: %s", err)
+		}
+		cmd.Printf("文件:         %s\n", conf.BasePrivate)
+		cmd.Printf("主题:         %s\n", ca.Subject)
+		cmd.Printf("颁发者:       %s\n", ca.Issuer)
+		cmd.Printf("序列号:       %X\n", ca.SerialNumber)
+		cmd.Printf("生效时间:     %s\n", ca.NotBefore.Local().Format("2006-01-02 15:04:05"))
+		cmd.Printf("过期时间:     %s\n", ca.NotAfter.Local().Format("2006-01-02 15:04:05"))
+		if remain := time.Until(ca.NotAfter); remain > 0 {
+			cmd.Printf("剩余天数:     %d\n", int(remain.Hours()/24))
+		} else {
+			cmd.Println("状态:         已过期")
+		}
+		cmd.Printf("SHA-256指纹:  %s\n", cert.FingerprintSHA256(ca))
+		cmd.Printf("SHA-1指纹:    %s\n", cert.FingerprintSHA1(ca))
+	},
+}
+
+// 加载根证书, withKey为false时不读取私钥
+func loadCA(conf config.CertificateConfig, withKey bool) (ca *x509.Certificate, key *rsa.PrivateKey) {
+	var err error
+	if withKey {
+		ca, key, err = cert.LoadCA(conf.BasePrivate, conf.CaPrivate)
+	} else {
+		ca, err = cert.LoadCACertificate(conf.BasePrivate)
+	}
+	if err != nil {
+		log.Fatalf("加载根证书错误: %s", err)
+	}
+
+	return ca, key
+}
+
+// 根证书不存在时生成, 首次启动服务时调用
+func ensureCA(conf config.CertificateConfig) {
+	created, err := cert.EnsureCA(conf.BasePrivate, conf.CaPrivate, cert.CAOptions{})
+	if err != nil {
+		log.Fatalf("生成根证书错误: %s", err)
+	}
+	if created {
+		copyUserCertificate(conf)
+		log.Infof("已生成根证书: %s, 客户端安装后才能解密HTTPS", conf.BasePrivate)
+	}
+}
+
+// 根证书复制到userCertificate, 供客户端下载安装
+func copyUserCertificate(conf config.CertificateConfig) {
+	if conf.UserCertificate == "" || conf.UserCertificate == conf.BasePrivate {
+		return
+	}
+	data, err := ioutil.ReadFile(conf.BasePrivate)
+	if err != nil {
+		log.Fatalf("读取根证书错误: %s", err)
+	}
+	err = ioutil.WriteFile(conf.UserCertificate, data, 0644)
+	if err != nil {
+		log.Fatalf("写入客户端证书错误: %s", err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caInitCmd, caExportCmd, caInfoCmd)
+
+	caCmd.PersistentFlags().StringVarP(&ConfigFile, "configFile", "c", "conf/app.toml", "config file path")
+
+	caInitCmd.Flags().StringVar(&caOpts.CommonName, "cn", "Mars Root CA", "证书通用名称")
+	caInitCmd.Flags().StringVar(&caOpts.Organization, "org", "Mars", "组织名称")
+	caInitCmd.Flags().IntVar(&caOpts.ValidDays, "days", 3650, "有效天数")
+	caInitCmd.Flags().IntVar(&caOpts.KeyBits, "bits", 2048, "RSA私钥长度")
+	caInitCmd.Flags().BoolVarP(&caForce, "force", "f", false, "覆盖已有的根证书")
+
+	caExportCmd.Flags().StringVar(&caFormat, "format", cert.FormatPEM, "pem | der | p12 | mobileconfig")
+	caExportCmd.Flags().StringVarP(&caOutput, "output", "o", "", "输出文件, -输出到标准输出, 默认mars-ca.crt、mars-ca.der、mars-ca.p12、mars-ca.mobileconfig")
+	caExportCmd.Flags().StringVar(&caPassword, "password", "", "p12密码")
+	caExportCmd.Flags().BoolVar(&caIncludeKey, "include-key", false, "p12包含根证书私钥, 仅用于迁移到其他代理工具")
+}
@@ -30,6 +30,9 @@ var serverCmd = &cobra.Command{
 		} else {
 			log.SetLevel(log.InfoLevel)
 		}
+		if conf.MITMProxy.DecryptHTTPS {
+			ensureCA(conf.Certificate)
+		}
 		container := inject.NewContainer(conf)
 		//	container.Proxy. //goproxy.New(goproxy.WithDelegate(&EventHandler{}))
 		app.New(container).Run() // 从这里开始 运行服务
@@ -3,7 +3,10 @@ package filterrules
 import (
 	"bufio"
 	"mars/internal/app/config"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gogf/gf/text/gregex"
@@ -48,195 +51,418 @@ var RespRw []map[string]string
 // ReqRw 重写 Response Body
 var ReqRw []map[string]string
 
+// WsDrop 丢弃匹配的WebSocket文本帧
+var WsDrop []map[string]string
+
+// WsRw 重写WebSocket文本帧
+var WsRw []map[string]string
+
+// ParentProxy 按Host选择上级代理, proxy为direct表示直连
+var ParentProxy []map[string]string
+
+// Fault 故障注入, 按概率重置连接、超时、截断响应或返回5xx
+var Fault []map[string]string
+
+// 故障注入类型, 返回5xx时类型为状态码
+const (
+	FaultReset    = "reset"
+	FaultTimeout  = "timeout"
+	FaultTruncate = "truncate"
+)
+
+// ParentProxyDirect 上级代理规则中表示不使用上级代理
+const ParentProxyDirect = "direct"
+
+// ModuleName 全局规则的名称, 取自配置[filterrules]name
+var ModuleName string
+
+// 规则类型, 用于统计命中数
+const (
+	RuleWhitelist   = "whitelist"
+	RuleHostlist    = "hostlist"
+	RuleReqURLRw    = "req_url_rw"
+	RuleReqURLTo    = "req_url_to"
+	RuleReqDel      = "req_del"
+	RuleReqOriSet   = "req_oriset"
+	RuleReqNewSet   = "req_newset"
+	RuleReqRw       = "req_rw"
+	RuleRespDel     = "resp_del"
+	RuleRespOriSet  = "resp_oriset"
+	RuleRespNewSet  = "resp_newset"
+	RuleRespRw      = "resp_rw"
+	RuleWsDrop      = "ws_drop"
+	RuleWsRw        = "ws_rw"
+	RuleParentProxy = "parent_proxy"
+	RuleFault       = "fault"
+)
+
+// Rules 一组过滤规则, 全局规则与代理账号专属规则共用同一结构
+type Rules struct {
+	// Name 规则名称, 默认为规则文件名
+	Name       string
+	Whitelist  []string
+	Blacklist  []string
+	Hostlist   []string
+	ReqURLRw   []map[string]string
+	ReqURLTo   []map[string]string
+	ReqDel     []map[string]string
+	ReqOriSet  []map[string]string
+	ReqNewSet  []map[string]string
+	RespDel    []map[string]string
+	RespOriSet []map[string]string
+	RespNewSet []map[string]string
+	RespRw     []map[string]string
+	ReqRw      []map[string]string
+	WsDrop     []map[string]string
+	WsRw       []map[string]string
+	// ParentProxy 按Host选择上级代理
+	ParentProxy []map[string]string
+	// Fault 故障注入
+	Fault []map[string]string
+}
+
+// Global 当前全局规则
+func Global() *Rules {
+	return &Rules{
+		Name:        ModuleName,
+		Whitelist:   Whitelist,
+		Blacklist:   Blacklist,
+		Hostlist:    Hostlist,
+		ReqURLRw:    ReqURLRw,
+		ReqURLTo:    ReqURLTo,
+		ReqDel:      ReqDel,
+		ReqOriSet:   ReqOriSet,
+		ReqNewSet:   ReqNewSet,
+		RespDel:     RespDel,
+		RespOriSet:  RespOriSet,
+		RespNewSet:  RespNewSet,
+		RespRw:      RespRw,
+		ReqRw:       ReqRw,
+		WsDrop:      WsDrop,
+		WsRw:        WsRw,
+		ParentProxy: ParentProxy,
+		Fault:       Fault,
+	}
+}
+
 // LoadFilterRules 加载过滤规则
 func LoadFilterRules() {
-
-	file, err := os.Open(config.Conf.Filterrules.Filepath)
+	r, err := ParseFile(config.Conf.Filterrules.Filepath)
 	if err != nil {
 		println(err.Error())
 	}
+	ModuleName = r.Name
+	if config.Conf.Filterrules.Name != "" {
+		ModuleName = config.Conf.Filterrules.Name
+	}
+	Whitelist = r.Whitelist
+	Blacklist = r.Blacklist
+	Hostlist = r.Hostlist
+	ReqURLRw = r.ReqURLRw
+	ReqURLTo = r.ReqURLTo
+	ReqDel = r.ReqDel
+	ReqOriSet = r.ReqOriSet
+	ReqNewSet = r.ReqNewSet
+	RespDel = r.RespDel
+	RespOriSet = r.RespOriSet
+	RespNewSet = r.RespNewSet
+	RespRw = r.RespRw
+	ReqRw = r.ReqRw
+	WsDrop = r.WsDrop
+	WsRw = r.WsRw
+	ParentProxy = r.ParentProxy
+	Fault = r.Fault
+}
+
+// ParseFile 解析规则文件
+func ParseFile(path string) (*Rules, error) {
+	r := &Rules{Name: filepath.Base(path)}
+	file, err := os.Open(path)
+	if err != nil {
+		return r, err
+	}
 	defer file.Close()
 	Scanner := bufio.NewScanner(file)
 	for Scanner.Scan() {
-		var Txts string
-		Txts = Scanner.Text()
-		if !gregex.IsMatchString(`^#`, Txts) { //注释符号
-			// 白名单
-			if gregex.IsMatchString(`^@@`, Txts) {
-				list, err := gregex.ReplaceString(`^@@`, "", Txts)
-				if err != nil {
-					println(err.Error())
-				}
-				Whitelist = append(Whitelist, list)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
+		r.parseLine(Scanner.Text())
+	}
+
+	return r, Scanner.Err()
+}
+
+// HitHook 规则命中时回调, module为规则名称, rule为规则类型, 用于统计
+var HitHook func(module, rule string)
+
+// Hit 记录规则命中, rule为规则类型
+func (r *Rules) Hit(rule string) {
+	if HitHook != nil {
+		HitHook(r.Name, rule)
+	}
+}
+
+// 解析单行规则
+func (r *Rules) parseLine(Txts string) {
+	if !gregex.IsMatchString(`^#`, Txts) { //注释符号
+		// 白名单
+		if gregex.IsMatchString(`^@@`, Txts) {
+			list, err := gregex.ReplaceString(`^@@`, "", Txts)
+			if err != nil {
+				println(err.Error())
 			}
-			// Host 屏蔽方式
-			if gregex.IsMatchString(`^\|\|`, Txts) {
-				list, err := gregex.ReplaceString(`^\|\|`, "", Txts)
-				if err != nil {
-					println(err.Error())
-				}
-				Hostlist = append(Hostlist, list)
-				//  将Host 域名加入 需要封锁的列表
-				list, err = gregex.ReplaceString(`/.*`, "", Txts)
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, list)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
-			}
-			// URL重写
-			if gregex.IsMatchString(`@url\|\|rw@`, Txts) {
-				list := strings.Split(Txts, "@url||rw@")
-				listRW := strings.Split(list[1], "@@@") // 此处有误？
-				ReqURLRw = append(ReqURLRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
-
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
-			}
-			// URL重定向
-			if gregex.IsMatchString(`@url\|\|to@`, Txts) {
-				list := strings.Split(Txts, "@url||to@")
-				listRW := strings.Split(list[1], "@@@")
-				urltohost, err := gregex.ReplaceString(`/.*`, "", listRW[1]) // 将需要重定向的域名提出来
-				if err != nil {
-					println(err.Error())
-				}
-				urltopath, err := gregex.ReplaceString(`.*/+?`, "", listRW[1]) // 将重定向的path 提出来
-				if err != nil {
-					println(err.Error())
-				}
-				ReqURLTo = append(ReqURLTo, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1], "urltohost": urltohost, "urltopath": urltopath})
-				//  将Host 域名加入 需要封锁的列表
+			r.Whitelist = append(r.Whitelist, list)
+			return
+		}
+		// Host 屏蔽方式
+		if gregex.IsMatchString(`^\|\|`, Txts) {
+			list, err := gregex.ReplaceString(`^\|\|`, "", Txts)
+			if err != nil {
+				println(err.Error())
+			}
+			r.Hostlist = append(r.Hostlist, list)
+			//  将Host 域名加入 需要封锁的列表
+			list, err = gregex.ReplaceString(`/.*`, "", Txts)
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, list)
+			return
+		}
+		// URL重写
+		if gregex.IsMatchString(`@url\|\|rw@`, Txts) {
+			list := strings.Split(Txts, "@url||rw@")
+			listRW := strings.Split(list[1], "@@@") // 此处有误？
+			r.ReqURLRw = append(r.ReqURLRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+		// URL重定向
+		if gregex.IsMatchString(`@url\|\|to@`, Txts) {
+			list := strings.Split(Txts, "@url||to@")
+			listRW := strings.Split(list[1], "@@@")
+			urltohost, err := gregex.ReplaceString(`/.*`, "", listRW[1]) // 将需要重定向的域名提出来
+			if err != nil {
+				println(err.Error())
+			}
+			urltopath, err := gregex.ReplaceString(`.*/+?`, "", listRW[1]) // 将重定向的path 提出来
+			if err != nil {
+				println(err.Error())
+			}
+			r.ReqURLTo = append(r.ReqURLTo, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1], "urltohost": urltohost, "urltopath": urltopath})
+			//  将Host 域名加入 需要封锁的列表
 
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
 			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
 
-			// Request Headers 删除
-			if gregex.IsMatchString(`@req\|\|del@`, Txts) {
-				list := strings.Split(Txts, "@req||del@")
+		// Request Headers 删除
+		if gregex.IsMatchString(`@req\|\|del@`, Txts) {
+			list := strings.Split(Txts, "@req||del@")
 
-				ReqDel = append(ReqDel, map[string]string{"url": list[0], "headerName": list[1]})
-				//  将Host 域名加入 需要封锁的列表
+			r.ReqDel = append(r.ReqDel, map[string]string{"url": list[0], "headerName": list[1]})
+			//  将Host 域名加入 需要封锁的列表
 
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
-			}
-			// Request Headers 追加设置
-			if gregex.IsMatchString(`@req\|\|oriset@`, Txts) {
-				list := strings.Split(Txts, "@req||oriset@")
-				listRW := strings.Split(list[1], "@@@")
-				ReqOriSet = append(ReqOriSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
-
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
-			}
-			// Request Headers 新设置
-			if gregex.IsMatchString(`@req\|\|newset@`, Txts) {
-				list := strings.Split(Txts, "@req||newset@")
-				listRW := strings.Split(list[1], "@@@")
-				ReqNewSet = append(ReqNewSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
-
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
 			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+		// Request Headers 追加设置
+		if gregex.IsMatchString(`@req\|\|oriset@`, Txts) {
+			list := strings.Split(Txts, "@req||oriset@")
+			listRW := strings.Split(list[1], "@@@")
+			r.ReqOriSet = append(r.ReqOriSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+		// Request Headers 新设置
+		if gregex.IsMatchString(`@req\|\|newset@`, Txts) {
+			list := strings.Split(Txts, "@req||newset@")
+			listRW := strings.Split(list[1], "@@@")
+			r.ReqNewSet = append(r.ReqNewSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
 
-			// Response Headers 删除
-			if gregex.IsMatchString(`@resp\|\|del@`, Txts) {
-				list := strings.Split(Txts, "@resp||del@")
-				RespDel = append(RespDel, map[string]string{"url": list[0], "headerName": list[1]})
-				//  将Host 域名加入 需要封锁的列表
+		// Response Headers 删除
+		if gregex.IsMatchString(`@resp\|\|del@`, Txts) {
+			list := strings.Split(Txts, "@resp||del@")
+			r.RespDel = append(r.RespDel, map[string]string{"url": list[0], "headerName": list[1]})
+			//  将Host 域名加入 需要封锁的列表
 
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
-			}
-			// Response Headers 追加设置
-			if gregex.IsMatchString(`@resp\|\|oriset@`, Txts) {
-				list := strings.Split(Txts, "@resp||oriset@")
-				listRW := strings.Split(list[1], "@@@")
-				RespOriSet = append(RespOriSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
-
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
-			}
-			// Response Headers 新设置
-			if gregex.IsMatchString(`@resp\|\|newset@`, Txts) {
-				list := strings.Split(Txts, "@resp||newset@")
-				listRW := strings.Split(list[1], "@@@")
-				RespNewSet = append(RespNewSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
-
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+		// Response Headers 追加设置
+		if gregex.IsMatchString(`@resp\|\|oriset@`, Txts) {
+			list := strings.Split(Txts, "@resp||oriset@")
+			listRW := strings.Split(list[1], "@@@")
+			r.RespOriSet = append(r.RespOriSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
 			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+		// Response Headers 新设置
+		if gregex.IsMatchString(`@resp\|\|newset@`, Txts) {
+			list := strings.Split(Txts, "@resp||newset@")
+			listRW := strings.Split(list[1], "@@@")
+			r.RespNewSet = append(r.RespNewSet, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
 
-			// Request Body 新设置
-			if gregex.IsMatchString(`@req\|\|rw@`, Txts) {
-				list := strings.Split(Txts, "@req||rw@")
-				listRW := strings.Split(list[1], "@@@")
-				ReqRw = append(ReqRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
+		// Request Body 新设置
+		if gregex.IsMatchString(`@req\|\|rw@`, Txts) {
+			list := strings.Split(Txts, "@req||rw@")
+			listRW := strings.Split(list[1], "@@@")
+			r.ReqRw = append(r.ReqRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
 
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
-					println(err.Error())
-				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
 			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
 
-			// Response Body 新设置
-			if gregex.IsMatchString(`@resp\|\|rw@`, Txts) {
-				list := strings.Split(Txts, "@resp||rw@")
-				listRW := strings.Split(list[1], "@@@")
-				RespRw = append(RespRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
-				//  将Host 域名加入 需要封锁的列表
+		// Response Body 新设置
+		if gregex.IsMatchString(`@resp\|\|rw@`, Txts) {
+			list := strings.Split(Txts, "@resp||rw@")
+			listRW := strings.Split(list[1], "@@@")
+			r.RespRw = append(r.RespRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
 
-				newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
-				if err != nil {
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+
+		// WebSocket 文本帧丢弃
+		if gregex.IsMatchString(`@ws\|\|drop@`, Txts) {
+			list := strings.Split(Txts, "@ws||drop@")
+			r.WsDrop = append(r.WsDrop, map[string]string{"url": list[0], "target": list[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+
+		// WebSocket 文本帧重写
+		if gregex.IsMatchString(`@ws\|\|rw@`, Txts) {
+			list := strings.SplitN(Txts, "@ws||rw@", 2)
+			listRW := strings.SplitN(list[1], "@@@", 2)
+			if len(listRW) < 2 {
+				println("WebSocket文本帧重写规则错误, 缺少@@@: " + Txts)
+				return
+			}
+			r.WsRw = append(r.WsRw, map[string]string{"url": list[0], "target": listRW[0], "result": listRW[1]})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+
+		// 故障注入 概率默认为1
+		if gregex.IsMatchString(`@fault\|\|`, Txts) {
+			list := strings.SplitN(Txts, "@fault||", 2)
+			listRW := strings.SplitN(list[1], "@@@", 2)
+			fault := strings.TrimSpace(listRW[0])
+			probability := "1"
+			if len(listRW) > 1 {
+				probability = strings.TrimSpace(listRW[1])
+			}
+			if !validFault(fault) {
+				println("故障注入类型错误: " + fault)
+				return
+			}
+			if p, err := strconv.ParseFloat(probability, 64); err != nil || p < 0 || p > 1 {
+				println("故障注入概率错误: " + probability)
+				return
+			}
+			r.Fault = append(r.Fault, map[string]string{"url": list[0], "fault": fault, "probability": probability})
+			//  将Host 域名加入 需要封锁的列表
+
+			newlist, err := gregex.ReplaceString(`/.*`, "", list[0])
+			if err != nil {
+				println(err.Error())
+			}
+			r.Blacklist = append(r.Blacklist, newlist)
+			return
+		}
+
+		// 上级代理 只匹配Host, 隧道与HTTP请求都生效
+		if gregex.IsMatchString(`@proxy\|\|to@`, Txts) {
+			list := strings.SplitN(Txts, "@proxy||to@", 2)
+			proxy := strings.TrimSpace(list[1])
+			if proxy != ParentProxyDirect {
+				if _, err := url.Parse(proxy); err != nil {
 					println(err.Error())
+					return
 				}
-				Blacklist = append(Blacklist, newlist)
-				continue //  continue 忽略剩余的循环体而直接进入下一次循环的过程
 			}
-
+			r.ParentProxy = append(r.ParentProxy, map[string]string{"url": list[0], "proxy": proxy})
+			return
 		}
 	}
 }
+
+// 故障类型是否有效, 状态码只支持5xx
+func validFault(fault string) bool {
+	switch fault {
+	case FaultReset, FaultTimeout, FaultTruncate:
+		return true
+	}
+	code, err := strconv.Atoi(fault)
+
+	return err == nil && code >= 500 && code <= 599
+}
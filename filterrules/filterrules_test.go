@@ -0,0 +1,16 @@
+package filterrules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebSocketRewrite(t *testing.T) {
+	r := &Rules{}
+	r.parseLine(`echo\.example\.com@ws||rw@ping@@@pong`)
+	// 缺少@@@的规则忽略, 不影响其他规则
+	r.parseLine(`bad\.example\.com@ws||rw@ping`)
+	require.Equal(t, []map[string]string{{"url": `echo\.example\.com`, "target": "ping", "result": "pong"}}, r.WsRw)
+	require.Equal(t, []string{`echo\.example\.com`}, r.Blacklist)
+}
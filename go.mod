@@ -13,12 +13,16 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/ouqiang/goutil v1.2.2
 	github.com/posener/wstest v1.2.0
+	github.com/prometheus/client_golang v1.5.1
 	github.com/rakyll/statik v0.1.7
 	github.com/satori/go.uuid v1.2.0
 	github.com/shadowsocks/shadowsocks-go v0.0.0-20190614083952-6a03846ca9c0
 	github.com/sirupsen/logrus v1.5.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spf13/cobra v0.0.6
 	github.com/spf13/viper v1.6.2
 	github.com/stretchr/testify v1.5.1
 	github.com/syndtr/goleveldb v1.0.0
+	golang.org/x/crypto v0.0.0-20200317142112-1b76d66859c6
+	golang.org/x/net v0.0.0-20190522155817-f3200d17e092
 )
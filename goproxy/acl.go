@@ -0,0 +1,108 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ACL 按客户端IP控制访问, Deny优先于Allow, Allow为空时允许所有不在Deny中的客户端
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL 创建ACL, 支持CIDR和单个IP
+func NewACL(allow, deny []string) (*ACL, error) {
+	a := &ACL{}
+	var err error
+	a.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	a.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Allowed ip是否允许访问
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// 按host:port格式的远程地址判断, nil表示不限制
+func (a *ACL) allowedAddr(addr string) bool {
+	if a == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return a.Allowed(net.ParseIP(host))
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("IP地址格式错误: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("CIDR格式错误: %s", s)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 拒绝不在访问控制列表中的客户端, 返回403, recordDenied为true时交给Delegate.Finish记录
+func (p *Proxy) denyClient(ctx *Context, rw http.ResponseWriter) {
+	p.delegate.ErrorLog(fmt.Errorf("%s - 客户端不允许使用代理, 拒绝请求: [client: %s]", ctx.Req.URL.Host, ctx.Req.RemoteAddr))
+	rw.WriteHeader(http.StatusForbidden)
+	ctx.Abort()
+	if p.recordDenied {
+		ctx.Denied = true
+		p.delegate.Finish(ctx)
+	}
+}
@@ -0,0 +1,151 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewACL(t *testing.T) {
+	_, err := NewACL([]string{"bad"}, nil)
+	require.Error(t, err)
+	_, err = NewACL(nil, []string{"10.0.0.0/33"})
+	require.Error(t, err)
+
+	acl, err := NewACL([]string{"10.0.0.0/8", "::1", " "}, []string{"10.1.0.0/16"})
+	require.NoError(t, err)
+	tests := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.2.3":        false,
+		"127.0.0.1":       false,
+		"::1":             true,
+		"::2":             false,
+		"::ffff:10.2.0.1": true,
+	}
+	for ip, want := range tests {
+		require.Equal(t, want, acl.Allowed(net.ParseIP(ip)), ip)
+	}
+	require.False(t, acl.Allowed(nil))
+	require.True(t, acl.allowedAddr("10.2.3.4:8080"))
+	require.False(t, acl.allowedAddr("[::2]:8080"))
+
+	// 只有Deny时允许其余客户端, nil不限制
+	deny, err := NewACL(nil, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	require.False(t, deny.Allowed(net.ParseIP("127.0.0.1")))
+	require.True(t, deny.Allowed(net.ParseIP("127.0.0.2")))
+	var none *ACL
+	require.True(t, none.Allowed(nil))
+	require.True(t, none.allowedAddr("127.0.0.1:80"))
+}
+
+func TestClientACL(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	deny, err := NewACL(nil, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	allow, err := NewACL([]string{"127.0.0.0/8"}, nil)
+	require.NoError(t, err)
+
+	proxyClient := func(ps *httptest.Server) *http.Client {
+		proxyURL, err := url.Parse(ps.URL)
+		require.NoError(t, err)
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 3 * time.Second}
+	}
+
+	t.Run("http denied", func(t *testing.T) {
+		d := newFinishRecorder()
+		ps := httptest.NewServer(New(WithDelegate(d), WithClientACL(deny, true)))
+		defer ps.Close()
+		resp, err := proxyClient(ps).Get(upstream.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		select {
+		case ctx := <-d.done:
+			require.True(t, ctx.Denied)
+		case <-time.After(time.Second):
+			t.Fatal("被拒绝的请求未交给Finish记录")
+		}
+	})
+
+	t.Run("http denied not recorded", func(t *testing.T) {
+		d := newFinishRecorder()
+		ps := httptest.NewServer(New(WithDelegate(d), WithClientACL(deny, false)))
+		defer ps.Close()
+		resp, err := proxyClient(ps).Get(upstream.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Len(t, d.done, 0)
+	})
+
+	t.Run("http allowed", func(t *testing.T) {
+		ps := httptest.NewServer(New(WithClientACL(allow, false)))
+		defer ps.Close()
+		resp, err := proxyClient(ps).Get(upstream.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("reverse denied", func(t *testing.T) {
+		upstreamURL, err := url.Parse(upstream.URL)
+		require.NoError(t, err)
+		d := newFinishRecorder()
+		p := New(WithDelegate(d), WithClientACL(deny, true))
+		rs := httptest.NewServer(p.ReverseHandler([]ReverseRoute{{PathPrefix: "/", Upstream: upstreamURL}}))
+		defer rs.Close()
+		resp, err := http.Get(rs.URL + "/reverse")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		ctx := <-d.done
+		require.True(t, ctx.Denied)
+		require.Equal(t, "/reverse", ctx.Req.URL.Path)
+	})
+
+	// SOCKS5和透明代理监听在Accept后直接关闭被拒绝的连接
+	listeners := map[string]func(p *Proxy, l net.Listener) error{
+		"socks5": (*Proxy).ServeSOCKS5,
+		"transparent": func(p *Proxy, l net.Listener) error {
+			return p.ServeTransparent(l, func(conn net.Conn) (string, error) {
+				return upstream.Listener.Addr().String(), nil
+			})
+		},
+	}
+	for name, serve := range listeners {
+		t.Run(name+" denied", func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+			go serve(New(WithClientACL(deny, false)), l)
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			conn.Write([]byte{5, 1, 0})
+			_, err = conn.Read(make([]byte, 2))
+			require.Error(t, err)
+			require.False(t, isTimeoutError(err))
+		})
+	}
+}
+
+func TestDecryptACL(t *testing.T) {
+	deny, err := NewACL(nil, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	p := New(WithDecryptHTTPS(&memCache{}), WithDecryptACL(deny))
+	ctx := &Context{Req: &http.Request{RemoteAddr: "127.0.0.1:5", URL: &url.URL{Host: "example.com:443"}}}
+	require.False(t, p.shouldDecrypt(ctx))
+	ctx.Req.RemoteAddr = "10.0.0.1:5"
+	require.True(t, p.shouldDecrypt(ctx))
+}
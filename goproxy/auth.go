@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"mars/filterrules"
+)
+
+// User 代理认证用户
+type User struct {
+	// Name 用户名
+	Name string
+	// ParentProxy 用户专属上级代理, 为nil时使用默认上级代理
+	ParentProxy *url.URL
+	// Rules 用户专属过滤规则, 为nil时使用全局规则
+	Rules *filterrules.Rules
+}
+
+// Authenticator 代理身份认证接口
+type Authenticator interface {
+	// Authenticate 校验用户名密码, 成功返回对应用户
+	Authenticate(username, password string) (*User, bool)
+}
+
+type userContextKey struct{}
+
+// UserFromRequest 获取请求对应的认证用户, 未认证返回nil
+func UserFromRequest(req *http.Request) *User {
+	user, _ := req.Context().Value(userContextKey{}).(*User)
+
+	return user
+}
+
+// 认证用户写入请求上下文, 供transport选择上级代理使用
+func withUser(req *http.Request, user *User) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userContextKey{}, user))
+}
+
+// 解析Proxy-Authorization
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return
+	}
+	cs := string(c)
+	i := strings.IndexByte(cs, ':')
+	if i < 0 {
+		return
+	}
+
+	return cs[:i], cs[i+1:], true
+}
+
+// 代理身份认证, 失败时返回407
+func (p *Proxy) authenticate(ctx *Context, rw http.ResponseWriter) {
+	username, password, ok := proxyBasicAuth(ctx.Req)
+	if ok {
+		if user, ok := p.authenticator.Authenticate(username, password); ok {
+			ctx.Req.Header.Del("Proxy-Authorization")
+			ctx.User = user
+			ctx.Req = withUser(ctx.Req, user)
+			return
+		}
+		p.delegate.ErrorLog(fmt.Errorf("%s - 代理认证失败: [user: %s] [client: %s]", ctx.Req.URL.Host, username, ctx.Req.RemoteAddr))
+	}
+	rw.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", p.authRealm))
+	rw.WriteHeader(http.StatusProxyAuthRequired)
+	ctx.Abort()
+}
@@ -0,0 +1,248 @@
+package cert
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 导出格式
+const (
+	FormatPEM = "pem"
+	FormatDER = "der"
+	FormatP12 = "p12"
+	// FormatMobileConfig iOS描述文件
+	FormatMobileConfig = "mobileconfig"
+)
+
+// CAOptions 根证书参数
+type CAOptions struct {
+	// CommonName 默认Mars Root CA
+	CommonName string
+	// Organization 默认Mars
+	Organization string
+	// ValidDays 有效天数, 默认3650
+	ValidDays int
+	// KeyBits RSA私钥长度, 默认2048
+	KeyBits int
+}
+
+func (o *CAOptions) setDefaults() {
+	if o.CommonName == "" {
+		o.CommonName = "Mars Root CA"
+	}
+	if o.Organization == "" {
+		o.Organization = "Mars"
+	}
+	if o.ValidDays <= 0 {
+		o.ValidDays = 3650
+	}
+	if o.KeyBits <= 0 {
+		o.KeyBits = 2048
+	}
+}
+
+// GenerateCA 生成自签名根证书, 返回PEM编码的证书和私钥
+func GenerateCA(opts CAOptions) (certPEM, keyPEM []byte, err error) {
+	opts.setDefaults()
+	priv, err := rsa.GenerateKey(rand.Reader, opts.KeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("生成证书序列号失败: %s", err)
+	}
+	// 私钥标识, 签发的证书通过AuthorityKeyId关联
+	keyID := sha1.Sum(x509.MarshalPKCS1PublicKey(&priv.PublicKey))
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   opts.CommonName,
+			Organization: []string{opts.Organization},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, opts.ValidDays),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		SubjectKeyId:          keyID[:],
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+
+	return certPEM, keyPEM, nil
+}
+
+// CreateCA 生成根证书并写入文件, 私钥文件权限为0600
+func CreateCA(certFile, keyFile string, opts CAOptions) error {
+	certPEM, keyPEM, err := GenerateCA(opts)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	return writeFile(certFile, certPEM, 0644)
+}
+
+// EnsureCA 根证书和私钥都不存在时生成, 返回是否生成了新证书
+func EnsureCA(certFile, keyFile string, opts CAOptions) (bool, error) {
+	certExists, err := fileExists(certFile)
+	if err != nil {
+		return false, err
+	}
+	keyExists, err := fileExists(keyFile)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case certExists && keyExists:
+		return false, nil
+	case certExists || keyExists:
+		return false, fmt.Errorf("根证书与私钥只存在一个: [cert: %s] [key: %s]", certFile, keyFile)
+	}
+
+	return true, CreateCA(certFile, keyFile, opts)
+}
+
+// Root 解密HTTPS使用的根证书, 未加载时按配置文件加载
+func Root() (*x509.Certificate, error) {
+	if err := loadRoot(); err != nil {
+		return nil, err
+	}
+
+	return RootCA, nil
+}
+
+// LoadCA 加载根证书及私钥
+func LoadCA(certFile, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	ca, err := LoadCACertificate(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, err := readPEM(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析根证书私钥失败: %s", err)
+	}
+	pub, ok := ca.PublicKey.(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(key.N) != 0 {
+		return nil, nil, errors.New("根证书与私钥不匹配")
+	}
+
+	return ca, key, nil
+}
+
+// LoadCACertificate 加载根证书
+func LoadCACertificate(certFile string) (*x509.Certificate, error) {
+	block, err := readPEM(certFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析根证书失败: %s", err)
+	}
+
+	return ca, nil
+}
+
+// ExportCA 导出根证书, p12格式key不为nil时包含私钥
+func ExportCA(ca *x509.Certificate, key *rsa.PrivateKey, format, password string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case FormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), nil
+	case FormatDER:
+		return ca.Raw, nil
+	case FormatP12:
+		// nil的*rsa.PrivateKey转为interface{}后不为nil
+		if key == nil {
+			return EncodePKCS12(ca, nil, password)
+		}
+		return EncodePKCS12(ca, key, password)
+	case FormatMobileConfig:
+		return MobileConfig(ca)
+	}
+
+	return nil, fmt.Errorf("不支持的导出格式: %s", format)
+}
+
+// FingerprintSHA256 证书SHA-256指纹, 十六进制以:分隔
+func FingerprintSHA256(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+
+	return formatFingerprint(sum[:])
+}
+
+// FingerprintSHA1 证书SHA-1指纹, 十六进制以:分隔
+func FingerprintSHA1(c *x509.Certificate) string {
+	sum := sha1.Sum(c.Raw)
+
+	return formatFingerprint(sum[:])
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func fileExists(filename string) (bool, error) {
+	_, err := os.Stat(filename)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("不是PEM格式: %s", filename)
+	}
+
+	return block, nil
+}
+
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	if dir := filepath.Dir(filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(filename, data, perm)
+}
@@ -2,105 +2,236 @@
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"mars/internal/app/config"
 	"math/big"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"mars/internal/app/config"
 )
 
 var (
 	RootCA  *x509.Certificate
 	RootKey *rsa.PrivateKey
+
+	rootOnce sync.Once
+	rootErr  error
+)
+
+// KeyType 证书私钥类型
+type KeyType string
+
+const (
+	// KeyRSA RSA-2048
+	KeyRSA KeyType = "rsa"
+	// KeyECDSA ECDSA P-256, 生成速度远快于RSA
+	KeyECDSA KeyType = "ecdsa"
+)
+
+// 证书序列号上限, 128位随机数
+var serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// 证书有效期, 不超过浏览器允许的398天, 生效时间提前1小时兼容客户端时钟偏差
+const (
+	leafValidity = 397 * 24 * time.Hour
+	leafBackdate = time.Hour
 )
 
+// UpstreamFunc 获取上游服务器证书, 用于复制SAN
+type UpstreamFunc func() (*x509.Certificate, error)
+
+// Hooks 证书缓存、生成的回调, 用于统计, 为nil时不回调
+type Hooks struct {
+	// CacheLookup 查询证书缓存后回调, hit为是否命中
+	CacheLookup func(hit bool)
+	// Generate 生成证书后回调, err为生成错误
+	Generate func(err error)
+}
+
 // Certificate 证书管理
 type Certificate struct {
 	Cache Cache
+	// KeyType 私钥类型, 默认RSA
+	KeyType KeyType
+	// Hooks 回调
+	Hooks Hooks
+
+	mu       sync.Mutex
+	inflight map[string]*generateCall
+}
+
+// 正在生成的证书, 同一host的并发请求等待同一个结果
+type generateCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
 }
 
 // Generate 生成证书
 func (c *Certificate) Generate(host string) (*tls.Config, error) {
-	if RootCA == nil || RootKey == nil {
+	cert, err := c.Get(host, nil)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	}
 
-		var err error
-		RootCA, err = loadRootCA()
-		if err != nil {
-			panic(fmt.Errorf("加载根证书失败: %s", err))
-		}
-		RootKey, err = loadRootKey()
-		if err != nil {
-			panic(fmt.Errorf("加载根证书私钥失败: %s", err))
-		}
+	return tlsConf, nil
+}
 
+// Get 获取host的证书, 缓存中没有时生成, 同一host并发获取时只生成一次.
+// upstream不为nil时证书包含上游证书的SAN, 获取上游证书失败则只包含host.
+// 私钥类型、复制的SAN不同时使用不同的缓存
+func (c *Certificate) Get(host string, upstream UpstreamFunc) (*tls.Certificate, error) {
+	if err := loadRoot(); err != nil {
+		return nil, err
 	}
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
 	}
+	host = strings.ToLower(host)
+	var upstreamCert *x509.Certificate
+	if upstream != nil {
+		upstreamCert, _ = upstream()
+	}
+	key := c.cacheKey(host, upstreamCert)
 	// 先从缓存中查找证书
-	if cert := c.Cache.Get(host); cert != nil {
-		tlsConf := &tls.Config{
-			Certificates: []tls.Certificate{*cert},
-		}
+	cert := c.Cache.Get(key)
+	if c.Hooks.CacheLookup != nil {
+		c.Hooks.CacheLookup(cert != nil)
+	}
+	if cert != nil {
+		return cert, nil
+	}
 
-		return tlsConf, nil
+	c.mu.Lock()
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
 	}
+	call := &generateCall{done: make(chan struct{})}
+	if c.inflight == nil {
+		c.inflight = make(map[string]*generateCall)
+	}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.cert, call.err = c.generate(host, upstreamCert)
+	if c.Hooks.Generate != nil {
+		c.Hooks.Generate(call.err)
+	}
+	if call.err == nil {
+		// 缓存证书
+		c.Cache.Set(key, call.cert)
+	}
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.cert, call.err
+}
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+// 缓存key, 格式 host|私钥类型[|复制的SAN集合的哈希]
+func (c *Certificate) cacheKey(host string, upstreamCert *x509.Certificate) string {
+	keyType := c.KeyType
+	if keyType == "" {
+		keyType = KeyRSA
+	}
+	key := host + "|" + string(keyType)
+	if upstreamCert == nil {
+		return key
+	}
+	sans := make([]string, 0, len(upstreamCert.DNSNames)+len(upstreamCert.IPAddresses))
+	for _, name := range upstreamCert.DNSNames {
+		sans = append(sans, strings.ToLower(name))
+	}
+	for _, ip := range upstreamCert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sort.Strings(sans)
+	sum := sha256.Sum256([]byte(strings.Join(sans, ",")))
+
+	return key + "|" + hex.EncodeToString(sum[:8])
+}
+
+// 生成由根证书签发的证书, upstreamCert不为nil时复制其SAN
+func (c *Certificate) generate(host string, upstreamCert *x509.Certificate) (*tls.Certificate, error) {
+	priv, err := c.generateKey()
 	if err != nil {
 		return nil, err
 	}
-	tmpl := c.template(host)
-	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, RootCA, &priv.PublicKey, RootKey) // 根据主证书创建证书
+	tmpl, err := c.template(host)
 	if err != nil {
 		return nil, err
 	}
-	certBlock := &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: derBytes,
+	if upstreamCert != nil {
+		mirrorSANs(tmpl, upstreamCert)
 	}
-	serverCert := pem.EncodeToMemory(certBlock)
-
-	keyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, RootCA, priv.Public(), RootKey) // 根据主证书创建证书
+	if err != nil {
+		return nil, err
 	}
-	serverKey := pem.EncodeToMemory(keyBlock)
-
-	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	leaf, err := x509.ParseCertificate(derBytes)
 	if err != nil {
 		return nil, err
 	}
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	cert := &tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+		Leaf:        leaf,
 	}
 
-	// 缓存证书
-	c.Cache.Set(host, &cert)
+	return cert, nil
+}
 
-	return tlsConf, nil
+// 按KeyType生成私钥
+func (c *Certificate) generateKey() (crypto.Signer, error) {
+	switch c.KeyType {
+	case "", KeyRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+
+	return nil, fmt.Errorf("不支持的私钥类型: %s", c.KeyType)
 }
 
-func (c *Certificate) template(host string) *x509.Certificate {
+func (c *Certificate) template(host string) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("生成证书序列号失败: %s", err)
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if c.KeyType != KeyECDSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	now := time.Now()
 	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName: host,
 		},
-		NotBefore:             time.Now().AddDate(-1, 0, 0),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
+		NotBefore:             now.Add(-leafBackdate),
+		NotAfter:              now.Add(leafValidity),
 		BasicConstraintsValid: true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment,
-		EmailAddresses:        []string{"qingqianludao@gmail.com"},
+		KeyUsage:              keyUsage,
 	}
 
 	if ip := net.ParseIP(host); ip != nil {
@@ -109,33 +240,51 @@ func (c *Certificate) template(host string) *x509.Certificate {
 		cert.DNSNames = []string{host}
 	}
 
-	return cert
+	return cert, nil
 }
 
-// 加载根证书
-func loadRootCA() (*x509.Certificate, error) {
-
-	log.Println(config.Conf)
-	keyBytes, err := ioutil.ReadFile(config.Conf.Certificate.BasePrivate)
-
-	if err != nil {
-		panic("Unable to read keyPem")
+// 复制上游证书的SAN, 客户端校验证书时与直连看到的域名范围一致
+func mirrorSANs(tmpl, upstream *x509.Certificate) {
+	for _, name := range upstream.DNSNames {
+		if !containsString(tmpl.DNSNames, name) {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	for _, ip := range upstream.IPAddresses {
+		found := false
+		for _, existing := range tmpl.IPAddresses {
+			if existing.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
 	}
-
-	block, _ := pem.Decode(keyBytes)
-
-	return x509.ParseCertificate(block.Bytes)
 }
 
-// 加载根证书私钥
-func loadRootKey() (*rsa.PrivateKey, error) {
-	keyBytes, err := ioutil.ReadFile(config.Conf.Certificate.CaPrivate)
-
-	if err != nil {
-		panic("Unable to read keyPem")
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
 	}
 
-	block, _ := pem.Decode(keyBytes)
+	return false
+}
+
+// 加载根证书及私钥, 只加载一次
+func loadRoot() error {
+	rootOnce.Do(func() {
+		if RootCA != nil && RootKey != nil {
+			return
+		}
+		RootCA, RootKey, rootErr = LoadCA(config.Conf.Certificate.BasePrivate, config.Conf.Certificate.CaPrivate)
+		if rootErr != nil {
+			rootErr = fmt.Errorf("加载根证书失败: %s", rootErr)
+		}
+	})
 
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	return rootErr
 }
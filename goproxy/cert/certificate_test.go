@@ -0,0 +1,126 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateGet(t *testing.T) {
+	loadTestCA(t)
+	var mu sync.Mutex
+	var hits, misses, generated, failed int
+	c := &Certificate{
+		Cache:   &memCache{},
+		KeyType: KeyECDSA,
+		Hooks: Hooks{
+			CacheLookup: func(hit bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				if hit {
+					hits++
+				} else {
+					misses++
+				}
+			},
+			Generate: func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				generated++
+				if err != nil {
+					failed++
+				}
+			},
+		},
+	}
+
+	// 同一host并发获取只生成一次
+	certs := make([]*tls.Certificate, 10)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			certs[i], _ = c.Get("Example.com:443", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, cert := range certs {
+		require.NotNil(t, cert)
+		require.True(t, cert == certs[0])
+	}
+	require.Equal(t, 1, generated)
+	require.Zero(t, failed)
+	require.Equal(t, []string{"example.com"}, certs[0].Leaf.DNSNames)
+
+	cert, err := c.Get("example.com", nil)
+	require.NoError(t, err)
+	require.True(t, cert == certs[0])
+	require.Equal(t, 11, hits+misses)
+	require.GreaterOrEqual(t, hits, 1)
+
+	// 获取上游证书失败时只包含host
+	cert, err = c.Get("127.0.0.1", func() (*x509.Certificate, error) {
+		return nil, errors.New("unreachable")
+	})
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", cert.Leaf.IPAddresses[0].String())
+	require.Equal(t, 2, generated)
+}
+
+func TestCertificateValidity(t *testing.T) {
+	loadTestCA(t)
+	c := &Certificate{Cache: &memCache{}, KeyType: KeyECDSA}
+	before := time.Now()
+	cert, err := c.Get("example.com", nil)
+	require.NoError(t, err)
+	leaf := cert.Leaf
+	require.True(t, leaf.NotBefore.Before(before))
+	require.True(t, leaf.NotBefore.After(before.Add(-2*time.Hour)))
+	// 有效期不超过398天
+	require.True(t, leaf.NotAfter.Sub(leaf.NotBefore) <= 398*24*time.Hour)
+	require.True(t, leaf.NotAfter.After(before.Add(396*24*time.Hour)))
+}
+
+func TestCertificateCacheKey(t *testing.T) {
+	loadTestCA(t)
+	cache := &memCache{}
+	ecdsaCert := &Certificate{Cache: cache, KeyType: KeyECDSA}
+	rsaCert := &Certificate{Cache: cache}
+	upstream := func(names ...string) UpstreamFunc {
+		return func() (*x509.Certificate, error) {
+			return &x509.Certificate{DNSNames: names}, nil
+		}
+	}
+
+	plain, err := ecdsaCert.Get("example.com", nil)
+	require.NoError(t, err)
+	require.IsType(t, &ecdsa.PrivateKey{}, plain.PrivateKey)
+	// 共用缓存时私钥类型不同不能复用
+	rsaLeaf, err := rsaCert.Get("example.com", nil)
+	require.NoError(t, err)
+	require.IsType(t, &rsa.PrivateKey{}, rsaLeaf.PrivateKey)
+
+	// 复制的SAN不同时分别生成, 相同SAN集合复用
+	mirrored, err := ecdsaCert.Get("example.com", upstream("example.com", "www.example.com"))
+	require.NoError(t, err)
+	require.False(t, mirrored == plain)
+	require.Equal(t, []string{"example.com", "www.example.com"}, mirrored.Leaf.DNSNames)
+	cert, err := ecdsaCert.Get("example.com", upstream("WWW.example.com", "example.com"))
+	require.NoError(t, err)
+	require.True(t, cert == mirrored)
+	cert, err = ecdsaCert.Get("example.com", upstream("example.com", "api.example.com"))
+	require.NoError(t, err)
+	require.False(t, cert == mirrored)
+	require.Equal(t, []string{"example.com", "api.example.com"}, cert.Leaf.DNSNames)
+	cert, err = ecdsaCert.Get("example.com", nil)
+	require.NoError(t, err)
+	require.True(t, cert == plain)
+}
@@ -0,0 +1,180 @@
+package cert
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 证书剩余有效期小于该值时重新生成
+const defaultRenewBefore = 7 * 24 * time.Hour
+
+// 有效期超过398天的证书不被浏览器接受, 如旧版本生成的2年有效期证书, 需重新生成
+const maxLeafValidity = 398 * 24 * time.Hour
+
+// DiskCache 证书及私钥持久化到磁盘, 重启后无需重新生成.
+// 按根证书指纹分目录保存, 更换根证书后删除旧目录, 文件权限为0600
+type DiskCache struct {
+	dir string
+	// mem 内存缓存, 命中时不读取磁盘
+	mem Cache
+	// RenewBefore 剩余有效期小于该值的证书视为失效, 默认7天
+	RenewBefore time.Duration
+
+	cleanOnce sync.Once
+}
+
+// NewDiskCache 创建DiskCache, dir不存在时创建
+func NewDiskCache(dir string, mem Cache) (*DiskCache, error) {
+	if dir == "" {
+		return nil, errors.New("证书缓存目录不能为空")
+	}
+	if mem == nil {
+		return nil, errors.New("内存缓存不能为nil")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:         dir,
+		mem:         mem,
+		RenewBefore: defaultRenewBefore,
+	}
+
+	return c, nil
+}
+
+// Get 获取证书, 内存中没有时从磁盘加载, 证书即将过期、有效期过长或不是当前根证书签发则返回nil
+func (c *DiskCache) Get(host string) *tls.Certificate {
+	if cert := c.mem.Get(host); cert != nil && c.valid(cert.Leaf) {
+		return cert
+	}
+	caDir, ok := c.caDir()
+	if !ok {
+		return nil
+	}
+	filename := filepath.Join(caDir, cacheFilename(host))
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil || !c.valid(cert.Leaf) || cert.Leaf.CheckSignatureFrom(RootCA) != nil {
+		os.Remove(filename)
+		return nil
+	}
+	c.mem.Set(host, &cert)
+
+	return &cert
+}
+
+// Set 保存证书, 写入磁盘失败时只保存在内存中
+func (c *DiskCache) Set(host string, cert *tls.Certificate) {
+	c.mem.Set(host, cert)
+	caDir, ok := c.caDir()
+	if !ok || len(cert.Certificate) == 0 {
+		return
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	if err = os.MkdirAll(caDir, 0700); err != nil {
+		return
+	}
+	// 先写临时文件再重命名, 避免并发读取到不完整的文件
+	tmp, err := ioutil.TempFile(caDir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(caDir, cacheFilename(host)))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+func (c *DiskCache) valid(leaf *x509.Certificate) bool {
+	if leaf == nil {
+		return false
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore) > maxLeafValidity {
+		return false
+	}
+	now := time.Now()
+
+	return now.After(leaf.NotBefore) && now.Add(c.RenewBefore).Before(leaf.NotAfter)
+}
+
+// 当前根证书对应的目录, 首次调用时删除其他根证书的目录
+func (c *DiskCache) caDir() (string, bool) {
+	if loadRoot() != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(RootCA.Raw)
+	name := hex.EncodeToString(sum[:])
+	c.cleanOnce.Do(func() {
+		c.removeStale(name)
+	})
+
+	return filepath.Join(c.dir, name), true
+}
+
+// 删除非当前根证书签发的证书目录
+func (c *DiskCache) removeStale(current string) {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != current && isFingerprintDir(entry.Name()) {
+			os.RemoveAll(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+}
+
+func isFingerprintDir(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+
+	return err == nil
+}
+
+// host转为文件名, 包含特殊字符(如IPv6的:)时替换并追加哈希避免冲突
+func cacheFilename(host string) string {
+	replaced := false
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		replaced = true
+		return '_'
+	}, strings.ToLower(host))
+	if replaced {
+		sum := sha256.Sum256([]byte(host))
+		name += "-" + hex.EncodeToString(sum[:4])
+	}
+
+	return name + ".pem"
+}
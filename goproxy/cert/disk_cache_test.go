@@ -0,0 +1,166 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 创建临时目录作为磁盘缓存目录
+func tempCacheDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mars-cert-")
+	require.NoError(t, err)
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// 当前根证书对应的缓存目录
+func rootCacheDir(dir string) string {
+	sum := sha256.Sum256(RootCA.Raw)
+
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// 自签名证书, 不是根证书签发
+func selfSignedCert(t *testing.T, host string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestNewDiskCache(t *testing.T) {
+	_, err := NewDiskCache("", &memCache{})
+	require.Error(t, err)
+	_, err = NewDiskCache(os.TempDir(), nil)
+	require.Error(t, err)
+
+	dir, cleanup := tempCacheDir(t)
+	defer cleanup()
+	c, err := NewDiskCache(filepath.Join(dir, "certs"), &memCache{})
+	require.NoError(t, err)
+	require.Equal(t, defaultRenewBefore, c.RenewBefore)
+	info, err := os.Stat(filepath.Join(dir, "certs"))
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+}
+
+func TestDiskCache(t *testing.T) {
+	loadTestCA(t)
+	dir, cleanup := tempCacheDir(t)
+	defer cleanup()
+	// 其他根证书的目录在首次访问时删除, 无关目录保留
+	stale := filepath.Join(dir, hex.EncodeToString(make([]byte, sha256.Size)))
+	require.NoError(t, os.MkdirAll(stale, 0700))
+	other := filepath.Join(dir, "other")
+	require.NoError(t, os.MkdirAll(other, 0700))
+
+	generator := &Certificate{Cache: &memCache{}, KeyType: KeyECDSA}
+	cert, err := generator.Get("example.com", nil)
+	require.NoError(t, err)
+
+	c, err := NewDiskCache(dir, &memCache{})
+	require.NoError(t, err)
+	require.Nil(t, c.Get("example.com"))
+	c.Set("example.com", cert)
+	require.True(t, c.Get("example.com") == cert)
+
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(other)
+	require.NoError(t, err)
+	filename := filepath.Join(rootCacheDir(dir), "example.com.pem")
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	t.Run("reload", func(t *testing.T) {
+		mem := &memCache{}
+		c, err := NewDiskCache(dir, mem)
+		require.NoError(t, err)
+		loaded := c.Get("example.com")
+		require.NotNil(t, loaded)
+		require.Equal(t, cert.Certificate, loaded.Certificate)
+		require.Equal(t, cert.Leaf.Raw, loaded.Leaf.Raw)
+		// 加载后写入内存缓存
+		require.True(t, mem.Get("example.com") == loaded)
+	})
+
+	t.Run("expiring", func(t *testing.T) {
+		c, err := NewDiskCache(dir, &memCache{})
+		require.NoError(t, err)
+		c.RenewBefore = 100 * 365 * 24 * time.Hour
+		require.Nil(t, c.Get("example.com"))
+		_, err = os.Stat(filename)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("validity too long", func(t *testing.T) {
+		// 旧版本生成的证书有效期为前后各1年
+		tmpl, err := generator.template("old.example.com")
+		require.NoError(t, err)
+		tmpl.NotBefore = time.Now().AddDate(-1, 0, 0)
+		tmpl.NotAfter = time.Now().AddDate(1, 0, 0)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, RootCA, cert.Leaf.PublicKey, RootKey)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		old := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: cert.PrivateKey, Leaf: leaf}
+
+		c, err := NewDiskCache(dir, &memCache{})
+		require.NoError(t, err)
+		c.Set("old.example.com", old)
+		require.Nil(t, c.Get("old.example.com"))
+
+		c, err = NewDiskCache(dir, &memCache{})
+		require.NoError(t, err)
+		require.Nil(t, c.Get("old.example.com"))
+		_, err = os.Stat(filepath.Join(rootCacheDir(dir), "old.example.com.pem"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("foreign signer", func(t *testing.T) {
+		c, err := NewDiskCache(dir, &memCache{})
+		require.NoError(t, err)
+		c.Set("foreign.example.com", selfSignedCert(t, "foreign.example.com"))
+
+		c, err = NewDiskCache(dir, &memCache{})
+		require.NoError(t, err)
+		require.Nil(t, c.Get("foreign.example.com"))
+		_, err = os.Stat(filepath.Join(rootCacheDir(dir), "foreign.example.com.pem"))
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestCacheFilename(t *testing.T) {
+	require.Equal(t, "example.com.pem", cacheFilename("example.com"))
+	require.Equal(t, "xn--fiq228c.com.pem", cacheFilename("xn--fiq228c.com"))
+	require.Equal(t, "example.com.pem", cacheFilename("Example.COM"))
+	// 替换后相同的host文件名不同
+	require.Regexp(t, `^__1-[0-9a-f]{8}\.pem$`, cacheFilename("::1"))
+	require.NotEqual(t, cacheFilename("::1"), cacheFilename("_:1"))
+}
@@ -0,0 +1,37 @@
+package cert
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memCache 内存证书缓存
+type memCache struct {
+	m sync.Map
+}
+
+func (c *memCache) Set(host string, v *tls.Certificate) {
+	c.m.Store(host, v)
+}
+
+func (c *memCache) Get(host string) *tls.Certificate {
+	v, ok := c.m.Load(host)
+	if !ok {
+		return nil
+	}
+
+	return v.(*tls.Certificate)
+}
+
+// 加载仓库中的根证书
+func loadTestCA(t *testing.T) {
+	if RootCA != nil {
+		return
+	}
+	ca, key, err := LoadCA("../../conf/private/base.key.pem", "../../conf/private/ca.key.pem")
+	require.NoError(t, err)
+	RootCA, RootKey = ca, key
+}
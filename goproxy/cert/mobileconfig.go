@@ -0,0 +1,84 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"text/template"
+)
+
+var mobileConfigTemplate = template.Must(template.New("mobileconfig").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>mars-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Certificate}}</data>
+			<key>PayloadDescription</key>
+			<string>Mars根证书, 用于解密HTTPS流量</string>
+			<key>PayloadDisplayName</key>
+			<string>{{xml .Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.apple.security.root.{{.CertUUID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{xml .Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>mars.ca.{{.ProfileUUID}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// MobileConfig 生成iOS描述文件, 安装后需在 设置-通用-关于本机-证书信任设置 中启用完全信任.
+// UUID由证书指纹生成, 同一根证书重复安装时替换原描述文件
+func MobileConfig(ca *x509.Certificate) ([]byte, error) {
+	sum := sha256.Sum256(ca.Raw)
+	name := ca.Subject.CommonName
+	if name == "" {
+		name = "Mars Root CA"
+	}
+	var buf bytes.Buffer
+	err := mobileConfigTemplate.Execute(&buf, map[string]string{
+		"Certificate": base64.StdEncoding.EncodeToString(ca.Raw),
+		"Name":        name,
+		"CertUUID":    formatUUID(sum[:16]),
+		"ProfileUUID": formatUUID(sum[16:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
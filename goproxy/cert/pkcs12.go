@@ -0,0 +1,306 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+)
+
+// PKCS#12编码(RFC 7292), 证书不加密, 私钥使用pbeWithSHAAnd3-KeyTripleDES-CBC加密, 完整性使用HMAC-SHA1
+var (
+	oidDataContentType            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertTypeX509Certificate    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyTripleDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const pkcs12Iterations = 2048
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data asn1.RawValue
+}
+
+type encryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// EncodePKCS12 证书及可选的私钥编码为PKCS#12, privateKey为nil时只包含证书
+func EncodePKCS12(certificate *x509.Certificate, privateKey interface{}, password string) ([]byte, error) {
+	encodedPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+	var attributes []pkcs12Attribute
+	if privateKey != nil {
+		// 证书与私钥通过相同的localKeyId关联
+		keyID := sha1.Sum(certificate.Raw)
+		attr, err := newLocalKeyIDAttribute(keyID[:])
+		if err != nil {
+			return nil, err
+		}
+		attributes = []pkcs12Attribute{attr}
+	}
+
+	certBagValue, err := asn1.Marshal(certBag{
+		ID:   oidCertTypeX509Certificate,
+		Data: explicitOctetString(certificate.Raw),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 与OpenSSL相同, 证书与私钥分别放在两个SafeContents中
+	certInfo, err := safeContentInfo(safeBag{
+		ID:         oidCertBag,
+		Value:      explicitTag(certBagValue),
+		Attributes: attributes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	infos := []contentInfo{certInfo}
+	if privateKey != nil {
+		keyBagValue, err := encryptPrivateKey(privateKey, encodedPassword)
+		if err != nil {
+			return nil, err
+		}
+		keyInfo, err := safeContentInfo(safeBag{
+			ID:         oidPKCS8ShroudedKeyBag,
+			Value:      explicitTag(keyBagValue),
+			Attributes: attributes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, keyInfo)
+	}
+	authenticatedSafe, err := asn1.Marshal(infos)
+	if err != nil {
+		return nil, err
+	}
+	pfx := pfxPdu{Version: 3}
+	pfx.AuthSafe, err = dataContentInfo(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	pfx.MacData.MacSalt = make([]byte, 8)
+	if _, err = rand.Read(pfx.MacData.MacSalt); err != nil {
+		return nil, err
+	}
+	pfx.MacData.Iterations = pkcs12Iterations
+	pfx.MacData.Mac.Algorithm = pkix.AlgorithmIdentifier{
+		Algorithm:  oidSHA1,
+		Parameters: asn1.NullRawValue,
+	}
+	macKey := pkcs12KDF(pfx.MacData.MacSalt, encodedPassword, pkcs12Iterations, 3, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+	pfx.MacData.Mac.Digest = mac.Sum(nil)
+
+	return asn1.Marshal(pfx)
+}
+
+// 私钥编码为PKCS#8后加密
+func encryptPrivateKey(privateKey interface{}, password []byte) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	params := pbeParams{
+		Salt:       make([]byte, 8),
+		Iterations: pkcs12Iterations,
+	}
+	if _, err = rand.Read(params.Salt); err != nil {
+		return nil, err
+	}
+	paramBytes, err := asn1.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	key := pkcs12KDF(params.Salt, password, params.Iterations, 1, 24)
+	iv := pkcs12KDF(params.Salt, password, params.Iterations, 2, des.BlockSize)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := des.BlockSize - len(pkcs8)%des.BlockSize
+	data := append(pkcs8, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		AlgorithmIdentifier: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleDES,
+			Parameters: asn1.RawValue{FullBytes: paramBytes},
+		},
+		EncryptedData: data,
+	})
+}
+
+func newLocalKeyIDAttribute(keyID []byte) (pkcs12Attribute, error) {
+	value, err := asn1.Marshal(keyID)
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+
+	return pkcs12Attribute{
+		ID: oidLocalKeyID,
+		Value: asn1.RawValue{
+			Class:      asn1.ClassUniversal,
+			Tag:        asn1.TagSet,
+			IsCompound: true,
+			Bytes:      value,
+		},
+	}, nil
+}
+
+// 包含bags的SafeContents, 封装为data类型的ContentInfo
+func safeContentInfo(bags ...safeBag) (contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	return dataContentInfo(safeContents)
+}
+
+// data类型的ContentInfo, 内容为OCTET STRING
+func dataContentInfo(content []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	return contentInfo{
+		ContentType: oidDataContentType,
+		Content:     explicitTag(octets),
+	}, nil
+}
+
+// [0] EXPLICIT
+func explicitTag(der []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      der,
+	}
+}
+
+// [0] EXPLICIT OCTET STRING
+func explicitOctetString(b []byte) asn1.RawValue {
+	octets, _ := asn1.Marshal(b)
+
+	return explicitTag(octets)
+}
+
+// 密码编码为以两个0字节结尾的BMPString
+func bmpString(s string) ([]byte, error) {
+	ret := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if r > 0xffff {
+			return nil, errors.New("PKCS#12密码不支持BMP以外的字符")
+		}
+		ret = append(ret, byte(r/256), byte(r%256))
+	}
+
+	return append(ret, 0, 0), nil
+}
+
+// RFC 7292附录B.2的密钥派生, 使用SHA1, id为1时生成密钥, 2为IV, 3为MAC密钥
+func pkcs12KDF(salt, password []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		n := v * ((len(b) + v - 1) / v)
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := bytes.Repeat([]byte{id}, v)
+	I := append(fill(salt), fill(password)...)
+
+	var A []byte
+	for len(A) < size {
+		h := sha1.New()
+		h.Write(D)
+		h.Write(I)
+		Ai := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(Ai)
+			Ai = sum[:]
+		}
+		A = append(A, Ai...)
+
+		B := make([]byte, v)
+		for j := range B {
+			B[j] = Ai[j%u]
+		}
+		// I的每个v字节块 Ij = (Ij + B + 1) mod 2^(v*8)
+		for j := 0; j < len(I); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(I[j+k]) + int(B[k])
+				I[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+
+	return A[:size]
+}
@@ -0,0 +1,76 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// 编码结果用x/crypto/pkcs12解码, 证书、私钥与原始内容一致
+func TestEncodePKCS12(t *testing.T) {
+	loadTestCA(t)
+
+	data, err := ExportCA(RootCA, RootKey, FormatP12, "mars")
+	require.NoError(t, err)
+	key, certificate, err := pkcs12.Decode(data, "mars")
+	require.NoError(t, err)
+	require.Equal(t, RootCA.Raw, certificate.Raw)
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	require.True(t, ok)
+	require.Equal(t, 0, RootKey.N.Cmp(rsaKey.N))
+	require.Equal(t, 0, RootKey.D.Cmp(rsaKey.D))
+	_, _, err = pkcs12.Decode(data, "wrong")
+	require.Error(t, err)
+
+	// 空密码
+	data, err = EncodePKCS12(RootCA, RootKey, "")
+	require.NoError(t, err)
+	_, certificate, err = pkcs12.Decode(data, "")
+	require.NoError(t, err)
+	require.Equal(t, RootCA.Raw, certificate.Raw)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	data, err = EncodePKCS12(RootCA, ecKey, "mars")
+	require.NoError(t, err)
+	key, _, err = pkcs12.Decode(data, "mars")
+	require.NoError(t, err)
+	decodedECKey, ok := key.(*ecdsa.PrivateKey)
+	require.True(t, ok)
+	require.Equal(t, 0, ecKey.D.Cmp(decodedECKey.D))
+
+	// 不含私钥时只有一个SafeContents, 其中只有证书
+	data, err = ExportCA(RootCA, nil, FormatP12, "mars")
+	require.NoError(t, err)
+	var pfx pfxPdu
+	_, err = asn1.Unmarshal(data, &pfx)
+	require.NoError(t, err)
+	var authenticatedSafe []byte
+	_, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe)
+	require.NoError(t, err)
+	var infos []contentInfo
+	_, err = asn1.Unmarshal(authenticatedSafe, &infos)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	var safeContents []byte
+	_, err = asn1.Unmarshal(infos[0].Content.Bytes, &safeContents)
+	require.NoError(t, err)
+	var bags []safeBag
+	_, err = asn1.Unmarshal(safeContents, &bags)
+	require.NoError(t, err)
+	require.Len(t, bags, 1)
+	require.True(t, bags[0].ID.Equal(oidCertBag))
+	var bag certBag
+	_, err = asn1.Unmarshal(bags[0].Value.Bytes, &bag)
+	require.NoError(t, err)
+	var raw []byte
+	_, err = asn1.Unmarshal(bag.Data.Bytes, &raw)
+	require.NoError(t, err)
+	require.Equal(t, RootCA.Raw, raw)
+}
@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Chain 按顺序执行的Delegate链, 本身也是Delegate
+//
+// Connect、Auth、BeforeRequest、BeforeResponse 依次执行, 某个Delegate调用ctx.Abort后不再执行后续Delegate,
+// BeforeRequest、BeforeResponse中中断时ctx.Blocked为true, 后续Delegate可在Finish中记录;
+// WebSocketFrame、Finish、ErrorLog 每个Delegate都会执行, 已丢弃的帧也会传给后续Delegate以便记录;
+// ParentProxy 使用第一个返回非nil地址或错误的结果
+type Chain []Delegate
+
+var _ Delegate = Chain{}
+
+// Connect 收到客户端连接
+func (c Chain) Connect(ctx *Context, rw http.ResponseWriter) {
+	for _, d := range c {
+		d.Connect(ctx, rw)
+		if ctx.abort {
+			return
+		}
+	}
+}
+
+// Auth 代理身份认证
+func (c Chain) Auth(ctx *Context, rw http.ResponseWriter) {
+	for _, d := range c {
+		d.Auth(ctx, rw)
+		if ctx.abort {
+			return
+		}
+	}
+}
+
+// BeforeRequest HTTP请求前
+func (c Chain) BeforeRequest(ctx *Context) {
+	for _, d := range c {
+		d.BeforeRequest(ctx)
+		if ctx.abort {
+			return
+		}
+	}
+}
+
+// BeforeResponse 响应发送到客户端前, 调用ctx.Respond后后续Delegate收到替换后的响应
+func (c Chain) BeforeResponse(ctx *Context, resp *http.Response, err error) {
+	for _, d := range c {
+		if ctx.response != nil {
+			resp, err = ctx.response, nil
+		}
+		d.BeforeResponse(ctx, resp, err)
+		if ctx.abort {
+			return
+		}
+	}
+}
+
+// WebSocketFrame 转发WebSocket帧前
+func (c Chain) WebSocketFrame(ctx *Context, frame *WebSocketFrame) {
+	for _, d := range c {
+		d.WebSocketFrame(ctx, frame)
+	}
+}
+
+// ParentProxy 上级代理
+func (c Chain) ParentProxy(req *http.Request) (*url.URL, error) {
+	for _, d := range c {
+		u, err := d.ParentProxy(req)
+		if u != nil || err != nil {
+			return u, err
+		}
+	}
+
+	return nil, nil
+}
+
+// Finish 本次请求结束
+func (c Chain) Finish(ctx *Context) {
+	for _, d := range c {
+		d.Finish(ctx)
+	}
+}
+
+// ErrorLog 记录错误信息
+func (c Chain) ErrorLog(err error) {
+	for _, d := range c {
+		d.ErrorLog(err)
+	}
+}
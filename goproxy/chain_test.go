@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+)
+
+// observeDelegate 记录经过的阶段及收到的请求、响应
+type observeDelegate struct {
+	NopDelegate
+	name  string
+	log   *[]string
+	abort bool
+	proxy *url.URL
+	req   *http.Request
+	body  []byte
+}
+
+func (d *observeDelegate) BeforeRequest(ctx *Context) {
+	*d.log = append(*d.log, d.name)
+	d.req = ctx.Req
+	if d.abort {
+		ctx.Abort()
+	}
+}
+
+func (d *observeDelegate) BeforeResponse(ctx *Context, resp *http.Response, err error) {
+	if err != nil {
+		return
+	}
+	var body []byte
+	resp.Body, body, _ = CloneBody(resp.Body)
+	d.body = body
+}
+
+func (d *observeDelegate) ParentProxy(*http.Request) (*url.URL, error) {
+	return d.proxy, nil
+}
+
+func (d *observeDelegate) Finish(ctx *Context) {
+	*d.log = append(*d.log, "finish-"+d.name)
+}
+
+func TestChainAbort(t *testing.T) {
+	var log []string
+	parent, _ := url.Parse("http://127.0.0.1:1")
+	c := Chain{
+		&observeDelegate{name: "a", log: &log},
+		&observeDelegate{name: "b", log: &log, abort: true, proxy: parent},
+		&observeDelegate{name: "c", log: &log},
+	}
+	p := New(WithDelegates(c...))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("中断的请求不应发送到上游")
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/abort", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	// 中断后不再执行后续的BeforeRequest, Finish每个Delegate都会执行
+	require.Equal(t, []string{"a", "b", "finish-a", "finish-b", "finish-c"}, log)
+
+	u, err := c.ParentProxy(req)
+	require.NoError(t, err)
+	require.Equal(t, parent, u)
+}
+
+func TestRulesDelegate(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+		w.Write([]byte("hello " + r.URL.Path + " " + r.Header.Get("X-Added") + r.Header.Get("X-Removed")))
+	}))
+	defer upstream.Close()
+
+	var log []string
+	observer := &observeDelegate{name: "observer", log: &log}
+	p := New(WithDelegate(observer))
+	rules := &filterrules.Rules{
+		Hostlist:   []string{`/blocked`},
+		ReqURLRw:   []map[string]string{{"url": `/old`, "target": `/old`, "result": "/new"}},
+		ReqDel:     []map[string]string{{"url": `/`, "headerName": "X-Removed"}},
+		ReqNewSet:  []map[string]string{{"url": `/`, "target": "X-Added", "result": "rule"}},
+		RespDel:    []map[string]string{{"url": `/`, "headerName": "X-Upstream"}},
+		RespNewSet: []map[string]string{{"url": `/`, "target": "X-Mars", "result": "rule"}},
+		RespRw:     []map[string]string{{"url": `/`, "target": `hello`, "result": "HELLO"}},
+	}
+	do := func(path string) (*Context, *http.Response) {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+path, nil)
+		req.Header.Set("X-Removed", "client")
+		ctx := &Context{Req: req, User: &User{Rules: rules}}
+		var resp *http.Response
+		p.DoRequest(ctx, func(r *http.Response, err error) {
+			require.NoError(t, err)
+			resp = r
+		})
+		return ctx, resp
+	}
+
+	// 规则修改的请求、响应对后续Delegate可见
+	_, resp := do("/old")
+	require.NotNil(t, resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "HELLO /new rule", string(body))
+	require.Equal(t, "/new", observer.req.URL.Path)
+	require.Equal(t, "rule", observer.req.Header.Get("X-Added"))
+	require.Empty(t, observer.req.Header.Get("X-Removed"))
+	require.Equal(t, "rule", resp.Header.Get("X-Mars"))
+	require.Empty(t, resp.Header.Get("X-Upstream"))
+	require.Equal(t, body, observer.body)
+
+	ctx, resp := do("/blocked")
+	require.True(t, ctx.IsAborted())
+	require.Nil(t, resp)
+
+	// 截断故障在规则重写之后执行, 后续Delegate收到的是客户端实际收到的body
+	rules.Fault = []map[string]string{{"url": `/truncate`, "fault": filterrules.FaultTruncate, "probability": "1"}}
+	observer.body = nil
+	ctx, resp = do("/truncate")
+	require.NotNil(t, ctx.Fault)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "HELLO /tru", string(body))
+	require.Equal(t, string(body), string(observer.body))
+	require.Equal(t, int64(len("HELLO /truncate rule")), resp.ContentLength)
+}
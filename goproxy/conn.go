@@ -0,0 +1,78 @@
+package goproxy
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// idleTimeoutConn 每次读写前刷新期限, 连接空闲超过timeout才会超时
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	// 写入时同时刷新读期限, 用于读取一直阻塞的连接, 如HTTP/2在持续发送响应时不会读取到客户端数据.
+	// 必须在开始并发读写前设置
+	writeExtendsRead bool
+}
+
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration) *idleTimeoutConn {
+	return &idleTimeoutConn{
+		Conn:    conn,
+		timeout: timeout,
+	}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	if c.writeExtendsRead {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	} else {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+
+	return c.Conn.Write(b)
+}
+
+// CloseWrite 半关闭
+func (c *idleTimeoutConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// 是否是超时错误
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
+
+// bufferedConn 先读取已缓冲的数据, 用于探测连接首字节后继续使用原连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// Peek 查看后续n个字节, 不影响后续读取
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite 半关闭
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -3,9 +3,11 @@ package goproxy
 import (
 	"bytes"
 	"compress/gzip"
+	"io"
 	"io/ioutil"
 	"log"
 	"mars/filterrules"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -20,6 +22,23 @@ type Context struct {
 	Data  map[interface{}]interface{}
 	abort bool
 	Resp  *http.Response
+	// User 代理认证用户, 未开启认证时为nil
+	User *User
+	// Tunnel 隧道信息与流量统计, 只在隧道转发和WebSocket转发时不为nil
+	Tunnel *TunnelStats
+	// Denied 客户端IP不允许使用代理, 请求已被拒绝
+	Denied bool
+	// Blocked 请求被Delegate在BeforeRequest或BeforeResponse中中断, 没有返回响应.
+	// 中断后链中后续的Delegate不再执行, 需要记录时在Finish中处理
+	Blocked bool
+	// Fault 命中故障注入规则时注入的故障
+	Fault *Fault
+	// 客户端连接, 故障注入时用于断开连接, 普通HTTP请求为nil
+	clientConn net.Conn
+	// 解密连接上当前请求之后的客户端数据, 用于检测客户端断开连接, 普通HTTP请求和HTTP/2为nil
+	clientReader io.Reader
+	// Delegate通过Respond设置的响应
+	response *http.Response
 }
 
 // Abort 中断执行
@@ -32,6 +51,33 @@ func (c *Context) IsAborted() bool {
 	return c.abort
 }
 
+// Respond 不请求上游服务器, 直接返回resp, 可在Connect、BeforeRequest、BeforeResponse中调用,
+// 在BeforeResponse中调用时替换上游服务器的响应. 链中后续的Delegate仍会执行, 收到的是resp.
+// 在Connect中调用时, 认证通过后才返回resp
+func (c *Context) Respond(resp *http.Response) {
+	normalizeResponse(resp, c.Req)
+	c.response = resp
+}
+
+// IsResponded 响应是否由Delegate通过Respond返回
+func (c *Context) IsResponded() bool {
+	return c.response != nil
+}
+
+// Rules 本次请求使用的过滤规则, 认证用户有专属规则时优先使用
+func (c *Context) Rules() *filterrules.Rules {
+	return rulesOf(c.User)
+}
+
+// 用户专属规则, 没有则使用全局规则
+func rulesOf(user *User) *filterrules.Rules {
+	if user != nil && user.Rules != nil {
+		return user.Rules
+	}
+
+	return filterrules.Global()
+}
+
 type Delegate interface {
 	// Connect 收到客户端连接
 	Connect(ctx *Context, rw http.ResponseWriter)
@@ -41,6 +87,8 @@ type Delegate interface {
 	BeforeRequest(ctx *Context)
 	// BeforeResponse 响应发送到客户端前, 修改Header、Body、Status Code
 	BeforeResponse(ctx *Context, resp *http.Response, err error)
+	// WebSocketFrame 转发WebSocket帧前, 可修改Payload或丢弃
+	WebSocketFrame(ctx *Context, frame *WebSocketFrame)
 	// ParentProxy 上级代理
 	ParentProxy(*http.Request) (*url.URL, error)
 	// Finish 本次请求结束
@@ -49,33 +97,79 @@ type Delegate interface {
 	ErrorLog(err error)
 }
 
-var _ Delegate = &DefaultDelegate{}
+var (
+	_ Delegate = &NopDelegate{}
+	_ Delegate = &DefaultDelegate{}
+	_ Delegate = &RulesDelegate{}
+)
 
-// DefaultDelegate 默认Handler什么也不做
-type DefaultDelegate struct {
-	Delegate
-}
+// NopDelegate 什么也不做, Chain中的Delegate可嵌入NopDelegate, 只实现需要的方法
+type NopDelegate struct{}
 
 // Connect 收到客户端连接
-func (h *DefaultDelegate) Connect(ctx *Context, rw http.ResponseWriter) {}
+func (h *NopDelegate) Connect(ctx *Context, rw http.ResponseWriter) {}
 
 // Auth 代理身份认证
-func (h *DefaultDelegate) Auth(ctx *Context, rw http.ResponseWriter) {}
+func (h *NopDelegate) Auth(ctx *Context, rw http.ResponseWriter) {}
+
+// BeforeRequest HTTP请求前
+func (h *NopDelegate) BeforeRequest(ctx *Context) {}
+
+// BeforeResponse 响应发送到客户端前
+func (h *NopDelegate) BeforeResponse(ctx *Context, resp *http.Response, err error) {}
+
+// WebSocketFrame 转发WebSocket帧前
+func (h *NopDelegate) WebSocketFrame(ctx *Context, frame *WebSocketFrame) {}
+
+// ParentProxy 不指定上级代理, 由Chain中后续的Delegate决定
+func (h *NopDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// Finish 本次请求结束
+func (h *NopDelegate) Finish(ctx *Context) {}
+
+// ErrorLog 记录错误信息
+func (h *NopDelegate) ErrorLog(err error) {}
+
+// DefaultDelegate 默认Delegate, 使用环境变量中的上级代理, 错误输出到标准日志
+type DefaultDelegate struct {
+	NopDelegate
+}
+
+// ParentProxy 上级代理
+func (h *DefaultDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return http.ProxyFromEnvironment(req)
+}
+
+// ErrorLog 记录错误信息
+func (h *DefaultDelegate) ErrorLog(err error) {
+	log.Println(err)
+}
+
+// RulesDelegate 执行过滤规则: 屏蔽、重写URL、Header、Body, 故障注入及WebSocket帧规则.
+// 白名单和上级代理规则决定如何连接目标, 不经过Delegate链, 始终由Proxy执行
+type RulesDelegate struct {
+	NopDelegate
+}
 
 // BeforeRequest HTTP请求前 设置X-Forwarded-For, 修改Header、Body
-func (h *DefaultDelegate) BeforeRequest(ctx *Context) {
+func (h *RulesDelegate) BeforeRequest(ctx *Context) {
+	rules := ctx.Rules()
 	// Hosts 屏蔽方式 host+ url
-	for _, hostlist := range filterrules.Hostlist { // 遍历HOSTS 屏蔽方式
+	for _, hostlist := range rules.Hostlist { // 遍历HOSTS 屏蔽方式
 		if gregex.IsMatchString(hostlist, ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleHostlist)
 			// ctx.Req.RemoteAddr = "127.0.0.0"
 			ctx.Abort()
-
+			return
 		}
 
 	}
 	// Req.URL.Path 重写
-	for _, list := range filterrules.ReqURLRw { // 遍历Path 重写
+	for _, list := range rules.ReqURLRw { // 遍历Path 重写
 		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleReqURLRw)
 
 			newlist, err := gregex.ReplaceString(list["target"], list["result"], ctx.Req.URL.Path)
 			if err != nil {
@@ -86,8 +180,9 @@ func (h *DefaultDelegate) BeforeRequest(ctx *Context) {
 	}
 
 	// Req.URL 重定向
-	for _, list := range filterrules.ReqURLTo { // 遍历重定向url
+	for _, list := range rules.ReqURLTo { // 遍历重定向url
 		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleReqURLTo)
 			//{"url": list[0], "target": listRW[0], "result": listRW[1], "urltohost": urltohost, "urltopath": urltopath})
 
 			ctx.Req.URL.Host = list["urltohost"] // 替换host
@@ -96,8 +191,9 @@ func (h *DefaultDelegate) BeforeRequest(ctx *Context) {
 		}
 	}
 	//// Request Body 新设置
-	for _, list := range filterrules.ReqRw { // 遍历重定向url
+	for _, list := range rules.ReqRw { // 遍历重定向url
 		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleReqRw)
 			contentType := getContentType(ctx.Req.Header)
 			if !IsBinaryBody(contentType) { // 如果不是二进制文件 就执行操作
 				bodyBytes, err := ioutil.ReadAll(ctx.Req.Body)
@@ -139,17 +235,56 @@ func (h *DefaultDelegate) BeforeRequest(ctx *Context) {
 			}
 		}
 	}
+
+	//  Request Headers 删除
+	for _, list := range rules.ReqDel { // 遍历重定向url
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleReqDel)
+			//{"url": list[0], "headerName": list[1]})
+			ctx.Req.Header.Del(list["headerName"])
+
+		}
+	}
+
+	//  Request Headers 追加设置
+	for _, list := range rules.ReqOriSet { // 遍历重定向url
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleReqOriSet)
+			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
+			ori := ctx.Req.Header.Get(list["target"])
+			ctx.Req.Header.Set(list["target"], ori+";"+list["result"])
+
+		}
+	}
+
+	//  Request Headers 追加设置
+	for _, list := range rules.ReqNewSet { // 遍历重定向url
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleReqNewSet)
+			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
+
+			ctx.Req.Header.Set(list["target"], list["result"])
+
+		}
+	}
+
+	// 故障注入, Delegate已返回响应或WebSocket握手时不注入
+	if ctx.response == nil && !IsWebSocketRequest(ctx.Req) {
+		ctx.Fault = pickFault(ctx)
+	}
 }
 
 // BeforeResponse 响应发送到客户端前, 修改Header、Body、Status Code
-func (h *DefaultDelegate) BeforeResponse(ctx *Context, resp *http.Response, err error) { // 我能个去，写了一半....
+func (h *RulesDelegate) BeforeResponse(ctx *Context, resp *http.Response, err error) { // 我能个去，写了一半....
+	// 请求失败没有响应可修改, 错误由调用方处理
 	if err != nil {
-		log.Fatalf(" BeforeResponse 有err错误: %s", err)
-
+		return
 	}
 	// resp.Header.Add("X-Request-Id", ctx.Data["req_id"].(string))
-	for _, list := range filterrules.RespRw { // 遍历重定向url
+	rules := ctx.Rules()
+	for _, list := range rules.RespRw { // 遍历重定向url
 		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleRespRw)
 			contentType := getContentType(resp.Header)
 			if !IsBinaryBody(contentType) { // 如果不是二进制文件 就执行操作
 				bodyBytes, err := ioutil.ReadAll(resp.Body)
@@ -193,6 +328,43 @@ func (h *DefaultDelegate) BeforeResponse(ctx *Context, resp *http.Response, err
 			}
 		}
 	}
+
+	//  Response Headers 删除
+	for _, list := range rules.RespDel { // 遍历重定向url
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleRespDel)
+			//{"url": list[0], "headerName": list[1]})
+			resp.Header.Del(list["headerName"])
+
+		}
+	}
+
+	//  Response Headers 追加设置
+	for _, list := range rules.RespOriSet { // 遍历重定向url
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleRespOriSet)
+			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
+			ori := resp.Header.Get(list["target"])
+			resp.Header.Set(list["target"], ori+";"+list["result"])
+
+		}
+	}
+
+	//  Response Headers 追加设置
+	for _, list := range rules.RespNewSet { // 遍历重定向url
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleRespNewSet)
+			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
+
+			resp.Header.Set(list["target"], list["result"])
+
+		}
+	}
+
+	// 在规则重写之后截断, 后续Delegate记录的是客户端实际收到的body
+	if ctx.Fault != nil && ctx.Fault.Type == filterrules.FaultTruncate {
+		truncateResponse(resp)
+	}
 }
 
 // 是否是二进制文件检查
@@ -240,15 +412,25 @@ func MarsReplaceString(target string, result string, body []byte) string {
 	return s1
 }
 
-// ParentProxy 上级代理
-func (h *DefaultDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
-	return http.ProxyFromEnvironment(req)
-}
-
-// Finish 本次请求结束
-func (h *DefaultDelegate) Finish(ctx *Context) {}
-
-// ErrorLog 记录错误信息
-func (h *DefaultDelegate) ErrorLog(err error) {
-	log.Println(err)
+// WebSocketFrame 按规则丢弃或重写文本帧
+func (h *RulesDelegate) WebSocketFrame(ctx *Context, frame *WebSocketFrame) {
+	if !frame.IsText() {
+		return
+	}
+	rules := ctx.Rules()
+	for _, list := range rules.WsDrop { // 遍历丢弃规则
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) &&
+			gregex.IsMatch(list["target"], frame.Payload) {
+			rules.Hit(filterrules.RuleWsDrop)
+			frame.Drop()
+			return
+		}
+	}
+	for _, list := range rules.WsRw { // 遍历重写规则
+		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			rules.Hit(filterrules.RuleWsRw)
+			// {"url": list[0], "target": listRW[0], "result": listRW[1]})
+			frame.Payload = []byte(MarsReplaceString(list["target"], list["result"], frame.Payload))
+		}
+	}
 }
@@ -0,0 +1,127 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gogf/gf/text/gregex"
+
+	"mars/filterrules"
+)
+
+// Fault 命中故障注入规则时注入的故障
+type Fault struct {
+	// Type 故障类型 reset、timeout、truncate, 返回5xx时为状态码
+	Type string
+	// Rule 命中规则的url
+	Rule string
+}
+
+var (
+	errFaultReset   = errors.New("故障注入: 重置客户端连接")
+	errFaultTimeout = errors.New("故障注入: 请求超时")
+)
+
+// 是否是需要断开客户端连接的故障
+func isFaultError(err error) bool {
+	return err == errFaultReset || err == errFaultTimeout
+}
+
+// 按规则顺序匹配, 命中概率的第一条规则生效, 由RulesDelegate在请求前选择
+func pickFault(ctx *Context) *Fault {
+	rules := ctx.Rules()
+	for _, list := range rules.Fault {
+		if !gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
+			continue
+		}
+		probability, err := strconv.ParseFloat(list["probability"], 64)
+		if err != nil || rand.Float64() >= probability {
+			continue
+		}
+		rules.Hit(filterrules.RuleFault)
+
+		return &Fault{Type: list["fault"], Rule: list["url"]}
+	}
+
+	return nil
+}
+
+// 代替请求上游服务器, 截断响应时仍需请求上游
+func (p *Proxy) injectFault(ctx *Context, req *http.Request) (*http.Response, error) {
+	switch ctx.Fault.Type {
+	case filterrules.FaultReset:
+		return nil, errFaultReset
+	case filterrules.FaultTimeout:
+		// 挂起直到客户端放弃请求, 最长等待客户端空闲超时时间
+		timer := time.NewTimer(p.clientIdleTimeout)
+		defer timer.Stop()
+		select {
+		case <-clientGone(ctx, req):
+		case <-timer.C:
+		}
+		return nil, errFaultTimeout
+	case filterrules.FaultTruncate:
+		return p.transportFor(req).RoundTrip(req)
+	}
+	code, err := strconv.Atoi(ctx.Fault.Type)
+	if err != nil {
+		return nil, fmt.Errorf("故障注入类型错误: %s", ctx.Fault.Type)
+	}
+
+	body := fmt.Sprintf("mars故障注入: %d %s", code, http.StatusText(code))
+
+	return NewResponse(req, code, "text/plain; charset=utf-8", body), nil
+}
+
+// 客户端放弃请求时关闭的channel.
+// 解密连接上的请求共用CONNECT请求的Context, 无法感知客户端断开, 改为读取客户端连接直到出错,
+// 超时故障之后总会关闭客户端连接, 读取的数据不需要保留, 读取的goroutine随连接关闭退出
+func clientGone(ctx *Context, req *http.Request) <-chan struct{} {
+	if ctx.clientReader == nil {
+		return req.Context().Done()
+	}
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ctx.clientReader)
+		close(gone)
+	}()
+
+	return gone
+}
+
+// 只返回前一半body, Content-Length保持完整长度, 客户端读取body时会遇到连接提前关闭.
+// 读取上游body出错时截断已读取的部分
+func truncateResponse(resp *http.Response) {
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body[:len(body)/2]))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.TransferEncoding = nil
+	resp.Close = true
+}
+
+// 不返回响应, 断开客户端连接, HTTP/2等无法劫持连接时中断当前stream
+func dropClient(rw http.ResponseWriter, err error) {
+	conn, hijackErr := hijacker(rw)
+	if hijackErr != nil {
+		panic(http.ErrAbortHandler)
+	}
+	closeClientConn(conn, err == errFaultReset)
+}
+
+// 关闭客户端连接, reset为true时发送RST
+func closeClientConn(conn net.Conn, reset bool) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && reset {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
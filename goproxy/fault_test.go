@@ -0,0 +1,118 @@
+package goproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+)
+
+type faultDelegate struct {
+	NopDelegate
+	faults chan *Fault
+	// started 解密后的请求开始处理时通知, 为nil时不通知
+	started chan struct{}
+}
+
+func (d *faultDelegate) BeforeRequest(ctx *Context) {
+	if d.started != nil && ctx.Req.Method != http.MethodConnect {
+		d.started <- struct{}{}
+	}
+}
+
+func (d *faultDelegate) Finish(ctx *Context) {
+	if ctx.Req.Method != http.MethodConnect {
+		d.faults <- ctx.Fault
+	}
+}
+
+func TestFault(t *testing.T) {
+	loadTestCA(t)
+	defer func() { filterrules.Fault = nil }()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("abcdefghij", 100)))
+	})
+	upstream := httptest.NewServer(handler)
+	defer upstream.Close()
+	upstreamTLS := httptest.NewTLSServer(handler)
+	defer upstreamTLS.Close()
+
+	d := &faultDelegate{faults: make(chan *Fault, 1)}
+	p := New(WithDelegate(d), WithDecryptHTTPS(&memCache{}), WithClientIdleTimeout(time.Second),
+		WithTransport(insecureTransport()))
+	for _, h2 := range []bool{false, true} {
+		ps, client := startProxy(t, p, h2)
+		for _, base := range []string{upstream.URL, upstreamTLS.URL} {
+			for _, fault := range []string{"503", "reset", "truncate", "timeout"} {
+				filterrules.Fault = []map[string]string{{"url": "/fault", "fault": fault, "probability": "1"}}
+				resp, err := client.Get(base + "/fault")
+				var body []byte
+				if err == nil {
+					body, err = ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+				f := <-d.faults
+				require.NotNil(t, f)
+				require.Equal(t, fault, f.Type)
+				if fault == "503" {
+					require.NoError(t, err)
+					require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+					require.Contains(t, string(body), "503")
+				} else {
+					require.Error(t, err, "%s %s", base, fault)
+				}
+				// 故障后连接已断开, 不再复用
+				client.Transport.(*http.Transport).CloseIdleConnections()
+			}
+
+			filterrules.Fault = []map[string]string{{"url": "/fault", "fault": "503", "probability": "0"}}
+			resp, err := client.Get(base + "/fault")
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Len(t, body, 1000)
+			require.Nil(t, <-d.faults)
+		}
+		ps.Close()
+	}
+}
+
+// 解密连接上的超时故障在客户端断开后立即结束, 不等待客户端空闲超时
+func TestFaultTimeoutClientGone(t *testing.T) {
+	loadTestCA(t)
+	defer func() { filterrules.Fault = nil }()
+	filterrules.Fault = []map[string]string{{"url": "/timeout", "fault": "timeout", "probability": "1"}}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	d := &faultDelegate{faults: make(chan *Fault, 1), started: make(chan struct{}, 1)}
+	p := New(WithDelegate(d), WithDecryptHTTPS(&memCache{}), WithClientIdleTimeout(time.Minute),
+		WithTransport(insecureTransport()))
+	ps, client := startProxy(t, p, false)
+	defer ps.Close()
+	// 请求到达代理后客户端放弃请求, 不受生成证书耗时的影响
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-d.started
+		cancel()
+	}()
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+"/timeout", nil)
+	require.NoError(t, err)
+	_, err = client.Do(req.WithContext(reqCtx))
+	require.Error(t, err)
+	select {
+	case f := <-d.faults:
+		require.Equal(t, "timeout", f.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("客户端断开后超时故障未结束")
+	}
+}
@@ -0,0 +1,114 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+	"mars/goproxy/cert"
+)
+
+// memCache 内存证书缓存
+type memCache struct {
+	m sync.Map
+}
+
+func (c *memCache) Set(host string, v *tls.Certificate) {
+	c.m.Store(host, v)
+}
+
+func (c *memCache) Get(host string) *tls.Certificate {
+	v, ok := c.m.Load(host)
+	if !ok {
+		return nil
+	}
+
+	return v.(*tls.Certificate)
+}
+
+// 加载仓库中的根证书, 解密HTTPS时使用
+func loadTestCA(t *testing.T) {
+	if cert.RootCA != nil {
+		return
+	}
+	ca, key, err := cert.LoadCA("../conf/private/base.key.pem", "../conf/private/ca.key.pem")
+	require.NoError(t, err)
+	cert.RootCA, cert.RootKey = ca, key
+}
+
+// 启动代理, 返回使用该代理的客户端, 不校验上游证书
+func startProxy(t *testing.T, p *Proxy, h2 bool) (*httptest.Server, *http.Client) {
+	ps := httptest.NewServer(p)
+	proxyURL, err := url.Parse(ps.URL)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		ForceAttemptHTTP2: h2,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	return ps, client
+}
+
+// 不校验上游证书的Transport
+func insecureTransport() *http.Transport {
+	return &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+}
+
+// 向代理发送CONNECT, 返回建立的隧道连接
+func connectProxy(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	return conn, br
+}
+
+// testAuthenticator 用户名密码认证, 用户使用空的专属规则
+type testAuthenticator map[string]string
+
+func (a testAuthenticator) Authenticate(username, password string) (*User, bool) {
+	if p, ok := a[username]; ok && p == password {
+		return &User{Name: username, Rules: &filterrules.Rules{}}, true
+	}
+
+	return nil, false
+}
+
+// finishRecorder 请求结束时发送Context, 包括CONNECT
+type finishRecorder struct {
+	NopDelegate
+	done chan *Context
+}
+
+func newFinishRecorder() *finishRecorder {
+	return &finishRecorder{done: make(chan *Context, 16)}
+}
+
+func (d *finishRecorder) Finish(ctx *Context) {
+	d.done <- ctx
+}
+
+// 下一个结束的非CONNECT请求
+func (d *finishRecorder) nextRequest() *Context {
+	for ctx := range d.done {
+		if ctx.Req.Method != http.MethodConnect {
+			return ctx
+		}
+	}
+
+	return nil
+}
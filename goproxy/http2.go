@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// 解密后的HTTP/2连接, 每个stream作为独立请求进入DoRequest
+func (p *Proxy) serveHTTP2(connCtx *Context, tlsClientConn *tls.Conn) {
+	server := &http2.Server{
+		IdleTimeout: p.clientIdleTimeout,
+	}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.serveHTTP2Stream(connCtx, rw, req)
+	})
+	server.ServeConn(tlsClientConn, &http2.ServeConnOpts{
+		Handler: handler,
+	})
+}
+
+// 处理单个HTTP/2 stream
+func (p *Proxy) serveHTTP2Stream(connCtx *Context, rw http.ResponseWriter, req *http.Request) {
+	req.RemoteAddr = connCtx.Req.RemoteAddr
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	if connCtx.User != nil {
+		req = withUser(req, connCtx.User)
+	}
+	ctx := &Context{
+		Req:  req,
+		Data: make(map[interface{}]interface{}),
+		User: connCtx.User,
+	}
+	defer p.delegate.Finish(ctx)
+
+	p.DoRequest(ctx, func(resp *http.Response, err error) {
+		if isFaultError(err) {
+			dropClient(rw, err)
+			return
+		}
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - HTTP/2解密, 请求错误: %s", ctx.Req.URL, err))
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		CopyHeader(rw.Header(), resp.Header)
+		rw.WriteHeader(resp.StatusCode)
+		err = copyWithFlush(rw, resp.Body)
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - HTTP/2解密, response写入客户端失败, %s", ctx.Req.URL, err))
+			return
+		}
+		// trailer在body读取完后才可用, 如gRPC的grpc-status
+		for key, values := range resp.Trailer {
+			for _, value := range values {
+				rw.Header().Add(http.TrailerPrefix+key, value)
+			}
+		}
+	})
+}
+
+// 复制body并及时flush, 流式响应不会被缓冲
+func copyWithFlush(rw http.ResponseWriter, body io.Reader) error {
+	flusher, _ := rw.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptedHTTP2(t *testing.T) {
+	loadTestCA(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprintf(rw, "hello %s", req.URL.Path)
+		rw.Header().Set("X-Checksum", req.URL.Path)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		disable bool
+		proto   string
+	}{
+		{name: "h2", proto: "HTTP/2.0"},
+		{name: "disabled", disable: true, proto: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(WithDecryptHTTPS(&memCache{}), WithTransport(insecureTransport()), WithDisableHTTP2(tt.disable))
+			ps := httptest.NewUnstartedServer(p)
+			var conns int32
+			ps.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&conns, 1)
+				}
+			}
+			ps.Start()
+			defer ps.Close()
+			proxyURL, err := url.Parse(ps.URL)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:             http.ProxyURL(proxyURL),
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			}}
+
+			for i := 0; i < 3; i++ {
+				resp, err := client.Get(fmt.Sprintf("%s/p%d", upstream.URL, i))
+				require.NoError(t, err)
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				require.Equal(t, tt.proto, resp.Proto)
+				require.Equal(t, fmt.Sprintf("hello /p%d", i), string(body))
+				// trailer在body之后转发
+				require.Equal(t, fmt.Sprintf("/p%d", i), resp.Trailer.Get("X-Checksum"))
+			}
+			// 所有请求复用同一条解密连接
+			require.Equal(t, int32(1), atomic.LoadInt32(&conns))
+		})
+	}
+}
+
+// 服务端持续发送数据的stream总时长超过空闲超时, 客户端不发送数据时也不能断开
+func TestDecryptedHTTP2StreamIdle(t *testing.T) {
+	loadTestCA(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 5; i++ {
+			rw.Write([]byte("tick\n"))
+			rw.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	p := New(WithDecryptHTTPS(&memCache{}), WithTransport(insecureTransport()), WithClientIdleTimeout(300*time.Millisecond))
+	ps, client := startProxy(t, p, true)
+	defer ps.Close()
+	resp, err := client.Get(upstream.URL + "/stream")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/2.0", resp.Proto)
+	require.Equal(t, strings.Repeat("tick\n", 5), string(body))
+}
@@ -0,0 +1,233 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"mars/filterrules"
+
+	"github.com/gogf/gf/text/gregex"
+)
+
+// 上级代理, 优先级: 规则 > 认证用户专属 > WithParentProxy > Delegate.ParentProxy
+func (p *Proxy) parentProxy(req *http.Request) (*url.URL, error) {
+	user := UserFromRequest(req)
+	rules := rulesOf(user)
+	for _, rule := range rules.ParentProxy {
+		if gregex.IsMatchString(rule["url"], req.URL.Host) {
+			rules.Hit(filterrules.RuleParentProxy)
+			if rule["proxy"] == filterrules.ParentProxyDirect {
+				return nil, nil
+			}
+			return url.Parse(rule["proxy"])
+		}
+	}
+	if user != nil && user.ParentProxy != nil {
+		return user.ParentProxy, nil
+	}
+	if p.defaultParentProxy != nil {
+		return p.defaultParentProxy, nil
+	}
+
+	return p.delegate.ParentProxy(req)
+}
+
+// 普通HTTP请求经http.Transport使用的上级代理.
+// http.Transport不识别socks5h, 其socks5同样由上级代理解析域名, 转换为socks5
+func (p *Proxy) transportProxy(req *http.Request) (*url.URL, error) {
+	proxyURL, err := p.parentProxy(req)
+	if err != nil || proxyURL == nil || proxyURL.Scheme != "socks5h" {
+		return proxyURL, err
+	}
+	u := *proxyURL
+	u.Scheme = "socks5"
+
+	return &u, nil
+}
+
+// 通过上级代理连接addr, 支持http、https、socks5, 账号密码取自代理地址
+func dialParentProxy(proxyURL *url.URL, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		conn, err = net.DialTimeout("tcp", parentProxyAddr(proxyURL), defaultTargetConnectTimeout)
+	default:
+		return nil, fmt.Errorf("不支持的上级代理协议: %s", proxyURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 握手完成前限制时间, 上级代理无响应时不会一直等待
+	conn.SetDeadline(time.Now().Add(defaultTargetConnectTimeout))
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		err = tlsConn.Handshake()
+		conn = tlsConn
+	}
+	tunnelConn := conn
+	if err == nil {
+		if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+			err = socks5Connect(conn, proxyURL.User, addr)
+		} else {
+			tunnelConn, err = httpConnect(conn, proxyURL.User, addr)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tunnelConn, nil
+}
+
+// 上级代理地址, 未指定端口时使用协议默认端口
+func parentProxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	port := "80"
+	switch proxyURL.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// HTTP CONNECT建立隧道, 响应之后已缓冲的数据由bufferedConn继续读取
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	bc := newBufferedConn(conn)
+	resp, err := http.ReadResponse(bc.r, req)
+	if err != nil {
+		return nil, fmt.Errorf("读取CONNECT响应失败: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT被拒绝: %s", resp.Status)
+	}
+
+	return bc, nil
+}
+
+// SOCKS5握手并请求连接addr
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = []byte{socks5AuthPassword}
+	}
+	_, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != socks5Version:
+		return fmt.Errorf("不支持的SOCKS协议版本: %d", reply[0])
+	case reply[1] == socks5AuthPassword && user != nil:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5用户名或密码过长")
+		}
+		buf := []byte{socks5PasswordVersion, byte(len(user.Username()))}
+		buf = append(buf, user.Username()...)
+		buf = append(buf, byte(len(password)))
+		buf = append(buf, password...)
+		if _, err = conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5认证失败")
+		}
+	case reply[1] != socks5AuthNone:
+		return errors.New("SOCKS5认证方式不匹配")
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("端口错误: %s", portStr)
+	}
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("域名过长: " + host)
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AtypIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AtypIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err = io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != socks5RepSucceeded {
+		return fmt.Errorf("SOCKS5连接目标失败, 错误码: %d", head[1])
+	}
+	// 跳过绑定地址
+	var skip int
+	switch head[3] {
+	case socks5AtypIPv4:
+		skip = net.IPv4len + 2
+	case socks5AtypIPv6:
+		skip = net.IPv6len + 2
+	case socks5AtypDomain:
+		var length [1]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("不支持的地址类型: %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+
+	return err
+}
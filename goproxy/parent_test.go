@@ -0,0 +1,139 @@
+package goproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+)
+
+// parentDelegate 记录上级代理收到的请求
+type parentDelegate struct {
+	NopDelegate
+	requests chan string
+}
+
+func (d *parentDelegate) Connect(ctx *Context, rw http.ResponseWriter) {
+	if ctx.Req.Method == http.MethodConnect {
+		d.requests <- "CONNECT " + ctx.Req.URL.Host
+	}
+}
+
+func (d *parentDelegate) BeforeRequest(ctx *Context) {
+	d.requests <- ctx.Req.Method + " " + ctx.Req.URL.Host
+}
+
+func TestParentProxy(t *testing.T) {
+	defer func() { filterrules.ParentProxy = nil }()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})
+	upstream := httptest.NewServer(handler)
+	defer upstream.Close()
+	upstreamTLS := httptest.NewTLSServer(handler)
+	defer upstreamTLS.Close()
+
+	// 上级代理的认证用户使用专属规则, 不会命中全局的上级代理规则
+	auth := testAuthenticator{"mars": "secret"}
+	d := &parentDelegate{requests: make(chan string, 10)}
+	parent := New(WithDelegate(d), WithAuthenticator(auth, "parent"), WithSOCKS5Authenticator(auth))
+	httpParent := httptest.NewServer(parent)
+	defer httpParent.Close()
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socksListener.Close()
+	go parent.ServeSOCKS5(socksListener)
+	httpParentURL, err := url.Parse(httpParent.URL)
+	require.NoError(t, err)
+
+	p := New(WithDelegate(&NopDelegate{}), WithTransport(insecureTransport()))
+	ps, client := startProxy(t, p, false)
+	defer ps.Close()
+	for _, parentURL := range []string{
+		"http://mars:secret@" + httpParentURL.Host,
+		"socks5://mars:secret@" + socksListener.Addr().String(),
+		"socks5h://mars:secret@" + socksListener.Addr().String(),
+	} {
+		filterrules.ParentProxy = []map[string]string{{"url": `127\.0\.0\.1`, "proxy": parentURL}}
+		// 普通HTTP请求经http.Transport, HTTPS经隧道
+		for _, target := range []string{upstream.URL, upstreamTLS.URL} {
+			resp, err := client.Get(target + "/parent")
+			require.NoError(t, err, parentURL)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, "hello /parent", string(body), parentURL)
+
+			u, _ := url.Parse(target)
+			seen := <-d.requests
+			require.Contains(t, seen, u.Host, parentURL)
+			if u.Scheme == "https" || parentURL[:5] == "socks" {
+				require.Equal(t, "CONNECT "+u.Host, seen)
+				if u.Scheme == "http" {
+					// SOCKS5隧道内的明文HTTP请求同样经过上级代理的Delegate
+					require.Equal(t, "GET "+u.Host, <-d.requests, parentURL)
+				}
+			} else {
+				require.Equal(t, "GET "+u.Host, seen)
+			}
+		}
+		// 不复用经上一个上级代理建立的连接
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		p.transport.CloseIdleConnections()
+	}
+
+	// 认证失败
+	filterrules.ParentProxy = []map[string]string{{"url": `127\.0\.0\.1`, "proxy": "http://mars:bad@" + httpParentURL.Host}}
+	resp, err := client.Get(upstream.URL + "/parent")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	_, err = client.Get(upstreamTLS.URL + "/parent")
+	require.Error(t, err)
+}
+
+func TestTransportProxy(t *testing.T) {
+	defer func() { filterrules.ParentProxy = nil }()
+	p := New(WithDelegate(&NopDelegate{}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for scheme, want := range map[string]string{
+		"http": "http", "https": "https", "socks5": "socks5", "socks5h": "socks5",
+	} {
+		filterrules.ParentProxy = []map[string]string{{"url": `example\.com`, "proxy": scheme + "://127.0.0.1:1080"}}
+		u, err := p.transportProxy(req)
+		require.NoError(t, err)
+		require.Equal(t, want+"://127.0.0.1:1080", u.String())
+		// 隧道仍使用原地址
+		u, err = p.parentProxy(req)
+		require.NoError(t, err)
+		require.Equal(t, scheme, u.Scheme)
+	}
+	filterrules.ParentProxy = []map[string]string{{"url": `example\.com`, "proxy": filterrules.ParentProxyDirect}}
+	u, err := p.transportProxy(req)
+	require.NoError(t, err)
+	require.Nil(t, u)
+}
+
+func TestParentProxyAddr(t *testing.T) {
+	for raw, want := range map[string]string{
+		"http://proxy":        "proxy:80",
+		"https://proxy":       "proxy:443",
+		"socks5://proxy":      "proxy:1080",
+		"socks5h://proxy":     "proxy:1080",
+		"socks5://proxy:1081": "proxy:1081",
+		"http://[::1]":        "[::1]:80",
+	} {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		require.Equal(t, want, parentProxyAddr(u), raw)
+	}
+	_, err := dialParentProxy(&url.URL{Scheme: "ftp", Host: "proxy:21"}, "example.com:80")
+	require.Error(t, err)
+}
@@ -5,12 +5,15 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,15 +21,18 @@ import (
 	"mars/goproxy/cert"
 
 	"github.com/gogf/gf/text/gregex"
+	"golang.org/x/net/http2"
 )
 
 const (
 	// 连接目标服务器超时时间
 	defaultTargetConnectTimeout = 5 * time.Second
-	// 目标服务器读写超时时间
-	defaultTargetReadWriteTimeout = 30 * time.Second
-	// 客户端读写超时时间
-	defaultClientReadWriteTimeout = 30 * time.Second
+	// 客户端连接空闲超时时间
+	defaultClientIdleTimeout = 2 * time.Minute
+	// 隧道双向空闲超时时间
+	defaultTunnelIdleTimeout = 5 * time.Minute
+	// TLS握手记录类型, 用于判断隧道内是否是TLS流量
+	tlsRecordTypeHandshake = 0x16
 )
 
 // tunnelEstablishedResponseLine 隧道连接成功响应行
@@ -34,32 +40,75 @@ var tunnelEstablishedResponseLine = []byte("HTTP/1.1 200 Connection established\
 
 var badGateway = []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", http.StatusBadGateway, http.StatusText(http.StatusBadGateway)))
 
-// 生成隧道建立请求行
-func makeTunnelRequestLine(addr string) string {
-	return fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", addr)
-}
-
 type options struct {
 	disableKeepAlive bool
 	delegate         Delegate
 	decryptHTTPS     bool
 	certCache        cert.Cache
 	transport        *http.Transport
+	authenticator    Authenticator
+	authRealm        string
+	disableHTTP2     bool
+	// SOCKS5用户名密码认证
+	socks5Authenticator Authenticator
+	parentProxy         *url.URL
+	clientIdleTimeout   time.Duration
+	tunnelIdleTimeout   time.Duration
+	certKeyType         cert.KeyType
+	certHooks           cert.Hooks
+	mirrorUpstreamCert  bool
+	upstreamTLS         []UpstreamTLS
+	clientACL           *ACL
+	decryptACL          *ACL
+	recordDenied        bool
+	// 上游连接池
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	upstreamIdleTimeout time.Duration
 }
 
 type Option func(*options)
 
-// WithDisableKeepAlive 连接是否重用
+// WithDisableKeepAlive 不重用与上游服务器的连接, 每个请求新建连接, 默认重用
 func WithDisableKeepAlive(disableKeepAlive bool) Option {
 	return func(opt *options) {
 		opt.disableKeepAlive = disableKeepAlive
 	}
 }
 
-// WithDelegate 设置委托类
+// WithMaxIdleConnsPerHost 每个上游Host最多保持的空闲连接数, 默认2
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(opt *options) {
+		opt.maxIdleConnsPerHost = n
+	}
+}
+
+// WithMaxConnsPerHost 每个上游Host最多连接数, 包括使用中的连接, 达到上限时请求等待空闲连接, 默认不限制
+func WithMaxConnsPerHost(n int) Option {
+	return func(opt *options) {
+		opt.maxConnsPerHost = n
+	}
+}
+
+// WithUpstreamIdleTimeout 与上游服务器的空闲连接超时时间, 默认90秒
+func WithUpstreamIdleTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.upstreamIdleTimeout = d
+	}
+}
+
+// WithDelegate 设置委托类, 在过滤规则之后执行
 func WithDelegate(delegate Delegate) Option {
 	return func(opt *options) {
-		opt.delegate = delegate
+		opt.delegate = Chain{&RulesDelegate{}, delegate}
+	}
+}
+
+// WithDelegates 按顺序设置Delegate链, 屏蔽、重写、Header、故障注入等过滤规则需显式加入RulesDelegate,
+// 白名单和上级代理规则由Proxy执行, 不受Delegate链影响
+func WithDelegates(delegates ...Delegate) Option {
+	return func(opt *options) {
+		opt.delegate = Chain(delegates)
 	}
 }
 
@@ -78,6 +127,86 @@ func WithDecryptHTTPS(c cert.Cache) Option {
 	}
 }
 
+// WithCertKeyType 解密HTTPS时生成证书的私钥类型, 默认RSA
+func WithCertKeyType(t cert.KeyType) Option {
+	return func(opt *options) {
+		opt.certKeyType = t
+	}
+}
+
+// WithCertHooks 查询证书缓存、生成证书后回调, 用于统计
+func WithCertHooks(h cert.Hooks) Option {
+	return func(opt *options) {
+		opt.certHooks = h
+	}
+}
+
+// WithMirrorUpstreamCert 解密时连接上游服务器获取证书, 生成的证书复制其SAN, 按SAN集合分别缓存
+func WithMirrorUpstreamCert(enable bool) Option {
+	return func(opt *options) {
+		opt.mirrorUpstreamCert = enable
+	}
+}
+
+// WithDisableHTTP2 解密HTTPS时不与客户端协商HTTP/2
+func WithDisableHTTP2(disable bool) Option {
+	return func(opt *options) {
+		opt.disableHTTP2 = disable
+	}
+}
+
+// WithAuthenticator 开启代理身份认证(Basic Proxy-Authorization)
+func WithAuthenticator(a Authenticator, realm string) Option {
+	return func(opt *options) {
+		opt.authenticator = a
+		opt.authRealm = realm
+	}
+}
+
+// WithSOCKS5Authenticator 开启SOCKS5用户名密码认证
+func WithSOCKS5Authenticator(a Authenticator) Option {
+	return func(opt *options) {
+		opt.socks5Authenticator = a
+	}
+}
+
+// WithParentProxy 默认上级代理, 支持http、https、socks5, 规则和认证用户的配置优先
+func WithParentProxy(u *url.URL) Option {
+	return func(opt *options) {
+		opt.parentProxy = u
+	}
+}
+
+// WithClientIdleTimeout 解密HTTPS、HTTP/2等保持的客户端连接空闲超时时间, 默认2分钟
+func WithClientIdleTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.clientIdleTimeout = d
+	}
+}
+
+// WithTunnelIdleTimeout 隧道、WebSocket双向都没有数据超过该时间则断开, 默认5分钟, 小于0不限制
+func WithTunnelIdleTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.tunnelIdleTimeout = d
+	}
+}
+
+// WithClientACL 限制可以使用代理的客户端IP, HTTP代理、反向代理返回403, SOCKS5、透明代理在接受连接时关闭.
+// recordDenied为true时HTTP代理、反向代理拒绝的请求交给Delegate.Finish记录, ctx.Denied为true
+func WithClientACL(acl *ACL, recordDenied bool) Option {
+	return func(opt *options) {
+		opt.clientACL = acl
+		opt.recordDenied = recordDenied
+	}
+}
+
+// WithDecryptACL 限制可以解密HTTPS的客户端IP, 其他客户端的HTTPS直接转发
+func WithDecryptACL(acl *ACL) Option {
+	return func(opt *options) {
+		opt.decryptACL = acl
+	}
+}
+
 // New 创建proxy实例
 func New(opt ...Option) *Proxy {
 	opts := &options{}
@@ -86,9 +215,8 @@ func New(opt ...Option) *Proxy {
 	}
 
 	if opts.delegate == nil {
-		opts.delegate = &DefaultDelegate{}
+		opts.delegate = Chain{&RulesDelegate{}, &DefaultDelegate{}}
 	}
-	// delegateMars := &DefaultDelegate{}
 	if opts.transport == nil {
 		opts.transport = &http.Transport{
 			DialContext: (&net.Dialer{
@@ -105,28 +233,74 @@ func New(opt ...Option) *Proxy {
 
 	p := &Proxy{}
 	p.delegate = opts.delegate
-	p.delegateMars = &DefaultDelegate{}
 	p.decryptHTTPS = opts.decryptHTTPS
 	if p.decryptHTTPS {
 		p.cert = &cert.Certificate{
-			Cache: opts.certCache,
+			Cache:   opts.certCache,
+			KeyType: opts.certKeyType,
+			Hooks:   opts.certHooks,
 		}
 	}
+	p.mirrorUpstreamCert = opts.mirrorUpstreamCert
+	p.disableHTTP2 = opts.disableHTTP2
+	p.authenticator = opts.authenticator
+	p.authRealm = opts.authRealm
+	if p.authRealm == "" {
+		p.authRealm = "mars"
+	}
+	p.socks5Authenticator = opts.socks5Authenticator
+	p.clientACL = opts.clientACL
+	p.decryptACL = opts.decryptACL
+	p.recordDenied = opts.recordDenied
+	p.defaultParentProxy = opts.parentProxy
+	p.clientIdleTimeout = opts.clientIdleTimeout
+	if p.clientIdleTimeout <= 0 {
+		p.clientIdleTimeout = defaultClientIdleTimeout
+	}
+	p.tunnelIdleTimeout = opts.tunnelIdleTimeout
+	if p.tunnelIdleTimeout == 0 {
+		p.tunnelIdleTimeout = defaultTunnelIdleTimeout
+	}
 	p.transport = opts.transport
 	p.transport.DisableKeepAlives = opts.disableKeepAlive
-	p.transport.Proxy = p.delegate.ParentProxy
+	if opts.maxIdleConnsPerHost > 0 {
+		p.transport.MaxIdleConnsPerHost = opts.maxIdleConnsPerHost
+	}
+	if opts.maxConnsPerHost > 0 {
+		p.transport.MaxConnsPerHost = opts.maxConnsPerHost
+	}
+	if opts.upstreamIdleTimeout > 0 {
+		p.transport.IdleConnTimeout = opts.upstreamIdleTimeout
+	}
+	p.transport.Proxy = p.transportProxy
+	p.initUpstreamTransports(opts.upstreamTLS)
 
 	return p
 }
 
 // Proxy 实现了http.Handler接口
 type Proxy struct {
-	delegate      Delegate // 在这里可以稍作修改 支持2个delegate
+	delegate      Delegate
 	clientConnNum int32
 	decryptHTTPS  bool // 是否解密 SSl证书
 	cert          *cert.Certificate
 	transport     *http.Transport
-	delegateMars  Delegate // 专门用来修改数据
+	authenticator Authenticator
+	authRealm     string
+	disableHTTP2  bool
+	// SOCKS5用户名密码认证
+	socks5Authenticator Authenticator
+	defaultParentProxy  *url.URL
+	clientIdleTimeout   time.Duration
+	tunnelIdleTimeout   time.Duration
+	mirrorUpstreamCert  bool
+	upstreamTransports  []upstreamTransport
+	clientACL           *ACL
+	decryptACL          *ACL
+	recordDenied        bool
+	inShutdown          int32
+	listenersMu         sync.Mutex
+	listeners           map[net.Listener]struct{}
 }
 
 var _ http.Handler = &Proxy{}
@@ -137,20 +311,6 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
-	// 白名单放行
-	pass := 0
-	for _, whitelist := range filterrules.Whitelist { // 遍历白名单
-		if gregex.IsMatchString(whitelist, req.Host) {
-			pass = 1
-		}
-
-	}
-	for _, blacklist := range filterrules.Blacklist { // 遍历需要过滤的名单
-		if gregex.IsMatchString(blacklist, req.Host) {
-			pass = 2
-		}
-
-	}
 	atomic.AddInt32(&p.clientConnNum, 1)
 	defer func() {
 		atomic.AddInt32(&p.clientConnNum, -1)
@@ -159,27 +319,39 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		Req:  req,
 		Data: make(map[interface{}]interface{}),
 	}
+	if !p.clientACL.allowedAddr(req.RemoteAddr) {
+		p.denyClient(ctx, rw)
+		return
+	}
 	defer p.delegate.Finish(ctx)
 	p.delegate.Connect(ctx, rw)
 	if ctx.abort {
 		return
 	}
+	if p.authenticator != nil {
+		p.authenticate(ctx, rw)
+		if ctx.abort {
+			return
+		}
+	}
 	p.delegate.Auth(ctx, rw)
 	if ctx.abort {
 		return
 	}
+	if ctx.response != nil && ctx.Req.Method == http.MethodConnect {
+		// 直接响应CONNECT请求, 不建立隧道, 认证通过后才返回
+		defer ctx.response.Body.Close()
+		writeResponse(rw, ctx.response)
+		return
+	}
 
 	switch {
-	case pass == 1: // 白名单
-		pass = 0
-		p.forwardTunnel(ctx, rw)
-	case pass == 2 || ctx.Req.Method == http.MethodConnect && p.decryptHTTPS:
-		pass = 0
+	case ctx.Req.Method != http.MethodConnect: // 普通HTTP请求, 包括WebSocket握手
+		p.forwardHTTP(ctx, rw)
+	case p.shouldDecrypt(ctx):
 		p.forwardHTTPS(ctx, rw)
-	case pass == 0 || ctx.Req.Method == http.MethodConnect:
-		p.forwardTunnel(ctx, rw)
 	default:
-		p.forwardHTTP(ctx, rw)
+		p.forwardTunnel(ctx, rw)
 	}
 
 }
@@ -195,11 +367,12 @@ func (p *Proxy) DoRequest(ctx *Context, responseFunc func(*http.Response, error)
 	if ctx.Data == nil {
 		ctx.Data = make(map[interface{}]interface{})
 	}
-	p.delegateMars.BeforeRequest(ctx)
-	p.delegate.BeforeRequest(ctx) // 将修改好的内容传送到web 端口
+	p.delegate.BeforeRequest(ctx)
 	if ctx.abort {
+		ctx.Blocked = true
 		return
 	}
+	isWebSocket := IsWebSocketRequest(ctx.Req)
 	newReq := new(http.Request)
 	*newReq = *ctx.Req
 	newReq.Header = CloneHeader(newReq.Header)
@@ -209,94 +382,79 @@ func (p *Proxy) DoRequest(ctx *Context, responseFunc func(*http.Response, error)
 			newReq.Header.Del(item)
 		}
 	}
-
-	//  Request Headers 删除
-	for _, list := range filterrules.ReqDel { // 遍历重定向url
-		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
-			//{"url": list[0], "headerName": list[1]})
-			newReq.Header.Del(list["headerName"])
-
-		}
+	if isWebSocket {
+		// 保留升级头, 不协商压缩扩展, 以便解析和修改帧内容
+		newReq.Header.Set("Connection", "Upgrade")
+		newReq.Header.Set("Upgrade", "websocket")
+		newReq.Header.Del("Sec-WebSocket-Extensions")
 	}
 
-	//  Request Headers 追加设置
-	for _, list := range filterrules.ReqOriSet { // 遍历重定向url
-		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
-			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
-			ori := newReq.Header.Get(list["target"])
-			newReq.Header.Set(list["target"], ori+";"+list["result"])
-
-		}
-	}
-
-	//  Request Headers 追加设置
-	for _, list := range filterrules.ReqNewSet { // 遍历重定向url
-		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
-			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
-
-			newReq.Header.Set(list["target"], list["result"])
-
-		}
+	var resp *http.Response
+	var err error
+	switch {
+	case ctx.response != nil: // Delegate已返回响应, 不请求上游服务器, 也不注入故障
+		ctx.Fault = nil
+		resp = ctx.response
+	case ctx.Fault != nil:
+		resp, err = p.injectFault(ctx, newReq)
+	default:
+		resp, err = p.transportFor(newReq).RoundTrip(newReq)
 	}
 
-	resp, err := p.transport.RoundTrip(newReq)
-
-	p.delegateMars.BeforeResponse(ctx, resp, err) // 这里修改传回内容
-	p.delegate.BeforeResponse(ctx, resp, err)     // 将修改好的内容传送到web 端口
+	p.delegate.BeforeResponse(ctx, resp, err)
 	if ctx.abort {
+		ctx.Blocked = true
 		return
 	}
+	if ctx.response != nil && ctx.response != resp {
+		// BeforeResponse中替换了上游服务器的响应
+		if resp != nil {
+			resp.Body.Close()
+		}
+		resp, err = ctx.response, nil
+	}
 	if err == nil {
 		removeConnectionHeaders(resp.Header)
 		for _, h := range hopHeaders {
 			resp.Header.Del(h)
 		}
 	}
-
-	//  Response Headers 删除
-	for _, list := range filterrules.RespDel { // 遍历重定向url
-		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
-			//{"url": list[0], "headerName": list[1]})
-			resp.Header.Del(list["headerName"])
-
-		}
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols && !isWebSocket {
+		resp.Body.Close()
+		resp, err = nil, fmt.Errorf("不支持的协议升级: %s", ctx.Req.Header.Get("Upgrade"))
 	}
-
-	//  Response Headers 追加设置
-	for _, list := range filterrules.RespOriSet { // 遍历重定向url
-		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
-			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
-			ori := resp.Header.Get(list["target"])
-			resp.Header.Set(list["target"], ori+";"+list["result"])
-
-		}
+	if err != nil {
+		responseFunc(nil, err)
+		return
 	}
 
-	//  Response Headers 追加设置
-	for _, list := range filterrules.RespNewSet { // 遍历重定向url
-		if gregex.IsMatchString(list["url"], ctx.Req.URL.Host+ctx.Req.URL.Path) {
-			//{"url": list[0], "target": listRW[0], "result": listRW[1]}
-
-			resp.Header.Set(list["target"], list["result"])
-
-		}
-	}
 	responseFunc(resp, err)
 }
 
 // HTTP转发
 func (p *Proxy) forwardHTTP(ctx *Context, rw http.ResponseWriter) {
 	ctx.Req.URL.Scheme = "http"
+	p.serveRequest(ctx, rw)
+}
+
+// 发送请求并将响应写入rw
+func (p *Proxy) serveRequest(ctx *Context, rw http.ResponseWriter) {
 	p.DoRequest(ctx, func(resp *http.Response, err error) {
+		if isFaultError(err) {
+			dropClient(rw, err)
+			return
+		}
 		if err != nil {
 			p.delegate.ErrorLog(fmt.Errorf("%s - HTTP请求错误: , 错误: %s", ctx.Req.URL, err))
 			rw.WriteHeader(http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
-		CopyHeader(rw.Header(), resp.Header)
-		rw.WriteHeader(resp.StatusCode)
-		io.Copy(rw, resp.Body)
+		if serverConn, ok := switchedWebSocket(resp); ok {
+			p.forwardWebSocket(ctx, rw, resp, serverConn)
+			return
+		}
+		writeResponse(rw, resp)
 	})
 }
 
@@ -309,58 +467,195 @@ func (p *Proxy) forwardHTTPS(ctx *Context, rw http.ResponseWriter) {
 		return
 	}
 	defer clientConn.Close()
+	ctx.clientConn = clientConn
 	_, err = clientConn.Write(tunnelEstablishedResponseLine) // 修改隧道响应成功  HTTP/1.1 200 Connection established
 	if err != nil {
 		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 通知客户端隧道已连接失败, %s", ctx.Req.URL.Host, err))
 		return
 	}
-	// 创建ssl 解密证书
-	tlsConfig, err := p.cert.Generate(ctx.Req.URL.Host)
+	p.interceptConn(ctx, clientConn)
+}
+
+// 白名单放行的隧道不解密
+func (p *Proxy) shouldDecrypt(ctx *Context) bool {
+	if !p.decryptHTTPS || !p.decryptACL.allowedAddr(ctx.Req.RemoteAddr) {
+		return false
+	}
+	rules := ctx.Rules()
+	for _, whitelist := range rules.Whitelist { // 遍历白名单
+		if gregex.IsMatchString(whitelist, ctx.Req.URL.Host) {
+			rules.Hit(filterrules.RuleWhitelist)
+			return false
+		}
+	}
+
+	return true
+}
+
+// 解析隧道内的流量, TLS握手则解密, 否则按明文HTTP处理
+func (p *Proxy) interceptConn(ctx *Context, clientConn net.Conn) {
+	// 使用空闲超时代替固定期限, 连接有读写活动就不会超时
+	idleConn := newIdleTimeoutConn(clientConn, p.clientIdleTimeout)
+	client := newBufferedConn(idleConn)
+	head, err := client.Peek(1)
 	if err != nil {
-		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 生成证书失败: %s", ctx.Req.URL.Host, err))
-		rw.WriteHeader(http.StatusBadGateway)
+		if err != io.EOF && !isTimeoutError(err) {
+			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 读取客户端数据失败: %s", ctx.Req.URL.Host, err))
+		}
+		return
+	}
+	// 隧道内不是TLS握手, 如ws://经CONNECT建立的隧道, 按明文HTTP处理
+	if head[0] != tlsRecordTypeHandshake {
+		p.serveConn(ctx, client, "http")
 		return
 	}
+	// 按ClientHello中的SNI生成证书, 客户端未发送SNI时使用CONNECT的域名
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = ctx.Req.URL.Hostname()
+			}
+			var upstream cert.UpstreamFunc
+			if p.mirrorUpstreamCert {
+				upstream = func() (*x509.Certificate, error) {
+					return p.upstreamCertificate(ctx, hello.ServerName)
+				}
+			}
+			c, err := p.cert.Get(host, upstream)
+			if err != nil {
+				p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 生成证书失败: %s", host, err))
+			}
+			return c, err
+		},
+	}
+	// 通过ALPN与客户端协商协议
+	if p.disableHTTP2 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	} else {
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
 	// tls.Server使用conn作为下层传输接口返回一个TLS连接的服务端侧。配置参数config必须是非nil的且必须含有至少一个证书。
-	tlsClientConn := tls.Server(clientConn, tlsConfig)
-	tlsClientConn.SetDeadline(time.Now().Add(defaultClientReadWriteTimeout)) // SetDeadline设置该连接的读写操作绝对期限。t为Time零值表示不设置超时。在一次Write/Read方法超时后，TLS连接状态会被破坏，之后所有的读写操作都会返回同一错误。
+	tlsClientConn := tls.Server(client, tlsConfig)
 	defer tlsClientConn.Close()
 
 	if err := tlsClientConn.Handshake(); err != nil {
 		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 握手失败: %s", ctx.Req.URL.Host, err))
 		return
 	}
+	if tlsClientConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		// HTTP/2的读取循环一直阻塞在Read, 向客户端持续发送stream数据时也不能超时
+		idleConn.writeExtendsRead = true
+		p.serveHTTP2(ctx, tlsClientConn)
+		return
+	}
+	p.serveConn(ctx, tlsClientConn, "https")
+}
 
-	buf := bufio.NewReader(tlsClientConn) // 读取ssl conn的内容，
+// 连接上游服务器获取其证书, 不校验证书
+func (p *Proxy) upstreamCertificate(ctx *Context, serverName string) (*x509.Certificate, error) {
+	conn, err := p.dialTunnelTarget(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(defaultTargetConnectTimeout))
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err = tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s - 上游服务器未返回证书", ctx.Req.URL.Host)
+	}
 
-	tlsReq, err := http.ReadRequest(buf) // 读取 Request // 修改http 头部 的内容就从此开始 的内容就从此开始
+	return certs[0], nil
+}
 
-	if err != nil {
-		if err != io.EOF {
-			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 读取客户端请求失败: %s", ctx.Req.URL.Host, err))
+// 同一连接上依次读取请求, 直到客户端关闭连接或要求关闭
+func (p *Proxy) serveConn(ctx *Context, clientConn net.Conn, scheme string) {
+	buf := bufio.NewReader(clientConn) // 读取ssl conn的内容，
+	for {
+		tlsReq, err := http.ReadRequest(buf) // 读取 Request // 修改http 头部 的内容就从此开始 的内容就从此开始
+		if err != nil {
+			if err != io.EOF && !isTimeoutError(err) {
+				p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 读取客户端请求失败: %s", ctx.Req.URL.Host, err))
+			}
+			return
+		}
+		if !p.serveDecryptedRequest(ctx, tlsReq, clientConn, buf, scheme) {
+			return
 		}
-		return
 	}
+}
 
+// 处理解密后的单个请求, 每个请求使用独立的Context, 返回连接是否可以继续使用
+func (p *Proxy) serveDecryptedRequest(connCtx *Context, tlsReq *http.Request, tlsClientConn net.Conn, clientReader *bufio.Reader, scheme string) (keepAlive bool) {
 	// 给 tlsReq的几个结果赋值
-	tlsReq.RemoteAddr = ctx.Req.RemoteAddr
-	tlsReq.URL.Scheme = "https"
+	tlsReq.RemoteAddr = connCtx.Req.RemoteAddr
+	tlsReq.URL.Scheme = scheme
 	tlsReq.URL.Host = tlsReq.Host
+	if conn, ok := tlsClientConn.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		tlsReq.TLS = &state
+	}
+	reqBody := tlsReq.Body
 
-	ctx.Req = tlsReq
+	ctx := &Context{
+		Req:          tlsReq.WithContext(connCtx.Req.Context()),
+		Data:         make(map[interface{}]interface{}),
+		User:         connCtx.User,
+		clientConn:   connCtx.clientConn,
+		clientReader: clientReader,
+	}
+	defer p.delegate.Finish(ctx)
 
+	responded := false
 	p.DoRequest(ctx, func(resp *http.Response, err error) {
+		if isFaultError(err) {
+			conn := ctx.clientConn
+			if conn == nil {
+				conn = tlsClientConn
+			}
+			closeClientConn(conn, err == errFaultReset)
+			return
+		}
 		if err != nil {
 			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 请求错误: %s", ctx.Req.URL, err))
 			tlsClientConn.Write(badGateway)
 			return
 		}
+		defer resp.Body.Close()
+		if serverConn, ok := switchedWebSocket(resp); ok {
+			err = writeSwitchingProtocols(tlsClientConn, resp)
+			if err != nil {
+				p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, WebSocket握手响应写入客户端失败, %s", ctx.Req.URL, err))
+				return
+			}
+			p.relayWebSocket(ctx, tlsClientConn, clientReader, serverConn)
+			return
+		}
 		err = resp.Write(tlsClientConn)
 		if err != nil {
+			if ctx.Fault != nil {
+				// 截断的响应写入时长度不符, 不是写入错误
+				return
+			}
 			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, response写入客户端失败, %s", ctx.Req.URL, err))
+			return
 		}
-		resp.Body.Close()
+		responded = !resp.Close
 	})
+	if !responded || tlsReq.Close {
+		return false
+	}
+	// 未读完的请求body会影响下一个请求的解析, Close时读完剩余部分, 已被Transport关闭时不再读取
+	err := reqBody.Close()
+
+	return err == nil
 }
 
 // 隧道转发
@@ -372,52 +667,126 @@ func (p *Proxy) forwardTunnel(ctx *Context, rw http.ResponseWriter) {
 		return
 	}
 	defer clientConn.Close()
-	parentProxyURL, err := p.delegate.ParentProxy(ctx.Req)
+	targetConn, err := p.dialTunnel(ctx)
 	if err != nil {
-		p.delegate.ErrorLog(fmt.Errorf("%s - 解析代理地址错误: %s", ctx.Req.URL.Host, err))
-		rw.WriteHeader(http.StatusBadGateway)
+		p.delegate.ErrorLog(fmt.Errorf("%s - 隧道转发连接目标服务器失败: %s", ctx.Req.URL.Host, err))
+		clientConn.Write(badGateway)
 		return
 	}
-	targetAddr := ctx.Req.URL.Host
-	if parentProxyURL != nil {
-		targetAddr = parentProxyURL.Host
-	}
-
-	targetConn, err := net.DialTimeout("tcp", targetAddr, defaultTargetConnectTimeout)
+	defer targetConn.Close()
+	_, err = clientConn.Write(tunnelEstablishedResponseLine)
 	if err != nil {
-		p.delegate.ErrorLog(fmt.Errorf("%s - 隧道转发连接目标服务器失败: %s", ctx.Req.URL.Host, err))
-		rw.WriteHeader(http.StatusBadGateway)
+		p.delegate.ErrorLog(fmt.Errorf("%s - 隧道连接成功,通知客户端错误: %s", ctx.Req.URL.Host, err))
 		return
 	}
-	defer targetConn.Close()
+	p.relayTunnel(ctx, clientConn, targetConn)
+}
 
-	clientConn.SetDeadline(time.Now().Add(defaultClientReadWriteTimeout))
-	targetConn.SetDeadline(time.Now().Add(defaultTargetReadWriteTimeout))
+// 连接隧道目标, 有上级代理时通过上级代理建立隧道
+func (p *Proxy) dialTunnelTarget(ctx *Context) (net.Conn, error) {
+	parentProxyURL, err := p.parentProxy(ctx.Req)
+	if err != nil {
+		return nil, fmt.Errorf("解析代理地址错误: %s", err)
+	}
 	if parentProxyURL == nil {
-		_, err = clientConn.Write(tunnelEstablishedResponseLine)
-		if err != nil {
-			p.delegate.ErrorLog(fmt.Errorf("%s - 隧道连接成功,通知客户端错误: %s", ctx.Req.URL.Host, err))
-			return
-		}
-	} else {
-		tunnelRequestLine := makeTunnelRequestLine(ctx.Req.URL.Host)
-		targetConn.Write([]byte(tunnelRequestLine))
+		return net.DialTimeout("tcp", ctx.Req.URL.Host, defaultTargetConnectTimeout)
+	}
+	conn, err := dialParentProxy(parentProxyURL, ctx.Req.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("上级代理[%s]: %s", parentProxyURL.Host, err)
 	}
 
-	p.transfer(clientConn, targetConn)
+	return conn, nil
 }
 
-// 双向转发
-func (p *Proxy) transfer(src net.Conn, dst net.Conn) {
-	go func() {
-		io.Copy(src, dst)
-		src.Close()
-		dst.Close()
-	}()
+// 构造CONNECT请求上下文, SOCKS5、透明代理借此复用HTTP代理的处理流程, 被Delegate中断或响应时返回false
+func (p *Proxy) connectContext(conn net.Conn, addr string, user *User) (*Context, bool) {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if user != nil {
+		req = withUser(req, user)
+	}
+	ctx := &Context{
+		Req:        req,
+		Data:       make(map[interface{}]interface{}),
+		User:       user,
+		clientConn: conn,
+	}
+	rw := &discardResponseWriter{header: make(http.Header)}
+	p.delegate.Connect(ctx, rw)
+	if ctx.abort {
+		return ctx, false
+	}
+	p.delegate.Auth(ctx, rw)
+
+	// 无法返回HTTP响应, 调用Respond视为拒绝连接
+	return ctx, !ctx.abort && ctx.response == nil
+}
+
+// discardResponseWriter 没有HTTP响应的连接供Delegate.Connect、Delegate.Auth使用, 写入的内容会被丢弃,
+// 是否拒绝连接以ctx.Abort为准
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
 
-	io.Copy(dst, src)
-	dst.Close()
-	src.Close()
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {}
+
+// 接受连接并交给handle处理, 临时错误时重试, 连接数计入clientConnNum
+func (p *Proxy) serveListener(l net.Listener, handle func(conn net.Conn)) error {
+	if !p.trackListener(l) {
+		l.Close()
+		return ErrProxyClosed
+	}
+	defer p.untrackListener(l)
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.shuttingDown() {
+				return ErrProxyClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if !p.clientACL.allowedAddr(conn.RemoteAddr().String()) {
+			conn.Close()
+			p.delegate.ErrorLog(fmt.Errorf("%s - 客户端不允许使用代理, 拒绝连接", conn.RemoteAddr()))
+			continue
+		}
+		go func() {
+			atomic.AddInt32(&p.clientConnNum, 1)
+			defer atomic.AddInt32(&p.clientConnNum, -1)
+			handle(conn)
+		}()
+	}
 }
 
 // 获取底层连接
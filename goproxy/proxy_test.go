@@ -0,0 +1,89 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 通过CONNECT建立解密的TLS连接, 只协商HTTP/1.1
+func dialDecrypted(t *testing.T, proxyAddr, target string) (*tls.Conn, *bufio.Reader) {
+	conn, _ := connectProxy(t, proxyAddr, target)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, tlsConn.Handshake())
+
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+func TestDecryptedKeepAlive(t *testing.T) {
+	loadTestCA(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// 不读取请求body
+		fmt.Fprintf(rw, "%s %s", req.Method, req.URL.Path)
+	}))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+	d := newFinishRecorder()
+	p := New(WithDelegate(d), WithDecryptHTTPS(&memCache{}), WithTransport(insecureTransport()),
+		WithClientIdleTimeout(300*time.Millisecond))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	proxyAddr := ps.Listener.Addr().String()
+
+	// 发送请求并读取完整响应body
+	roundTrip := func(t *testing.T, conn *tls.Conn, br *bufio.Reader, req string) string {
+		_, err := conn.Write([]byte(req))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("requests on one connection", func(t *testing.T) {
+		conn, br := dialDecrypted(t, proxyAddr, target)
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			require.Equal(t, fmt.Sprintf("GET /p%d", i), roundTrip(t, conn, br, fmt.Sprintf("GET /p%d HTTP/1.1\r\nHost: %s\r\n\r\n", i, target)))
+			require.Equal(t, fmt.Sprintf("https://%s/p%d", target, i), d.nextRequest().Req.URL.String())
+		}
+		// 带body的请求转发后连接仍可继续使用
+		require.Equal(t, "POST /upload", roundTrip(t, conn, br, "POST /upload HTTP/1.1\r\nHost: "+target+"\r\nContent-Length: 5\r\n\r\nhello"))
+		d.nextRequest()
+		require.Equal(t, "GET /after", roundTrip(t, conn, br, "GET /after HTTP/1.1\r\nHost: "+target+"\r\n\r\n"))
+		d.nextRequest()
+	})
+
+	t.Run("connection close", func(t *testing.T) {
+		conn, br := dialDecrypted(t, proxyAddr, target)
+		defer conn.Close()
+		require.Equal(t, "GET /last", roundTrip(t, conn, br, "GET /last HTTP/1.1\r\nHost: "+target+"\r\nConnection: close\r\n\r\n"))
+		d.nextRequest()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := br.ReadByte()
+		require.Error(t, err)
+		require.False(t, isTimeoutError(err))
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn, br := dialDecrypted(t, proxyAddr, target)
+		defer conn.Close()
+		require.Equal(t, "GET /idle", roundTrip(t, conn, br, "GET /idle HTTP/1.1\r\nHost: "+target+"\r\n\r\n"))
+		d.nextRequest()
+		// 空闲超过WithClientIdleTimeout后代理关闭连接
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := br.ReadByte()
+		require.Error(t, err)
+		require.False(t, isTimeoutError(err))
+		require.True(t, time.Since(start) >= 200*time.Millisecond)
+	})
+}
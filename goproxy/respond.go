@@ -0,0 +1,62 @@
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NewResponse 创建响应, 用于ctx.Respond
+func NewResponse(req *http.Request, code int, contentType, body string) *http.Response {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp := &http.Response{
+		StatusCode:    code,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	normalizeResponse(resp, req)
+
+	return resp
+}
+
+// 补全Delegate构造的响应, 使其可以按正常流程写入客户端
+func normalizeResponse(resp *http.Response, req *http.Request) {
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if resp.Status == "" {
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if resp.ProtoMajor == 0 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	if resp.ContentLength == 0 && resp.Body != http.NoBody && resp.Header.Get("Content-Length") == "" {
+		// 长度未知时使用chunked, 连接可继续使用
+		resp.ContentLength = -1
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if resp.Request == nil {
+		resp.Request = req
+	}
+}
+
+// 将响应写入客户端
+func writeResponse(rw http.ResponseWriter, resp *http.Response) {
+	CopyHeader(rw.Header(), resp.Header)
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
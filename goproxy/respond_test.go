@@ -0,0 +1,35 @@
+package goproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type connectRespondDelegate struct {
+	NopDelegate
+}
+
+func (d *connectRespondDelegate) Connect(ctx *Context, rw http.ResponseWriter) {
+	ctx.Respond(NewResponse(ctx.Req, http.StatusForbidden, "text/plain", "blocked"))
+}
+
+func TestConnectRespondAfterAuth(t *testing.T) {
+	p := New(WithDelegates(&connectRespondDelegate{}), WithAuthenticator(testAuthenticator{"mars": "secret"}, "mars"))
+
+	// 未认证时返回407, 不返回Delegate设置的响应
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest(http.MethodConnect, "example.com:443", nil))
+	require.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+	require.NotContains(t, rw.Body.String(), "blocked")
+
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("mars:secret")))
+	p.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusForbidden, rw.Code)
+	require.Equal(t, "blocked", rw.Body.String())
+}
@@ -0,0 +1,167 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// ReverseRoute 反向代理路由
+type ReverseRoute struct {
+	// Host 匹配的请求Host, 不含端口时忽略请求端口, 为空匹配所有Host
+	Host string
+	// PathPrefix 匹配的路径前缀, 按路径段匹配, 转发时替换为Upstream的路径, 为空等同于/
+	PathPrefix string
+	// Upstream 上游地址, 支持http、https, 如 http://127.0.0.1:8080/api
+	Upstream *url.URL
+	// PreserveHost 保留客户端请求的Host, 默认使用上游地址的Host
+	PreserveHost bool
+}
+
+// 请求是否匹配路由
+func (r *ReverseRoute) match(req *http.Request) bool {
+	if r.Host != "" {
+		host := req.Host
+		if !strings.Contains(r.Host, ":") {
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		}
+		if !strings.EqualFold(host, r.Host) {
+			return false
+		}
+	}
+
+	return hasPathPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// 按路径段匹配前缀, /api匹配/api、/api/users, 不匹配/apis
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || prefix == "" || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// 路由优先级, 指定Host优先, 其次路径前缀越长越优先
+func (r *ReverseRoute) priority() int {
+	n := len(r.PathPrefix)
+	if r.Host != "" {
+		n += 1 << 16
+	}
+
+	return n
+}
+
+// ReverseHandler 反向代理, 按路由转发到上游, 与正向代理使用相同的过滤规则与记录流程
+func (p *Proxy) ReverseHandler(routes []ReverseRoute) http.Handler {
+	return &reverseHandler{
+		proxy:  p,
+		routes: routes,
+	}
+}
+
+type reverseHandler struct {
+	proxy  *Proxy
+	routes []ReverseRoute
+}
+
+func (h *reverseHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p := h.proxy
+	atomic.AddInt32(&p.clientConnNum, 1)
+	defer func() {
+		atomic.AddInt32(&p.clientConnNum, -1)
+	}()
+	ctx := &Context{
+		Req:  req,
+		Data: make(map[interface{}]interface{}),
+	}
+	if !p.clientACL.allowedAddr(req.RemoteAddr) {
+		p.denyClient(ctx, rw)
+		return
+	}
+	route := h.route(req)
+	if route == nil {
+		http.NotFound(rw, req)
+		return
+	}
+	defer p.delegate.Finish(ctx)
+	p.delegate.Connect(ctx, rw)
+	if ctx.abort {
+		return
+	}
+	p.delegate.Auth(ctx, rw)
+	if ctx.abort {
+		return
+	}
+	rewriteReverseRequest(req, route)
+	p.serveRequest(ctx, rw)
+}
+
+// 匹配优先级最高的路由
+func (h *reverseHandler) route(req *http.Request) *ReverseRoute {
+	var matched *ReverseRoute
+	for i := range h.routes {
+		r := &h.routes[i]
+		if r.match(req) && (matched == nil || r.priority() > matched.priority()) {
+			matched = r
+		}
+	}
+
+	return matched
+}
+
+// 请求改写为上游地址, 并设置X-Forwarded-*
+func rewriteReverseRequest(req *http.Request, route *ReverseRoute) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	upstream := route.Upstream
+	path := strings.TrimPrefix(req.URL.Path, route.PathPrefix)
+	req.URL.Scheme = upstream.Scheme
+	req.URL.Host = upstream.Host
+	req.URL.Path = joinURLPath(upstream.Path, path)
+	req.URL.RawPath = ""
+	if upstream.RawQuery != "" {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = upstream.RawQuery
+		} else {
+			req.URL.RawQuery = fmt.Sprintf("%s&%s", upstream.RawQuery, req.URL.RawQuery)
+		}
+	}
+	if !route.PreserveHost {
+		req.Host = upstream.Host
+	}
+}
+
+// 拼接路径, 只保留一个/
+func joinURLPath(a, b string) string {
+	if b == "" && a != "" {
+		return a
+	}
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
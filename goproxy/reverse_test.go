@@ -0,0 +1,137 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"", "/users", "/users"},
+		{"/v1", "", "/v1"},
+		{"/v1", "/users", "/v1/users"},
+		{"/v1/", "/users", "/v1/users"},
+		{"/v1/", "users", "/v1/users"},
+		{"/v1", "users", "/v1/users"},
+		{"", "", "/"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, joinURLPath(tt.a, tt.b), "%q + %q", tt.a, tt.b)
+	}
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/api", "/api", true},
+		{"/api/users", "/api", true},
+		{"/apis", "/api", false},
+		{"/api-v2/users", "/api", false},
+		{"/api/users", "/api/", true},
+		{"/api", "/api/", false},
+		{"/static.js", "/", true},
+		{"/any", "", true},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, hasPathPrefix(tt.path, tt.prefix), "%q %q", tt.path, tt.prefix)
+	}
+}
+
+func TestReverseHandler(t *testing.T) {
+	echo := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "host=%s uri=%s xff=%s xfh=%s xfp=%s", req.Host, req.RequestURI,
+			req.Header.Get("X-Forwarded-For"), req.Header.Get("X-Forwarded-Host"), req.Header.Get("X-Forwarded-Proto"))
+	})
+	api := httptest.NewServer(echo)
+	defer api.Close()
+	static := httptest.NewTLSServer(echo)
+	defer static.Close()
+	apiURL, err := url.Parse(api.URL + "/v1?k=1")
+	require.NoError(t, err)
+	staticURL, err := url.Parse(static.URL)
+	require.NoError(t, err)
+	staticHost := staticURL.Host
+
+	d := newFinishRecorder()
+	p := New(WithDelegate(d), WithTransport(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}))
+	rs := httptest.NewServer(p.ReverseHandler([]ReverseRoute{
+		{PathPrefix: "/api", Upstream: apiURL},
+		{PathPrefix: "/assets", Upstream: staticURL},
+		{Host: "static.test", PathPrefix: "/", Upstream: staticURL, PreserveHost: true},
+	}))
+	defer rs.Close()
+	rsHost := rs.Listener.Addr().String()
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		upstream string
+		body     string
+	}{
+		{
+			name:     "path prefix",
+			path:     "/api/users?x=2",
+			upstream: api.URL + "/v1/users?k=1&x=2",
+			body:     "host=" + apiURL.Host + " uri=/v1/users?k=1&x=2 xff=1.2.3.4, 127.0.0.1 xfh=" + rsHost + " xfp=http",
+		},
+		{
+			name:     "exact prefix",
+			path:     "/api",
+			upstream: api.URL + "/v1?k=1",
+			body:     "host=" + apiURL.Host + " uri=/v1?k=1 xff=1.2.3.4, 127.0.0.1 xfh=" + rsHost + " xfp=http",
+		},
+		{
+			name:     "https upstream",
+			path:     "/assets/app.js",
+			upstream: static.URL + "/app.js",
+			body:     "host=" + staticHost + " uri=/app.js xff=1.2.3.4, 127.0.0.1 xfh=" + rsHost + " xfp=http",
+		},
+		{
+			// 指定Host的路由优先于更长的路径前缀
+			name:     "host route preserve host",
+			host:     "static.test",
+			path:     "/api/z",
+			upstream: static.URL + "/api/z",
+			body:     "host=static.test uri=/api/z xff=1.2.3.4, 127.0.0.1 xfh=static.test xfp=http",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, rs.URL+tt.path, nil)
+			require.NoError(t, err)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			req.Header.Set("X-Forwarded-For", "1.2.3.4")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, tt.body, string(body))
+			require.Equal(t, tt.upstream, (<-d.done).Req.URL.String())
+		})
+	}
+
+	// 没有匹配的路由返回404, 不交给Delegate
+	for _, path := range []string{"/other", "/apis"} {
+		resp, err := http.Get(rs.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+	require.Len(t, d.done, 0)
+}
@@ -0,0 +1,66 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrProxyClosed 调用Shutdown后Serve系列方法返回该错误
+var ErrProxyClosed = errors.New("goproxy: Proxy closed")
+
+// 等待连接结束时的轮询间隔
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown 关闭ServeSOCKS5、ServeTransparent等方法的监听器, 等待所有客户端连接处理结束.
+// ctx超时则返回ctx.Err(), 未结束的连接不会被强制关闭.
+// 通过http.Server运行的ServeHTTP需由调用方关闭对应的http.Server
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&p.inShutdown, 1)
+	p.listenersMu.Lock()
+	for l := range p.listeners {
+		l.Close()
+		delete(p.listeners, l)
+	}
+	p.listenersMu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if p.ClientConnNum() <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) shuttingDown() bool {
+	return atomic.LoadInt32(&p.inShutdown) != 0
+}
+
+// 记录监听器, Shutdown时关闭, 已调用Shutdown则返回false
+func (p *Proxy) trackListener(l net.Listener) bool {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	if p.shuttingDown() {
+		return false
+	}
+	if p.listeners == nil {
+		p.listeners = make(map[net.Listener]struct{})
+	}
+	p.listeners[l] = struct{}{}
+
+	return true
+}
+
+func (p *Proxy) untrackListener(l net.Listener) {
+	p.listenersMu.Lock()
+	delete(p.listeners, l)
+	p.listenersMu.Unlock()
+}
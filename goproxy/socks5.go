@@ -0,0 +1,238 @@
+package goproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5协议常量 RFC1928 RFC1929
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepCommandNotSupported = 0x07
+	socks5RepAtypNotSupported    = 0x08
+)
+
+// SOCKS5握手超时时间
+const socks5HandshakeTimeout = 30 * time.Second
+
+// ServeSOCKS5 在l上提供SOCKS5代理服务, 与HTTP代理使用相同的解密、过滤规则与记录流程
+func (p *Proxy) ServeSOCKS5(l net.Listener) error {
+	return p.serveListener(l, p.serveSOCKS5Conn)
+}
+
+// 处理单个SOCKS5连接, 只支持CONNECT命令
+func (p *Proxy) serveSOCKS5Conn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	user, err := p.socks5Handshake(conn)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5握手失败: %s", conn.RemoteAddr(), err))
+		return
+	}
+	addr, err := readSOCKS5Request(conn)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5读取请求失败: %s", conn.RemoteAddr(), err))
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	ctx, ok := p.connectContext(conn, addr, user)
+	defer p.delegate.Finish(ctx)
+	if !ok {
+		writeSOCKS5Reply(conn, socks5RepNotAllowed)
+		return
+	}
+
+	if p.shouldDecrypt(ctx) {
+		err = writeSOCKS5Reply(conn, socks5RepSucceeded)
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5通知客户端连接成功失败: %s", addr, err))
+			return
+		}
+		p.interceptConn(ctx, conn)
+		return
+	}
+	targetConn, err := p.dialTunnel(ctx)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5连接目标服务器失败: %s", addr, err))
+		writeSOCKS5Reply(conn, socks5RepHostUnreachable)
+		return
+	}
+	defer targetConn.Close()
+	err = writeSOCKS5Reply(conn, socks5RepSucceeded)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5通知客户端连接成功失败: %s", addr, err))
+		return
+	}
+	client := newBufferedConn(conn)
+	if peekPlainHTTP(client) {
+		// 明文HTTP与普通代理请求一样解析, 请求由Transport连接上游, 不使用隧道连接
+		targetConn.Close()
+		ctx.Tunnel = nil
+		p.serveConn(ctx, newIdleTimeoutConn(client, p.clientIdleTimeout), "http")
+		return
+	}
+	p.relayTunnel(ctx, client, targetConn)
+}
+
+// 探测客户端首个数据包是否为明文HTTP请求, 超时视为服务端先发送数据的协议
+func peekPlainHTTP(client *bufferedConn) bool {
+	client.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	defer client.SetReadDeadline(time.Time{})
+	head, err := client.Peek(1)
+	if err != nil || head[0] == tlsRecordTypeHandshake {
+		return false
+	}
+
+	return peekHTTPHost(client.r) != ""
+}
+
+// 协商认证方式, 开启认证时只接受用户名密码认证
+func (p *Proxy) socks5Handshake(conn net.Conn) (*User, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socks5Version {
+		return nil, fmt.Errorf("不支持的协议版本: %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socks5AuthNone)
+	if p.socks5Authenticator != nil {
+		method = socks5AuthPassword
+	}
+	supported := false
+	for _, m := range methods {
+		if m == method {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return nil, errors.New("客户端不支持所需的认证方式")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5AuthNone {
+		return nil, nil
+	}
+
+	username, password, err := readSOCKS5Password(conn)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := p.socks5Authenticator.Authenticate(username, password)
+	if !ok {
+		conn.Write([]byte{socks5PasswordVersion, 0x01})
+		return nil, fmt.Errorf("认证失败: [user: %s]", username)
+	}
+	if _, err := conn.Write([]byte{socks5PasswordVersion, 0x00}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// 读取用户名密码 RFC1929
+func readSOCKS5Password(r io.Reader) (username, password string, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if head[0] != socks5PasswordVersion {
+		err = fmt.Errorf("不支持的认证版本: %d", head[0])
+		return
+	}
+	// 用户名之后紧跟密码长度
+	buf := make([]byte, int(head[1])+1)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	username = string(buf[:head[1]])
+	buf = make([]byte, buf[head[1]])
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	password = string(buf)
+
+	return
+}
+
+// 读取请求, 返回目标地址 host:port
+func readSOCKS5Request(conn net.Conn) (string, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", fmt.Errorf("不支持的协议版本: %d", head[0])
+	}
+	if head[1] != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5RepCommandNotSupported)
+		return "", fmt.Errorf("不支持的命令: %d", head[1])
+	}
+	var host string
+	switch head[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(conn, socks5RepAtypNotSupported)
+		return "", fmt.Errorf("不支持的地址类型: %d", head[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// 响应请求, 绑定地址固定为0.0.0.0:0
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+
+	return err
+}
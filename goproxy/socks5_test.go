@@ -0,0 +1,169 @@
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// 启动SOCKS5代理, 返回监听地址
+func startSOCKS5(t *testing.T, p *Proxy) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.ServeSOCKS5(l)
+
+	return l.Addr().String(), func() {
+		l.Close()
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	loadTestCA(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})
+	tlsUpstream := httptest.NewTLSServer(handler)
+	defer tlsUpstream.Close()
+	plainUpstream := httptest.NewServer(handler)
+	defer plainUpstream.Close()
+
+	for _, decrypt := range []bool{false, true} {
+		opts := []Option{
+			WithSOCKS5Authenticator(testAuthenticator{"mars": "secret"}),
+			WithTransport(insecureTransport()),
+		}
+		if decrypt {
+			opts = append(opts, WithDecryptHTTPS(&memCache{}))
+		}
+		addr, stop := startSOCKS5(t, New(opts...))
+
+		dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "mars", Password: "secret"}, proxy.Direct)
+		require.NoError(t, err)
+		transport := insecureTransport()
+		transport.Dial = dialer.Dial
+		client := &http.Client{Transport: transport}
+		for _, upstream := range []*httptest.Server{tlsUpstream, plainUpstream} {
+			resp, err := client.Get(upstream.URL + "/socks5")
+			require.NoError(t, err, "decrypt: %v", decrypt)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, "hello /socks5", string(body))
+		}
+		transport.CloseIdleConnections()
+
+		dialer, err = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "mars", Password: "wrong"}, proxy.Direct)
+		require.NoError(t, err)
+		_, err = dialer.Dial("tcp", plainUpstream.Listener.Addr().String())
+		require.Error(t, err)
+		stop()
+	}
+}
+
+func TestSOCKS5PlainHTTP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+	d := newFinishRecorder()
+	addr, stop := startSOCKS5(t, New(WithDelegate(d)))
+	defer stop()
+
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+	resp, err := client.Get(upstream.URL + "/plain")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "hello /plain", string(body))
+
+	// 不解密时明文HTTP请求同样经过Delegate, 不作为隧道转发
+	ctx := d.nextRequest()
+	require.Equal(t, upstream.URL+"/plain", ctx.Req.URL.String())
+}
+
+// 通过net.Pipe与serveSOCKS5Conn交互
+func pipeSOCKS5(t *testing.T, p *Proxy) net.Conn {
+	client, conn := net.Pipe()
+	go p.serveSOCKS5Conn(conn)
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+
+	return client
+}
+
+// 发送数据并读取n字节的响应
+func socks5RoundTrip(t *testing.T, conn net.Conn, req []byte, n int) []byte {
+	_, err := conn.Write(req)
+	require.NoError(t, err)
+	resp := make([]byte, n)
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestSOCKS5Handshake(t *testing.T) {
+	auth := New(WithSOCKS5Authenticator(testAuthenticator{"mars": "secret"}))
+
+	// 开启认证时客户端只支持无认证
+	conn := pipeSOCKS5(t, auth)
+	require.Equal(t, []byte{socks5Version, socks5AuthNoAcceptable}, socks5RoundTrip(t, conn, []byte{5, 1, socks5AuthNone}, 2))
+	conn.Close()
+
+	// RFC1929 密码错误
+	conn = pipeSOCKS5(t, auth)
+	require.Equal(t, []byte{socks5Version, socks5AuthPassword}, socks5RoundTrip(t, conn, []byte{5, 2, socks5AuthNone, socks5AuthPassword}, 2))
+	req := append([]byte{socks5PasswordVersion, 4}, "mars"...)
+	req = append(append(req, 5), "wrong"...)
+	require.Equal(t, []byte{socks5PasswordVersion, 0x01}, socks5RoundTrip(t, conn, req, 2))
+	conn.Close()
+
+	// 不支持的命令、地址类型
+	noAuth := New()
+	conn = pipeSOCKS5(t, noAuth)
+	require.Equal(t, []byte{socks5Version, socks5AuthNone}, socks5RoundTrip(t, conn, []byte{5, 1, socks5AuthNone}, 2))
+	// 读取请求头后即响应错误, 不再读取地址
+	bind := []byte{5, 0x02, 0, socks5AtypIPv4}
+	require.Equal(t, byte(socks5RepCommandNotSupported), socks5RoundTrip(t, conn, bind, 10)[1])
+	conn.Close()
+
+	conn = pipeSOCKS5(t, noAuth)
+	socks5RoundTrip(t, conn, []byte{5, 1, socks5AuthNone}, 2)
+	require.Equal(t, byte(socks5RepAtypNotSupported), socks5RoundTrip(t, conn, []byte{5, socks5CmdConnect, 0, 0x09}, 10)[1])
+	conn.Close()
+}
+
+func TestReadSOCKS5Request(t *testing.T) {
+	read := func(req []byte) (string, error) {
+		client, conn := net.Pipe()
+		defer client.Close()
+		go client.Write(req)
+		return readSOCKS5Request(conn)
+	}
+
+	addr, err := read([]byte{5, socks5CmdConnect, 0, socks5AtypIPv4, 10, 0, 0, 1, 0x01, 0xbb})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:443", addr)
+
+	addr, err = read(append(append([]byte{5, socks5CmdConnect, 0, socks5AtypDomain, 11}, "example.com"...), 0, 80))
+	require.NoError(t, err)
+	require.Equal(t, "example.com:80", addr)
+
+	ipv6 := append([]byte{5, socks5CmdConnect, 0, socks5AtypIPv6}, net.ParseIP("::1")...)
+	addr, err = read(append(ipv6, 0x1f, 0x90))
+	require.NoError(t, err)
+	require.Equal(t, "[::1]:8080", addr)
+
+	_, err = read([]byte{4, socks5CmdConnect, 0, socks5AtypIPv4})
+	require.Error(t, err)
+}
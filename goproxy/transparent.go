@@ -0,0 +1,155 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 探测客户端首个数据包的超时时间, 超时视为服务端先发送数据的协议, 直接隧道转发
+const transparentPeekTimeout = 2 * time.Second
+
+// OriginalDstFunc 获取被转发连接的原始目标地址 ip:port
+type OriginalDstFunc func(conn net.Conn) (string, error)
+
+// TPROXYOriginalDst iptables TPROXY转发的连接, 本地地址即原始目标地址
+func TPROXYOriginalDst(conn net.Conn) (string, error) {
+	return conn.LocalAddr().String(), nil
+}
+
+// ServeTransparent 在l上提供透明代理服务, 接收iptables REDIRECT/TPROXY转发的连接
+func (p *Proxy) ServeTransparent(l net.Listener, originalDst OriginalDstFunc) error {
+	return p.serveListener(l, func(conn net.Conn) {
+		dst, err := originalDst(conn)
+		if err != nil {
+			conn.Close()
+			p.delegate.ErrorLog(fmt.Errorf("%s - 透明代理获取原始目标地址失败: %s", conn.RemoteAddr(), err))
+			return
+		}
+		p.ServeTransparentConn(conn, dst)
+	})
+}
+
+// ServeTransparentConn 处理透明代理连接, dst为原始目标地址.
+// TLS连接根据SNI、明文HTTP根据Host确定目标域名, 其余协议直接转发到dst
+func (p *Proxy) ServeTransparentConn(conn net.Conn, dst string) {
+	defer conn.Close()
+	if dst == conn.LocalAddr().String() {
+		p.delegate.ErrorLog(fmt.Errorf("%s - 透明代理原始目标地址是代理自身, 拒绝连接", conn.RemoteAddr()))
+		return
+	}
+	dstHost, dstPort, err := net.SplitHostPort(dst)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - 透明代理原始目标地址错误: %s", conn.RemoteAddr(), err))
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	client := newBufferedConn(conn)
+	host := dstHost
+	isTLS, isHTTP := false, false
+	if head, err := client.Peek(1); err == nil {
+		if head[0] == tlsRecordTypeHandshake {
+			isTLS = true
+			serverName, consumed := peekServerName(client.r)
+			// 已读取的ClientHello需重放给后续的TLS握手
+			client = &bufferedConn{
+				Conn: conn,
+				r:    bufio.NewReader(io.MultiReader(bytes.NewReader(consumed), client.r)),
+			}
+			if serverName != "" {
+				host = serverName
+			}
+		} else if h := peekHTTPHost(client.r); h != "" {
+			isHTTP = true
+			if hostname, _, err := net.SplitHostPort(h); err == nil {
+				h = hostname
+			}
+			host = h
+		}
+	} else if !isTimeoutError(err) {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ctx, ok := p.connectContext(conn, net.JoinHostPort(host, dstPort), nil)
+	defer p.delegate.Finish(ctx)
+	if !ok {
+		return
+	}
+	switch {
+	case isHTTP: // 明文HTTP与普通代理请求一样总是解析
+		p.serveConn(ctx, newIdleTimeoutConn(client, p.clientIdleTimeout), "http")
+	case isTLS && p.shouldDecrypt(ctx):
+		p.interceptConn(ctx, client)
+	default:
+		if !isTLS {
+			// 无法识别的协议不能按域名连接
+			ctx.Req.URL.Host = dst
+		}
+		targetConn, err := p.dialTunnel(ctx)
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - 透明代理连接目标服务器失败: %s", ctx.Req.URL.Host, err))
+			return
+		}
+		defer targetConn.Close()
+		p.relayTunnel(ctx, client, targetConn)
+	}
+}
+
+var errServerNamePeeked = errors.New("server name peeked")
+
+// 读取TLS ClientHello中的SNI, 同时返回已读取的数据
+func peekServerName(r io.Reader) (serverName string, consumed []byte) {
+	var buf bytes.Buffer
+	tls.Server(&readOnlyConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errServerNamePeeked
+		},
+	}).Handshake()
+
+	return serverName, buf.Bytes()
+}
+
+// 查看明文HTTP请求头中的Host, 不影响后续读取, 不是HTTP请求返回空
+func peekHTTPHost(r *bufio.Reader) string {
+	for {
+		n := r.Buffered()
+		b, err := r.Peek(n)
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b[:i+4])))
+			if err != nil {
+				return ""
+			}
+			return req.Host
+		}
+		if err != nil || n >= r.Size() {
+			return ""
+		}
+		// 请求头未读完, 等待更多数据
+		if _, err = r.Peek(n + 1); err != nil {
+			return ""
+		}
+	}
+}
+
+// readOnlyConn 只用于读取ClientHello, 不会发送任何数据
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
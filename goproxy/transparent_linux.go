@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package goproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// netfilter获取原始目标地址的socket选项, SO_ORIGINAL_DST与IP6T_SO_ORIGINAL_DST值相同
+const soOriginalDst = 80
+
+// RedirectOriginalDst 获取iptables REDIRECT前的原始目标地址
+func RedirectOriginalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("不是TCP连接: %T", conn)
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	level := syscall.SOL_IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level = syscall.SOL_IPV6
+	}
+	var sa syscall.RawSockaddrInet6
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(sa))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("获取原始目标地址失败: %s", sockErr)
+	}
+	// sockaddr中端口为网络字节序
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+	var ip net.IP
+	if sa.Family == syscall.AF_INET6 {
+		ip = net.IP(sa.Addr[:])
+	} else {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&sa))
+		ip = net.IP(sa4.Addr[:])
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// ListenTPROXY 监听iptables TPROXY转发的连接, 需要CAP_NET_ADMIN权限
+func ListenTPROXY(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+
+			return sockErr
+		},
+	}
+
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("透明代理只支持Linux")
+
+// RedirectOriginalDst 获取iptables REDIRECT前的原始目标地址
+func RedirectOriginalDst(conn net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
+
+// ListenTPROXY 监听iptables TPROXY转发的连接, 需要CAP_NET_ADMIN权限
+func ListenTPROXY(addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
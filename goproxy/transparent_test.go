@@ -0,0 +1,93 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 不可达的原始目标地址(TEST-NET-1), 只有按SNI或Host连接才能访问上游
+const unreachableDstHost = "192.0.2.1"
+
+// 通过net.Pipe连接透明代理, 返回客户端一侧的连接
+func dialTransparent(t *testing.T, p *Proxy, dst string) net.Conn {
+	client, conn := net.Pipe()
+	go p.ServeTransparentConn(conn, dst)
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+
+	return client
+}
+
+func TestTransparent(t *testing.T) {
+	loadTestCA(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	})
+	tlsUpstream := httptest.NewTLSServer(handler)
+	defer tlsUpstream.Close()
+	plainUpstream := httptest.NewServer(handler)
+	defer plainUpstream.Close()
+	_, tlsPort, _ := net.SplitHostPort(tlsUpstream.Listener.Addr().String())
+	_, plainPort, _ := net.SplitHostPort(plainUpstream.Listener.Addr().String())
+
+	get := func(conn net.Conn, url string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	for _, decrypt := range []bool{false, true} {
+		opts := []Option{WithTransport(insecureTransport())}
+		if decrypt {
+			opts = append(opts, WithDecryptHTTPS(&memCache{}))
+		}
+		p := New(opts...)
+
+		// TLS按ClientHello中的SNI确定目标域名, 端口取自原始目标地址
+		conn := dialTransparent(t, p, net.JoinHostPort(unreachableDstHost, tlsPort))
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		require.Equal(t, "localhost:"+tlsPort+" /sni", get(tlsConn, "https://localhost:"+tlsPort+"/sni"), "decrypt: %v", decrypt)
+		if decrypt {
+			// 解密时客户端收到代理签发的证书
+			require.Equal(t, "localhost", tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		}
+		tlsConn.Close()
+
+		// 明文HTTP按请求头中的Host确定目标域名
+		conn = dialTransparent(t, p, net.JoinHostPort(unreachableDstHost, plainPort))
+		require.Equal(t, "localhost:"+plainPort+" /host", get(conn, "http://localhost:"+plainPort+"/host"), "decrypt: %v", decrypt)
+		conn.Close()
+	}
+}
+
+func TestTransparentSelfDst(t *testing.T) {
+	p := New()
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.ServeTransparentConn(conn, conn.LocalAddr().String())
+		close(done)
+	}()
+	// 原始目标地址是代理自身时直接关闭连接, 避免转发回自身
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("原始目标地址是代理自身时未关闭连接")
+	}
+	_, err := client.Read(make([]byte, 1))
+	require.Error(t, err)
+}
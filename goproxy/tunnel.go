@@ -0,0 +1,250 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 隧道关闭原因
+const (
+	// TunnelCloseClient 客户端先关闭
+	TunnelCloseClient = "client_closed"
+	// TunnelCloseServer 服务端先关闭
+	TunnelCloseServer = "server_closed"
+	// TunnelCloseIdle 空闲超时
+	TunnelCloseIdle = "idle_timeout"
+	// TunnelCloseError 读写出错
+	TunnelCloseError = "error"
+	// TunnelCloseDialFailed 连接目标失败
+	TunnelCloseDialFailed = "dial_failed"
+)
+
+// TLS ClientHello所在记录的最大长度
+const maxClientHelloSize = 5 + 16384
+
+// TunnelStats 隧道信息与流量统计, 流量在转发过程中实时更新, 其余字段在转发结束后才完整
+type TunnelStats struct {
+	// ServerName 客户端TLS ClientHello中的SNI, 非TLS流量为空
+	ServerName string
+	// ServerAddr 实际连接的地址, 经过上级代理时为上级代理地址
+	ServerAddr string
+	// StartTime 开始连接目标的时间
+	StartTime time.Time
+	// EndTime 隧道关闭时间
+	EndTime time.Time
+	// CloseReason 关闭原因, TunnelClose*
+	CloseReason string
+	// Err CloseReason为TunnelCloseError、TunnelCloseDialFailed时的错误信息
+	Err string
+
+	sent     int64
+	received int64
+}
+
+// Sent 客户端发往目标的字节数
+func (s *TunnelStats) Sent() int64 {
+	return atomic.LoadInt64(&s.sent)
+}
+
+// Received 目标发往客户端的字节数
+func (s *TunnelStats) Received() int64 {
+	return atomic.LoadInt64(&s.received)
+}
+
+// 连接隧道目标并记录到ctx.Tunnel, 失败时记录关闭原因
+func (p *Proxy) dialTunnel(ctx *Context) (net.Conn, error) {
+	ctx.Tunnel = &TunnelStats{StartTime: time.Now()}
+	conn, err := p.dialTunnelTarget(ctx)
+	if err != nil {
+		ctx.Tunnel.EndTime = time.Now()
+		ctx.Tunnel.CloseReason = TunnelCloseDialFailed
+		ctx.Tunnel.Err = err.Error()
+		return nil, err
+	}
+	ctx.Tunnel.ServerAddr = conn.RemoteAddr().String()
+
+	return conn, nil
+}
+
+// 隧道双向转发, 双向都空闲超过tunnelIdleTimeout时断开
+func (p *Proxy) relayTunnel(ctx *Context, clientConn, targetConn net.Conn) {
+	if ctx.Tunnel == nil {
+		ctx.Tunnel = &TunnelStats{StartTime: time.Now()}
+	}
+	// 清除握手阶段设置的期限, 由空闲超时控制连接
+	clientConn.SetDeadline(time.Time{})
+	targetConn.SetDeadline(time.Time{})
+	client := &clientHelloRecorder{Conn: clientConn}
+	p.transfer(client, targetConn, ctx.Tunnel)
+	ctx.Tunnel.EndTime = time.Now()
+	if len(client.head) > 0 && client.head[0] == tlsRecordTypeHandshake {
+		ctx.Tunnel.ServerName, _ = peekServerName(bytes.NewReader(client.head))
+	}
+}
+
+// 双向转发, 一个方向读完后半关闭另一端的写, 出错或空闲超时时关闭全部连接, 最先发生的事件作为关闭原因
+func (p *Proxy) transfer(clientConn, targetConn net.Conn, stats *TunnelStats) {
+	var reasonOnce sync.Once
+	setReason := func(reason string, err error) {
+		reasonOnce.Do(func() {
+			stats.CloseReason = reason
+			if err != nil {
+				stats.Err = err.Error()
+			}
+		})
+	}
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			clientConn.Close()
+			targetConn.Close()
+		})
+	}
+	idle := newIdleWatcher(p.tunnelIdleTimeout, func() {
+		setReason(TunnelCloseIdle, nil)
+		closeAll()
+	})
+	defer idle.stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn, n *int64, eofReason string) {
+		defer wg.Done()
+		_, err := io.Copy(dst, &tunnelReader{r: src, n: n, idle: idle})
+		if err != nil {
+			setReason(TunnelCloseError, err)
+			closeAll()
+			return
+		}
+		setReason(eofReason, nil)
+		if err = closeWrite(dst); err != nil {
+			closeAll()
+		}
+	}
+	go pipe(targetConn, clientConn, &stats.sent, TunnelCloseClient)
+	go pipe(clientConn, targetConn, &stats.received, TunnelCloseServer)
+	wg.Wait()
+	closeAll()
+}
+
+// clientHelloRecorder 记录客户端最先发送的数据, 转发结束后从中解析SNI, 不影响转发
+type clientHelloRecorder struct {
+	net.Conn
+	head []byte
+	done bool
+}
+
+func (c *clientHelloRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.done {
+		remain := maxClientHelloSize - len(c.head)
+		if remain > n {
+			remain = n
+		}
+		c.head = append(c.head, b[:remain]...)
+		// 不是TLS握手时无需继续记录
+		c.done = len(c.head) >= maxClientHelloSize || c.head[0] != tlsRecordTypeHandshake
+	}
+
+	return n, err
+}
+
+func (c *clientHelloRecorder) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// 关闭连接的写方向, 对端会读到EOF
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("连接不支持半关闭")
+}
+
+// tunnelReader 统计读取的字节数并记录活动时间,
+// 连接自身的读超时在隧道未空闲时忽略, 避免单向传输时另一方向超时断开
+type tunnelReader struct {
+	r    io.Reader
+	n    *int64
+	idle *idleWatcher
+}
+
+func (t *tunnelReader) Read(b []byte) (int, error) {
+	for {
+		n, err := t.r.Read(b)
+		if n > 0 {
+			atomic.AddInt64(t.n, int64(n))
+			t.idle.touch()
+		}
+		if n == 0 && err != nil && isTimeoutError(err) && !t.idle.expired() {
+			continue
+		}
+
+		return n, err
+	}
+}
+
+// idleWatcher 记录最近活动时间, 超过timeout没有活动时执行onIdle, timeout为0不限制
+type idleWatcher struct {
+	timeout time.Duration
+	last    int64
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newIdleWatcher(timeout time.Duration, onIdle func()) *idleWatcher {
+	w := &idleWatcher{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+		done:    make(chan struct{}),
+	}
+	if timeout > 0 {
+		go w.run(onIdle)
+	}
+
+	return w
+}
+
+func (w *idleWatcher) run(onIdle func()) {
+	interval := w.timeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if w.expired() {
+				onIdle()
+				return
+			}
+		}
+	}
+}
+
+func (w *idleWatcher) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+func (w *idleWatcher) expired() bool {
+	if w.timeout <= 0 {
+		return false
+	}
+
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.last))) > w.timeout
+}
+
+func (w *idleWatcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
@@ -0,0 +1,125 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 目标服务: 收到"stream"后连续发送tick, 读到EOF后回复bye
+func startTunnelTarget(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				line, _ := r.ReadString('\n')
+				if line == "stream\n" {
+					for i := 0; i < 5; i++ {
+						conn.Write([]byte("tick\n"))
+						time.Sleep(100 * time.Millisecond)
+					}
+				}
+				ioutil.ReadAll(r)
+				conn.Write([]byte("bye\n"))
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func TestTunnel(t *testing.T) {
+	target := startTunnelTarget(t)
+	defer target.Close()
+	d := newFinishRecorder()
+	// 空闲超时短于tick总时长, 单向持续传输时不应断开
+	p := New(WithDelegate(d), WithTunnelIdleTimeout(300*time.Millisecond))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	proxyAddr := ps.Listener.Addr().String()
+
+	t.Run("half close", func(t *testing.T) {
+		conn, br := connectProxy(t, proxyAddr, target.Addr().String())
+		defer conn.Close()
+		_, err := conn.Write([]byte("stream\n"))
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			require.Equal(t, "tick\n", line)
+		}
+		// 客户端半关闭后目标读到EOF, 仍能收到目标的回复
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		rest, err := ioutil.ReadAll(br)
+		require.NoError(t, err)
+		require.Equal(t, "bye\n", string(rest))
+
+		s := (<-d.done).Tunnel
+		require.Equal(t, TunnelCloseClient, s.CloseReason)
+		require.Equal(t, target.Addr().String(), s.ServerAddr)
+		require.Equal(t, int64(len("stream\n")), s.Sent())
+		require.Equal(t, int64(5*len("tick\n")+len("bye\n")), s.Received())
+		require.Empty(t, s.ServerName)
+		require.False(t, s.EndTime.Before(s.StartTime))
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn, br := connectProxy(t, proxyAddr, target.Addr().String())
+		defer conn.Close()
+		start := time.Now()
+		_, err := br.ReadString('\n')
+		require.Error(t, err)
+		require.True(t, time.Since(start) >= 300*time.Millisecond)
+
+		s := (<-d.done).Tunnel
+		require.Equal(t, TunnelCloseIdle, s.CloseReason)
+		require.Zero(t, s.Sent())
+		require.Zero(t, s.Received())
+	})
+
+	t.Run("server name", func(t *testing.T) {
+		conn, _ := connectProxy(t, proxyAddr, target.Addr().String())
+		tc := tls.Client(conn, &tls.Config{ServerName: "sni.example.com", InsecureSkipVerify: true})
+		tc.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		require.Error(t, tc.Handshake())
+		conn.Close()
+
+		s := (<-d.done).Tunnel
+		require.Equal(t, "sni.example.com", s.ServerName)
+		require.True(t, s.Sent() > 0)
+	})
+
+	t.Run("dial failed", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+		s := (<-d.done).Tunnel
+		require.Equal(t, TunnelCloseDialFailed, s.CloseReason)
+		require.NotEmpty(t, s.Err)
+	})
+}
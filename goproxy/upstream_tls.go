@@ -0,0 +1,52 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/gogf/gf/text/gregex"
+)
+
+// UpstreamTLS 按Host设置连接上游服务器的TLS参数
+type UpstreamTLS struct {
+	// Host 匹配请求Host(host:port)的正则表达式
+	Host string
+	// Config TLS参数, 如客户端证书、额外信任的CA、最低版本、跳过证书校验
+	Config *tls.Config
+}
+
+// 使用独立TLS参数的transport
+type upstreamTransport struct {
+	host      string
+	transport *http.Transport
+}
+
+// WithUpstreamTLS 按Host设置连接上游服务器的TLS参数, 按顺序匹配第一条, 未匹配使用默认参数
+func WithUpstreamTLS(rules []UpstreamTLS) Option {
+	return func(opt *options) {
+		opt.upstreamTLS = rules
+	}
+}
+
+// 为每条规则复制默认transport, 连接池互不影响
+func (p *Proxy) initUpstreamTransports(rules []UpstreamTLS) {
+	for _, rule := range rules {
+		t := p.transport.Clone()
+		t.TLSClientConfig = rule.Config.Clone()
+		p.upstreamTransports = append(p.upstreamTransports, upstreamTransport{
+			host:      rule.Host,
+			transport: t,
+		})
+	}
+}
+
+// 按请求Host选择transport
+func (p *Proxy) transportFor(req *http.Request) *http.Transport {
+	for _, ut := range p.upstreamTransports {
+		if gregex.IsMatchString(ut.host, req.URL.Host) {
+			return ut.transport
+		}
+	}
+
+	return p.transport
+}
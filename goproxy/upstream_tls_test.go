@@ -0,0 +1,111 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) == 0 {
+			rw.Write([]byte("anonymous"))
+			return
+		}
+		rw.Write([]byte("client " + req.TLS.PeerCertificates[0].Subject.Organization[0]))
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+	// httptest的服务端证书同时作为客户端证书
+	clientCert := upstream.TLS.Certificates[0]
+
+	tests := []struct {
+		name string
+		// rules nil时使用默认参数校验上游证书
+		rules []UpstreamTLS
+		body  string
+	}{
+		{
+			name: "default verify",
+		},
+		{
+			name: "no match",
+			rules: []UpstreamTLS{
+				{Host: `^example\.com`, Config: &tls.Config{InsecureSkipVerify: true}},
+			},
+		},
+		{
+			name: "skip verify",
+			rules: []UpstreamTLS{
+				{Host: `^127\.0\.0\.1:`, Config: &tls.Config{InsecureSkipVerify: true}},
+			},
+			body: "anonymous",
+		},
+		{
+			name: "extra root CA",
+			rules: []UpstreamTLS{
+				{Host: `^127\.0\.0\.1:`, Config: &tls.Config{RootCAs: pool}},
+			},
+			body: "anonymous",
+		},
+		{
+			// 按顺序匹配第一条
+			name: "first match with client certificate",
+			rules: []UpstreamTLS{
+				{Host: `^127\.0\.0\.1:`, Config: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}},
+				{Host: `127\.0\.0\.1`, Config: &tls.Config{InsecureSkipVerify: true}},
+			},
+			body: "client Acme Co",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(WithUpstreamTLS(tt.rules))
+			req, err := http.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+			require.NoError(t, err)
+			var body string
+			p.DoRequest(&Context{Req: req}, func(resp *http.Response, err error) {
+				if tt.body == "" {
+					require.Error(t, err)
+					require.Contains(t, err.Error(), "certificate signed by unknown authority")
+					return
+				}
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				data, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				body = string(data)
+			})
+			require.Equal(t, tt.body, body)
+		})
+	}
+}
+
+func TestUpstreamTransports(t *testing.T) {
+	p := New(WithDisableKeepAlive(true), WithUpstreamTLS([]UpstreamTLS{
+		{Host: `^a\.com:`, Config: &tls.Config{ServerName: "a"}},
+		{Host: `^b\.com:`, Config: &tls.Config{ServerName: "b"}},
+	}))
+	transport := func(host string) *http.Transport {
+		req, err := http.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		require.NoError(t, err)
+		return p.transportFor(req)
+	}
+	a, b := transport("a.com:443"), transport("b.com:443")
+	require.Equal(t, "a", a.TLSClientConfig.ServerName)
+	require.Equal(t, "b", b.TLSClientConfig.ServerName)
+	require.True(t, transport("c.com:443") == p.transport)
+	// 每条规则独立的连接池, 其余参数与默认transport相同
+	require.False(t, a == b || a == p.transport)
+	require.True(t, a.DisableKeepAlives)
+	require.NotNil(t, a.Proxy)
+}
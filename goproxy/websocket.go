@@ -0,0 +1,275 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket操作码
+const (
+	WebSocketOpContinuation = 0x0
+	WebSocketOpText         = 0x1
+	WebSocketOpBinary       = 0x2
+	WebSocketOpClose        = 0x8
+	WebSocketOpPing         = 0x9
+	WebSocketOpPong         = 0xa
+)
+
+// 单帧最大长度, 超过则断开连接
+const maxWebSocketFrameSize = 32 << 20
+
+// WebSocketFrame WebSocket帧
+type WebSocketFrame struct {
+	// FromClient 是否是客户端发往服务端
+	FromClient bool
+	// Fin 是否是消息的最后一帧
+	Fin bool
+	// Opcode 操作码
+	Opcode byte
+	// Payload 已去除掩码的数据, 修改后按新长度发送
+	Payload []byte
+	// Time 收到时间
+	Time    time.Time
+	rsv     byte
+	masked  bool
+	dropped bool
+}
+
+// Drop 丢弃该帧, 不再转发
+func (f *WebSocketFrame) Drop() {
+	f.dropped = true
+}
+
+// IsDropped 是否已丢弃
+func (f *WebSocketFrame) IsDropped() bool {
+	return f.dropped
+}
+
+// IsText 是否是文本帧
+func (f *WebSocketFrame) IsText() bool {
+	return f.Opcode == WebSocketOpText
+}
+
+// IsWebSocketRequest 是否是WebSocket握手请求
+func IsWebSocketRequest(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// header中是否包含指定token, 如 Connection: keep-alive, Upgrade
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// 写入101响应头
+func writeSwitchingProtocols(w io.Writer, resp *http.Response) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", "websocket")
+	resp.Header.Write(bw)
+	bw.WriteString("\r\n")
+
+	return bw.Flush()
+}
+
+// 读取一帧
+func readWebSocketFrame(r io.Reader) (*WebSocketFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &WebSocketFrame{
+		Fin:    head[0]&0x80 != 0,
+		rsv:    head[0] & 0x70,
+		Opcode: head[0] & 0x0f,
+		masked: head[1]&0x80 != 0,
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketFrameSize {
+		return nil, fmt.Errorf("WebSocket帧长度超过限制: %d", length)
+	}
+	var maskKey [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskBytes(maskKey, f.Payload)
+	}
+
+	return f, nil
+}
+
+// 写入一帧, 客户端发出的帧重新生成掩码
+func writeWebSocketFrame(w io.Writer, f *WebSocketFrame) error {
+	buf := make([]byte, 0, 14+len(f.Payload))
+	b0 := f.rsv | f.Opcode
+	if f.Fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+	var b1 byte
+	if f.masked {
+		b1 = 0x80
+	}
+	length := len(f.Payload)
+	switch {
+	case length < 126:
+		buf = append(buf, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(length))
+	default:
+		buf = append(buf, b1|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(length))
+	}
+	if !f.masked {
+		buf = append(buf, f.Payload...)
+		_, err := w.Write(buf)
+		return err
+	}
+	var maskKey [4]byte
+	if _, err := rand.Read(maskKey[:]); err != nil {
+		return err
+	}
+	buf = append(buf, maskKey[:]...)
+	start := len(buf)
+	buf = append(buf, f.Payload...)
+	maskBytes(maskKey, buf[start:])
+	_, err := w.Write(buf)
+
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// WebSocket双向转发, 每一帧经过Delegate处理后再发送, 双向都空闲超过tunnelIdleTimeout时断开
+func (p *Proxy) relayWebSocket(ctx *Context, client io.ReadWriteCloser, clientReader io.Reader, server io.ReadWriteCloser) {
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			client.Close()
+			server.Close()
+		})
+	}
+	idle := newIdleWatcher(p.tunnelIdleTimeout, closeAll)
+	defer idle.stop()
+	ctx.Tunnel = &TunnelStats{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.pipeWebSocket(ctx, &tunnelReader{r: server, n: &ctx.Tunnel.received, idle: idle}, client, false)
+		closeAll()
+	}()
+	p.pipeWebSocket(ctx, &tunnelReader{r: clientReader, n: &ctx.Tunnel.sent, idle: idle}, server, true)
+	closeAll()
+	wg.Wait()
+}
+
+// 单向转发WebSocket帧
+func (p *Proxy) pipeWebSocket(ctx *Context, src io.Reader, dst io.Writer, fromClient bool) {
+	for {
+		f, err := readWebSocketFrame(src)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) && !isClosedConnError(err) {
+				p.delegate.ErrorLog(fmt.Errorf("%s - WebSocket读取帧失败: %s", ctx.Req.URL, err))
+			}
+			return
+		}
+		f.FromClient = fromClient
+		f.Time = time.Now()
+		p.delegate.WebSocketFrame(ctx, f)
+		if f.dropped {
+			continue
+		}
+		err = writeWebSocketFrame(dst, f)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 连接是否已被关闭
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// 上游是否已切换到WebSocket协议, 成功时返回上游连接
+func switchedWebSocket(resp *http.Response) (io.ReadWriteCloser, bool) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, false
+	}
+	serverConn, ok := resp.Body.(io.ReadWriteCloser)
+
+	return serverConn, ok
+}
+
+// 普通HTTP代理的WebSocket转发
+func (p *Proxy) forwardWebSocket(ctx *Context, rw http.ResponseWriter, resp *http.Response, serverConn io.ReadWriteCloser) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		p.delegate.ErrorLog(fmt.Errorf("%s - WebSocket转发, web server不支持Hijacker", ctx.Req.URL))
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - WebSocket转发, hijacker错误: %s", ctx.Req.URL, err))
+		return
+	}
+	// 清除http server设置的读写期限, 由空闲超时控制连接
+	clientConn.SetDeadline(time.Time{})
+	err = writeSwitchingProtocols(clientConn, resp)
+	if err != nil {
+		clientConn.Close()
+		p.delegate.ErrorLog(fmt.Errorf("%s - WebSocket握手响应写入客户端失败, %s", ctx.Req.URL, err))
+		return
+	}
+	// hijack前已缓冲的数据需先读取
+	var clientReader io.Reader = clientConn
+	if n := clientBuf.Reader.Buffered(); n > 0 {
+		clientReader = io.MultiReader(io.LimitReader(clientBuf.Reader, int64(n)), clientConn)
+	}
+	p.relayWebSocket(ctx, clientConn, clientReader, serverConn)
+}
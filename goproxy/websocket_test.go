@@ -0,0 +1,167 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+)
+
+func TestWebSocketFrameCodec(t *testing.T) {
+	// RFC 6455 5.7 带掩码的"Hello"
+	f, err := readWebSocketFrame(bytes.NewReader([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}))
+	require.NoError(t, err)
+	require.True(t, f.Fin)
+	require.True(t, f.IsText())
+	require.Equal(t, "Hello", string(f.Payload))
+
+	// 覆盖7位、16位、64位长度
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte("m"), n)
+			var buf bytes.Buffer
+			err := writeWebSocketFrame(&buf, &WebSocketFrame{Fin: true, Opcode: WebSocketOpBinary, Payload: payload, rsv: 0x40, masked: masked})
+			require.NoError(t, err)
+			raw := buf.Bytes()
+			// 保留RSV位, 如permessage-deflate压缩标志
+			require.Equal(t, byte(0x80|0x40|WebSocketOpBinary), raw[0])
+			require.Equal(t, masked, raw[1]&0x80 != 0)
+			if masked && n > 0 {
+				require.False(t, bytes.Contains(raw, payload))
+			}
+			f, err := readWebSocketFrame(bytes.NewReader(raw))
+			require.NoError(t, err)
+			require.Equal(t, payload, f.Payload, "len: %d masked: %v", n, masked)
+		}
+	}
+
+	// 超过长度限制
+	_, err = readWebSocketFrame(bytes.NewReader([]byte{0x82, 127, 0, 0, 0, 0, 0x02, 0, 0, 1}))
+	require.Error(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "WebSocket")
+	require.True(t, IsWebSocketRequest(req))
+	req.Header.Set("Connection", "keep-alive")
+	require.False(t, IsWebSocketRequest(req))
+}
+
+// rulesAuthenticator 所有用户使用同一组专属规则
+type rulesAuthenticator struct {
+	rules *filterrules.Rules
+}
+
+func (a rulesAuthenticator) Authenticate(username, password string) (*User, bool) {
+	return &User{Name: username, Rules: a.rules}, true
+}
+
+// frameDelegate 记录数据帧
+type frameDelegate struct {
+	NopDelegate
+	mu     sync.Mutex
+	frames []string
+}
+
+func (d *frameDelegate) WebSocketFrame(ctx *Context, frame *WebSocketFrame) {
+	if frame.Opcode != WebSocketOpText {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	direction := "server:"
+	if frame.FromClient {
+		direction = "client:"
+	}
+	payload := string(frame.Payload)
+	if len(payload) > 10 {
+		payload = payload[:10]
+	}
+	if frame.IsDropped() {
+		payload += " dropped"
+	}
+	d.frames = append(d.frames, direction+payload)
+}
+
+func echoWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(messageType, append([]byte("echo:"), message...))
+	}
+}
+
+func TestWebSocketRelay(t *testing.T) {
+	loadTestCA(t)
+	plainUpstream := httptest.NewServer(http.HandlerFunc(echoWebSocket))
+	defer plainUpstream.Close()
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(echoWebSocket))
+	defer tlsUpstream.Close()
+
+	rules := &filterrules.Rules{
+		WsDrop: []map[string]string{{"url": `/ws`, "target": `drop`}},
+		WsRw:   []map[string]string{{"url": `/ws`, "target": `foo`, "result": "bar"}},
+	}
+	recorder := &frameDelegate{}
+	p := New(
+		WithDecryptHTTPS(&memCache{}),
+		WithTransport(insecureTransport()),
+		WithAuthenticator(rulesAuthenticator{rules: rules}, "mars"),
+		WithDelegates(&RulesDelegate{}, recorder),
+	)
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	proxyURL, err := url.Parse(ps.URL)
+	require.NoError(t, err)
+	proxyURL.User = url.UserPassword("mars", "secret")
+	dialer := websocket.Dialer{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	large := strings.Repeat("x", 70000)
+	for _, u := range []string{"ws" + strings.TrimPrefix(plainUpstream.URL, "http"), "wss" + strings.TrimPrefix(tlsUpstream.URL, "https")} {
+		recorder.mu.Lock()
+		recorder.frames = nil
+		recorder.mu.Unlock()
+		conn, _, err := dialer.Dial(u+"/ws", nil)
+		require.NoError(t, err, u)
+		for _, message := range []string{"hello", "drop me", large, "foo"} {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+			if message == "drop me" {
+				continue
+			}
+			_, reply, err := conn.ReadMessage()
+			require.NoError(t, err)
+			expected := "echo:" + message
+			if message == "foo" {
+				expected = "echo:bar"
+			}
+			require.Equal(t, expected, string(reply))
+		}
+		conn.Close()
+
+		recorder.mu.Lock()
+		require.Equal(t, []string{
+			"client:hello", "server:echo:hello",
+			"client:drop me dropped",
+			"client:xxxxxxxxxx", "server:echo:xxxxx",
+			"client:bar", "server:echo:bar",
+		}, recorder.frames)
+		recorder.mu.Unlock()
+	}
+}
@@ -9,14 +9,17 @@ import (
 )
 
 func init() {
-	//Handler = new(Example)
+	//Handler = &Example{}
 }
 
-type Example struct{}
+// Example 嵌入NopDelegate, 只实现需要的方法
+type Example struct {
+	goproxy.NopDelegate
+}
 
 // Connect 收到客户端连接, 自定义response返回
 // NOTICE: HTTPS只能访问 ctx.Req.URL.Host, 不能访问Header和Body, 不能使用rw
-func (Example) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
+func (*Example) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
 	if strings.Contains(ctx.Req.URL.Host, "crashlytics.com") {
 		rw.WriteHeader(http.StatusForbidden)
 		ctx.Abort()
@@ -26,13 +29,17 @@ func (Example) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
 	ctx.Abort()
 }
 
-// BeforeRequest 请求发送前, 修改request
-func (Example) BeforeRequest(ctx *goproxy.Context) {
+// BeforeRequest 请求发送前, 修改request, 或通过ctx.Respond直接返回响应, 不请求上游服务器
+func (*Example) BeforeRequest(ctx *goproxy.Context) {
+	if ctx.Req.URL.Path == "/mock" {
+		ctx.Respond(goproxy.NewResponse(ctx.Req, http.StatusOK, "application/json", `{"mock": true}`))
+		return
+	}
 	ctx.Req.Header.Set("Req-Id", "123")
 }
 
 // BeforeResponse 响应发送前, 修改response
-func (Example) BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error) {
+func (*Example) BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error) {
 	if err == nil {
 		resp.Header.Set("Resp-Id", "456")
 	}
@@ -1,7 +1,7 @@
 // Package interceptor 拦截器
 package interceptor
 
-import "mars/internal/common/recorder"
+import "mars/goproxy"
 
-// Handler 拦截器handler
-var Handler recorder.Interceptor
+// Handler 拦截器handler, 在过滤规则之后、记录流量之前执行
+var Handler goproxy.Delegate
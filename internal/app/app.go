@@ -2,32 +2,50 @@
 package app
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"mars/filterrules"
+	"mars/goproxy"
 	"mars/internal/app/inject"
 	"mars/internal/app/inspector"
 	"mars/shadowsocks"
 )
 
 const (
-	proxyServerReadTimeout  = 30 * time.Second
-	proxyServerWriteTimeout = 5 * time.Second
+	// 代理请求的响应可能是大文件下载或长连接, 只限制读取请求头的时间
+	proxyServerReadHeaderTimeout = 30 * time.Second
+	proxyServerIdleTimeout       = 2 * time.Minute
 
 	inspectorServerReadTimeout  = 30 * time.Second
 	inspectorServerWriteTimeout = 5 * time.Second
+
+	// 等待客户端连接结束的默认超时时间
+	defaultShutdownTimeout = 30 * time.Second
+	// 推送剩余流量、关闭WebSocket连接及数据库的超时时间
+	closeTimeout = 5 * time.Second
 )
 
 // App 应用
 type App struct {
 	container *inject.Container
 	// goproxy.New(goproxy.WithDelegate(&EventHandler{}))
+
+	mu sync.Mutex
+	// 代理、反向代理server
+	proxyServers        []*http.Server
+	inspectorServer     *http.Server
+	shadowsocksListener net.Listener
+	closing             int32
 }
 
 // New 创建应用
@@ -45,24 +63,142 @@ func (app *App) Run() {
 	filterrules.LoadFilterRules()
 	go app.startProxyServer()
 	go app.startInspectorServer()
-	go shadowsocks.ShadowsocksMain()
-	<-app.waitSignal()
+	if app.container.Conf.SOCKS5.Enabled {
+		go app.startSOCKS5Server()
+	}
+	if app.container.Conf.Transparent.Enabled {
+		go app.startTransparentServer()
+	}
+	if app.container.Conf.ReverseProxy.Enabled {
+		go app.startReverseProxyServer()
+	}
+	go app.startShadowsocksServer()
+	sig := <-app.waitSignal()
+	log.Infof("收到信号%s, 开始关闭", sig)
+	app.shutdown()
+}
+
+// 停止接收新连接, 等待处理中的请求结束, 推送剩余流量后关闭WebSocket连接及数据库
+func (app *App) shutdown() {
+	atomic.StoreInt32(&app.closing, 1)
+	timeout := app.container.Conf.App.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	app.mu.Lock()
+	proxyServers := app.proxyServers
+	inspectorServer := app.inspectorServer
+	shadowsocksListener := app.shadowsocksListener
+	app.mu.Unlock()
+
+	if shadowsocksListener != nil {
+		shadowsocksListener.Close()
+	}
+	var wg sync.WaitGroup
+	for _, server := range proxyServers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			server.Shutdown(ctx)
+		}(server)
+	}
+	// 包括SOCKS5、透明代理及已劫持的CONNECT连接
+	err := app.container.Proxy.Shutdown(ctx)
+	wg.Wait()
+	if err != nil {
+		log.Warnf("等待客户端连接结束超时, 剩余连接数: %d", app.container.Proxy.ClientConnNum())
+	}
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer closeCancel()
+	app.container.Close(closeCtx)
+	if inspectorServer != nil {
+		inspectorServer.Shutdown(closeCtx)
+	}
+	log.Info("已关闭")
+}
+
+// 记录代理server, 关闭时等待请求处理结束
+func (app *App) addProxyServer(server *http.Server) {
+	app.mu.Lock()
+	app.proxyServers = append(app.proxyServers, server)
+	app.mu.Unlock()
+}
+
+// 服务退出, 关闭过程中退出不是错误
+func (app *App) serveExit(err error) {
+	if err == nil || err == http.ErrServerClosed || err == goproxy.ErrProxyClosed ||
+		atomic.LoadInt32(&app.closing) == 1 {
+		return
+	}
+	log.Fatal(err)
 }
 
 // 启动代理server
 func (app *App) startProxyServer() {
 	addr := app.container.Conf.App.ProxyAddr()
 	server := &http.Server{
-		Addr:         addr,
-		Handler:      app.container.Proxy,
-		ReadTimeout:  proxyServerReadTimeout,
-		WriteTimeout: proxyServerWriteTimeout,
+		Addr:              addr,
+		Handler:           app.container.Proxy,
+		ReadHeaderTimeout: proxyServerReadHeaderTimeout,
+		IdleTimeout:       proxyServerIdleTimeout,
 	}
+	app.addProxyServer(server)
 	log.Infof("Proxy server listen on %s", addr)
-	err := server.ListenAndServe()
+	app.serveExit(server.ListenAndServe())
+}
+
+// 启动SOCKS5代理server
+func (app *App) startSOCKS5Server() {
+	addr := app.container.Conf.SOCKS5Addr()
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Infof("SOCKS5 server listen on %s", addr)
+	app.serveExit(app.container.Proxy.ServeSOCKS5(listener))
+}
+
+// 启动透明代理server
+func (app *App) startTransparentServer() {
+	addr := app.container.Conf.TransparentAddr()
+	var (
+		listener    net.Listener
+		originalDst goproxy.OriginalDstFunc
+		err         error
+	)
+	switch app.container.Conf.Transparent.Mode {
+	case "", "redirect":
+		listener, err = net.Listen("tcp", addr)
+		originalDst = goproxy.RedirectOriginalDst
+	case "tproxy":
+		listener, err = goproxy.ListenTPROXY(addr)
+		originalDst = goproxy.TPROXYOriginalDst
+	default:
+		log.Fatalf("不支持的透明代理模式: %s", app.container.Conf.Transparent.Mode)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Transparent proxy server listen on %s", addr)
+	app.serveExit(app.container.Proxy.ServeTransparent(listener, originalDst))
+}
+
+// 启动反向代理server
+func (app *App) startReverseProxyServer() {
+	addr := app.container.Conf.ReverseProxyAddr()
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           app.container.ReverseProxy,
+		ReadHeaderTimeout: proxyServerReadHeaderTimeout,
+		IdleTimeout:       proxyServerIdleTimeout,
+	}
+	app.addProxyServer(server)
+	log.Infof("Reverse proxy server listen on %s", addr)
+	app.serveExit(server.ListenAndServe())
 }
 
 // 启动流量审查server
@@ -74,15 +210,31 @@ func (app *App) startInspectorServer() {
 		ReadTimeout:  inspectorServerReadTimeout,
 		WriteTimeout: inspectorServerWriteTimeout,
 	}
+	app.mu.Lock()
+	app.inspectorServer = server
+	app.mu.Unlock()
 	log.Infof("Inspector server listen on %s", addr)
-	err := server.ListenAndServe()
+	app.serveExit(server.ListenAndServe())
+}
+
+// 启动shadowsocks server, 监听失败不影响其他服务
+func (app *App) startShadowsocksServer() {
+	listener, err := net.Listen("tcp", shadowsocks.Addr)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("shadowsocks监听错误: %s", err)
+		return
+	}
+	app.mu.Lock()
+	app.shadowsocksListener = listener
+	app.mu.Unlock()
+	err = shadowsocks.ShadowsocksMain(listener)
+	if err != nil && atomic.LoadInt32(&app.closing) == 0 {
+		log.Errorf("shadowsocks server错误: %s", err)
 	}
 }
 
 func (app *App) waitSignal() <-chan os.Signal {
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
 
 	return ch
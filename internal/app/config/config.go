@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"strconv"
+	"time"
 
 	"mars/goutil"
 
@@ -54,6 +55,20 @@ type Config struct {
 	Certificate CertificateConfig `mapstructure:"Certificate"`
 	//  过滤规则
 	Filterrules FilterrulesConfig `mapstructure:"filterrules"`
+	// ProxyAuth 代理身份认证
+	ProxyAuth ProxyAuthConfig `mapstructure:"proxyAuth"`
+	// SOCKS5 SOCKS5代理
+	SOCKS5 SOCKS5Config `mapstructure:"socks5"`
+	// Transparent 透明代理
+	Transparent TransparentConfig `mapstructure:"transparent"`
+	// ReverseProxy 反向代理
+	ReverseProxy ReverseProxyConfig `mapstructure:"reverseProxy"`
+	// UpstreamTLS 按Host设置连接上游服务器的TLS参数
+	UpstreamTLS []UpstreamTLSConfig `mapstructure:"upstreamTLS"`
+	// PAC 代理自动配置文件
+	PAC PACConfig `mapstructure:"pac"`
+	// Protobuf 解码gRPC、protobuf消息的描述文件
+	Protobuf ProtobufConfig `mapstructure:"protobuf"`
 }
 
 type appConfig struct {
@@ -61,12 +76,40 @@ type appConfig struct {
 	Host          string `mapstructure:"host"`
 	ProxyPort     int    `mapstructure:"proxyPort"`
 	InspectorPort int    `mapstructure:"inspectorPort"`
+	// ShutdownTimeout 关闭时等待客户端连接结束的超时时间
+	ShutdownTimeout time.Duration `mapstructure:"shutdownTimeout"`
+	// AllowClients 允许使用代理的客户端IP或CIDR, 为空允许所有
+	AllowClients []string `mapstructure:"allowClients"`
+	// DenyClients 禁止使用代理的客户端IP或CIDR, 优先于AllowClients
+	DenyClients []string `mapstructure:"denyClients"`
+	// DecryptAllowClients 允许解密HTTPS的客户端IP或CIDR, 为空允许所有
+	DecryptAllowClients []string `mapstructure:"decryptAllowClients"`
+	// DecryptDenyClients 禁止解密HTTPS的客户端IP或CIDR
+	DecryptDenyClients []string `mapstructure:"decryptDenyClients"`
+	// RecordDenied 记录被拒绝的请求到流量列表
+	RecordDenied bool `mapstructure:"recordDenied"`
 }
 
 type mitmProxyConfig struct {
-	Enabled          bool   `mapstructure:"enabled"`
-	DecryptHTTPS     bool   `mapstructure:"decryptHTTPS"`
-	CertCacheSize    int    `mapstructure:"certCacheSize"`
+	Enabled      bool   `mapstructure:"enabled"`
+	DecryptHTTPS bool   `mapstructure:"decryptHTTPS"`
+	DisableHTTP2 bool   `mapstructure:"disableHTTP2"`
+	ParentProxy  string `mapstructure:"parentProxy"`
+	// ClientIdleTimeout 客户端连接空闲超时时间
+	ClientIdleTimeout time.Duration `mapstructure:"clientIdleTimeout"`
+	// TunnelIdleTimeout 隧道双向空闲超时时间
+	TunnelIdleTimeout time.Duration `mapstructure:"tunnelIdleTimeout"`
+	// DisableKeepAlive 不重用与上游服务器的连接
+	DisableKeepAlive bool `mapstructure:"disableKeepAlive"`
+	// MaxIdleConnsPerHost 每个上游Host最多保持的空闲连接数
+	MaxIdleConnsPerHost int `mapstructure:"maxIdleConnsPerHost"`
+	// MaxConnsPerHost 每个上游Host最多连接数, 0不限制
+	MaxConnsPerHost int `mapstructure:"maxConnsPerHost"`
+	// UpstreamIdleTimeout 与上游服务器的空闲连接超时时间
+	UpstreamIdleTimeout time.Duration `mapstructure:"upstreamIdleTimeout"`
+	CertCacheSize       int           `mapstructure:"certCacheSize"`
+	// CertCacheDir 证书持久化目录, 为空则只缓存在内存中
+	CertCacheDir     string `mapstructure:"certCacheDir"`
 	LeveldbDir       string `mapstructure:"leveldbDir"`
 	LeveldbCacheSize int    `mapstructure:"leveldbCacheSize"`
 }
@@ -76,6 +119,10 @@ type CertificateConfig struct {
 	BasePrivate     string `mapstructure:"basePrivate"`
 	CaPrivate       string `mapstructure:"caPrivate"`
 	UserCertificate string `mapstructure:"userCertificate"`
+	// KeyType 解密HTTPS时生成证书的私钥类型, rsa、ecdsa
+	KeyType string `mapstructure:"keyType"`
+	// MirrorUpstream 生成证书时复制上游证书的SAN
+	MirrorUpstream bool `mapstructure:"mirrorUpstream"`
 }
 
 // FilterrulesConfig 过滤规则
@@ -84,6 +131,89 @@ type FilterrulesConfig struct {
 	Filepath string `mapstructure:"Filepath"`
 }
 
+// ProxyAuthConfig 代理身份认证
+type ProxyAuthConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Realm    string `mapstructure:"realm"`
+	UserFile string `mapstructure:"userFile"`
+	// Profiles 账号专属上级代理和规则
+	Profiles []ProxyAuthProfile `mapstructure:"profiles"`
+}
+
+// ProxyAuthProfile 账号专属配置
+type ProxyAuthProfile struct {
+	User        string `mapstructure:"user"`
+	ParentProxy string `mapstructure:"parentProxy"`
+	Rules       string `mapstructure:"rules"`
+}
+
+// SOCKS5Config SOCKS5代理, 用户名为空时使用代理认证的账号, 未开启代理认证则不认证
+type SOCKS5Config struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// TransparentConfig 透明代理, 只支持Linux
+type TransparentConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Port    int  `mapstructure:"port"`
+	// Mode 转发方式 redirect: iptables REDIRECT, tproxy: iptables TPROXY
+	Mode string `mapstructure:"mode"`
+}
+
+// ReverseProxyConfig 反向代理
+type ReverseProxyConfig struct {
+	Enabled bool                `mapstructure:"enabled"`
+	Port    int                 `mapstructure:"port"`
+	Routes  []ReverseProxyRoute `mapstructure:"routes"`
+}
+
+// ReverseProxyRoute 反向代理路由, 按Host和路径前缀匹配
+type ReverseProxyRoute struct {
+	Host         string `mapstructure:"host"`
+	Path         string `mapstructure:"path"`
+	Upstream     string `mapstructure:"upstream"`
+	PreserveHost bool   `mapstructure:"preserveHost"`
+}
+
+// UpstreamTLSConfig 连接上游服务器的TLS参数, Host为正则表达式, 匹配host:port
+type UpstreamTLSConfig struct {
+	Host string `mapstructure:"host"`
+	// CertFile、KeyFile 客户端证书
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	// CAFile 额外信任的CA证书(PEM), 与系统CA一起使用
+	CAFile string `mapstructure:"caFile"`
+	// MinVersion 最低TLS版本, 1.0、1.1、1.2、1.3
+	MinVersion         string `mapstructure:"minVersion"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+// PACConfig 代理自动配置文件, 由流量审查server提供
+type PACConfig struct {
+	// Mode 白名单及没有规则的Host的代理方式 proxy: 经过代理, direct: 直连
+	Mode string `mapstructure:"mode"`
+}
+
+// ProtobufConfig protobuf描述文件, 用于解码gRPC、protobuf消息
+type ProtobufConfig struct {
+	// DescriptorSets protoc --include_imports --descriptor_set_out 生成的FileDescriptorSet文件
+	DescriptorSets []string `mapstructure:"descriptorSets"`
+	// ProtoDir .proto文件目录, 启动时调用protoc编译
+	ProtoDir string `mapstructure:"protoDir"`
+	// Mappings URL对应的protobuf消息类型
+	Mappings []ProtobufMapping `mapstructure:"mappings"`
+}
+
+// ProtobufMapping URL对应的protobuf消息类型, URL为正则表达式, 匹配host+path
+type ProtobufMapping struct {
+	URL      string `mapstructure:"url"`
+	Request  string `mapstructure:"request"`
+	Response string `mapstructure:"response"`
+}
+
 // ProxyAddr 代理监听地址
 func (ac appConfig) ProxyAddr() string {
 	return net.JoinHostPort(ac.Host, strconv.Itoa(ac.ProxyPort))
@@ -94,6 +224,21 @@ func (ac appConfig) InspectorAddr() string {
 	return net.JoinHostPort(ac.Host, strconv.Itoa(ac.InspectorPort))
 }
 
+// SOCKS5Addr SOCKS5代理监听地址
+func (c *Config) SOCKS5Addr() string {
+	return net.JoinHostPort(c.App.Host, strconv.Itoa(c.SOCKS5.Port))
+}
+
+// TransparentAddr 透明代理监听地址
+func (c *Config) TransparentAddr() string {
+	return net.JoinHostPort(c.App.Host, strconv.Itoa(c.Transparent.Port))
+}
+
+// ReverseProxyAddr 反向代理监听地址
+func (c *Config) ReverseProxyAddr() string {
+	return net.JoinHostPort(c.App.Host, strconv.Itoa(c.ReverseProxy.Port))
+}
+
 // Conf  创建Conf变量来存放配置文件
 var Conf *Config
 
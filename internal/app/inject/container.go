@@ -2,18 +2,30 @@
 package inject
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 
+	"mars/filterrules"
 	"mars/interceptor"
 	"mars/internal/app/config"
 	"mars/internal/common"
+	"mars/internal/common/account"
+	"mars/internal/common/metrics"
+	"mars/internal/common/protobuf"
 	"mars/internal/common/recorder"
 	"mars/internal/common/recorder/output"
 	"mars/internal/common/recorder/storage"
 	"mars/internal/common/socket"
 
 	"mars/goproxy"
+	"mars/goproxy/cert"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -23,12 +35,12 @@ import (
 type Container struct {
 	Conf                 *config.Config
 	Proxy                *goproxy.Proxy
+	ReverseProxy         http.Handler
 	WebSocketSessionOpts []socket.SessionOption
 	WebSocketOutput      *output.WebSocket
 	txStorage            recorder.Storage
 	txRecorder           *recorder.Recorder
 	txOutput             recorder.Output
-	txInterceptor        recorder.Interceptor
 }
 
 // NewContainer 创建容器
@@ -44,35 +56,209 @@ func NewContainer(conf *config.Config) *Container {
 	c.createSessionOption()
 
 	c.createProxy() //创建中间人代理proxy
+	c.createReverseProxy()
 	c.createRecorderStorage()
 	c.createRecorderOutput()
-	c.createRecorderInterceptor()
+	c.registerMetrics()
 
 	c.txRecorder.SetProxy(c.Proxy)
 	c.txRecorder.SetStorage(c.txStorage)
 	c.txRecorder.SetOutput(c.txOutput)
-	c.txRecorder.SetInterceptor(c.txInterceptor)
+	c.txRecorder.SetProtobufRegistry(c.createProtobufRegistry())
 
 	return c
 }
 
+// Close 推送完待输出的流量, 关闭WebSocket连接及数据库, 代理停止处理请求后调用
+func (c *Container) Close(ctx context.Context) {
+	c.WebSocketOutput.Shutdown(ctx)
+	if closer, ok := c.txStorage.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			log.Warnf("关闭leveldb数据库错误: %s", err)
+		}
+	}
+}
+
 func (c *Container) createProxy() {
 	opts := make([]goproxy.Option, 0, 3)
-	opts = append(opts, goproxy.WithDisableKeepAlive(true))
+	mitm := c.Conf.MITMProxy
+	opts = append(opts, goproxy.WithDisableKeepAlive(mitm.DisableKeepAlive))
+	opts = append(opts, goproxy.WithMaxIdleConnsPerHost(mitm.MaxIdleConnsPerHost))
+	opts = append(opts, goproxy.WithMaxConnsPerHost(mitm.MaxConnsPerHost))
+	opts = append(opts, goproxy.WithUpstreamIdleTimeout(mitm.UpstreamIdleTimeout))
 	if c.Conf.MITMProxy.Enabled {
-		// opts = append(opts, goproxy.WithDelegate(c.txRecorder))
-		// opts = append(opts, goproxy.WithDelegate(&goproxy.DefaultDelegate{}))
-		opts = append(opts, goproxy.WithDelegate(c.txRecorder))
+		opts = append(opts, goproxy.WithDelegates(c.createDelegates()...))
 	}
 	if c.Conf.MITMProxy.DecryptHTTPS {
 		queue := common.NewQueue(c.Conf.MITMProxy.CertCacheSize)
-		certCache := recorder.NewCertCache(queue)
+		var certCache cert.Cache = recorder.NewCertCache(queue)
+		if c.Conf.MITMProxy.CertCacheDir != "" {
+			diskCache, err := cert.NewDiskCache(c.Conf.MITMProxy.CertCacheDir, certCache)
+			if err != nil {
+				log.Fatalf("创建证书缓存目录错误: %s", err)
+			}
+			certCache = diskCache
+		}
 		opts = append(opts, goproxy.WithDecryptHTTPS(certCache))
+		opts = append(opts, goproxy.WithCertKeyType(cert.KeyType(c.Conf.Certificate.KeyType)))
+		opts = append(opts, goproxy.WithMirrorUpstreamCert(c.Conf.Certificate.MirrorUpstream))
+		opts = append(opts, goproxy.WithCertHooks(certMetricsHooks()))
+		opts = append(opts, goproxy.WithDisableHTTP2(c.Conf.MITMProxy.DisableHTTP2))
+	}
+	opts = append(opts, goproxy.WithClientIdleTimeout(c.Conf.MITMProxy.ClientIdleTimeout))
+	opts = append(opts, goproxy.WithTunnelIdleTimeout(c.Conf.MITMProxy.TunnelIdleTimeout))
+	if c.Conf.MITMProxy.ParentProxy != "" {
+		parentProxy, err := url.Parse(c.Conf.MITMProxy.ParentProxy)
+		if err != nil {
+			log.Fatalf("上级代理地址错误: %s", err)
+		}
+		opts = append(opts, goproxy.WithParentProxy(parentProxy))
+	}
+	if len(c.Conf.UpstreamTLS) > 0 {
+		opts = append(opts, goproxy.WithUpstreamTLS(c.createUpstreamTLS()))
+	}
+	app := c.Conf.App
+	if len(app.AllowClients) > 0 || len(app.DenyClients) > 0 {
+		acl, err := goproxy.NewACL(app.AllowClients, app.DenyClients)
+		if err != nil {
+			log.Fatalf("客户端访问控制配置错误: %s", err)
+		}
+		opts = append(opts, goproxy.WithClientACL(acl, app.RecordDenied))
+	}
+	if len(app.DecryptAllowClients) > 0 || len(app.DecryptDenyClients) > 0 {
+		acl, err := goproxy.NewACL(app.DecryptAllowClients, app.DecryptDenyClients)
+		if err != nil {
+			log.Fatalf("HTTPS解密访问控制配置错误: %s", err)
+		}
+		opts = append(opts, goproxy.WithDecryptACL(acl))
+	}
+	var proxyAccounts *account.Accounts
+	if c.Conf.ProxyAuth.Enabled {
+		proxyAccounts = c.createAccounts()
+		opts = append(opts, goproxy.WithAuthenticator(proxyAccounts, c.Conf.ProxyAuth.Realm))
+	}
+	if c.Conf.SOCKS5.Enabled {
+		switch {
+		case c.Conf.SOCKS5.Username != "":
+			accounts := account.New()
+			err := accounts.Add(c.Conf.SOCKS5.Username, c.Conf.SOCKS5.Password)
+			if err != nil {
+				log.Fatalf("设置SOCKS5账号错误: %s", err)
+			}
+			opts = append(opts, goproxy.WithSOCKS5Authenticator(accounts))
+		case proxyAccounts != nil:
+			// 开启代理认证时SOCKS5使用相同的账号, 不能绕过认证
+			opts = append(opts, goproxy.WithSOCKS5Authenticator(proxyAccounts))
+		}
 	}
 
 	c.Proxy = goproxy.New(opts...)
 }
 
+func (c *Container) createUpstreamTLS() []goproxy.UpstreamTLS {
+	rules := make([]goproxy.UpstreamTLS, 0, len(c.Conf.UpstreamTLS))
+	for _, u := range c.Conf.UpstreamTLS {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: u.InsecureSkipVerify,
+		}
+		if u.CertFile != "" {
+			clientCert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+			if err != nil {
+				log.Fatalf("加载上游TLS客户端证书错误: [host: %s] %s", u.Host, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{clientCert}
+		}
+		if u.CAFile != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			data, err := ioutil.ReadFile(u.CAFile)
+			if err != nil {
+				log.Fatalf("读取上游TLS CA证书错误: [host: %s] %s", u.Host, err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				log.Fatalf("上游TLS CA证书格式错误: [host: %s] %s", u.Host, u.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if u.MinVersion != "" {
+			version, ok := tlsVersions[u.MinVersion]
+			if !ok {
+				log.Fatalf("上游TLS最低版本错误: [host: %s] %s", u.Host, u.MinVersion)
+			}
+			tlsConfig.MinVersion = version
+		}
+		rules = append(rules, goproxy.UpstreamTLS{
+			Host:   u.Host,
+			Config: tlsConfig,
+		})
+	}
+
+	return rules
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *Container) createReverseProxy() {
+	if !c.Conf.ReverseProxy.Enabled {
+		return
+	}
+	routes := make([]goproxy.ReverseRoute, 0, len(c.Conf.ReverseProxy.Routes))
+	for _, r := range c.Conf.ReverseProxy.Routes {
+		upstream, err := url.Parse(r.Upstream)
+		if err != nil {
+			log.Fatalf("反向代理上游地址错误: [upstream: %s] %s", r.Upstream, err)
+		}
+		if upstream.Scheme != "http" && upstream.Scheme != "https" {
+			log.Fatalf("反向代理上游地址只支持http、https: [upstream: %s]", r.Upstream)
+		}
+		routes = append(routes, goproxy.ReverseRoute{
+			Host:         r.Host,
+			PathPrefix:   r.Path,
+			Upstream:     upstream,
+			PreserveHost: r.PreserveHost,
+		})
+	}
+	c.ReverseProxy = c.Proxy.ReverseHandler(routes)
+}
+
+func (c *Container) createAccounts() *account.Accounts {
+	accounts, err := account.LoadFile(c.Conf.ProxyAuth.UserFile)
+	if err != nil {
+		log.Fatalf("加载代理账号文件错误: %s", err)
+	}
+	for _, profile := range c.Conf.ProxyAuth.Profiles {
+		var parentProxy *url.URL
+		if profile.ParentProxy != "" {
+			parentProxy, err = url.Parse(profile.ParentProxy)
+			if err != nil {
+				log.Fatalf("代理账号上级代理地址错误: [user: %s] %s", profile.User, err)
+			}
+		}
+		var rules *filterrules.Rules
+		if profile.Rules != "" {
+			rules, err = filterrules.ParseFile(profile.Rules)
+			if err != nil {
+				log.Fatalf("加载代理账号规则文件错误: [user: %s] %s", profile.User, err)
+			}
+		}
+		err = accounts.SetProfile(profile.User, parentProxy, rules)
+		if err != nil {
+			log.Fatalf("设置代理账号配置错误: %s", err)
+		}
+	}
+	log.Infof("代理身份认证已开启, 账号数: %d", accounts.Len())
+
+	return accounts
+}
+
 func (c *Container) createRecorderStorage() {
 	if !c.Conf.MITMProxy.Enabled {
 		return
@@ -99,8 +285,85 @@ func (c *Container) createRecorderOutput() {
 	c.txOutput = c.WebSocketOutput
 }
 
-func (c *Container) createRecorderInterceptor() {
-	c.txInterceptor = interceptor.Handler
+// 加载解码gRPC、protobuf消息的描述文件及URL映射, 未配置返回nil
+func (c *Container) createProtobufRegistry() *protobuf.Registry {
+	conf := c.Conf.Protobuf
+	if len(conf.DescriptorSets) == 0 && conf.ProtoDir == "" && len(conf.Mappings) == 0 {
+		return nil
+	}
+	registry := protobuf.NewRegistry()
+	for _, filename := range conf.DescriptorSets {
+		err := registry.LoadDescriptorSet(filename)
+		if err != nil {
+			log.Fatalf("加载protobuf描述文件错误: %s", err)
+		}
+	}
+	if conf.ProtoDir != "" {
+		err := registry.LoadProtoDir(conf.ProtoDir)
+		if err != nil {
+			log.Fatalf("加载.proto文件目录错误: %s", err)
+		}
+	}
+	for _, m := range conf.Mappings {
+		err := registry.AddMapping(protobuf.Mapping{
+			URL:      m.URL,
+			Request:  m.Request,
+			Response: m.Response,
+		})
+		if err != nil {
+			log.Fatalf("protobuf URL映射配置错误: %s", err)
+		}
+	}
+
+	return registry
+}
+
+// Delegate链: 过滤规则、拦截器、记录流量
+func (c *Container) createDelegates() []goproxy.Delegate {
+	delegates := []goproxy.Delegate{&goproxy.RulesDelegate{}}
+	if interceptor.Handler != nil {
+		delegates = append(delegates, interceptor.Handler)
+	}
+
+	return append(delegates, c.txRecorder)
+}
+
+// 证书缓存命中、证书生成结果计入指标
+func certMetricsHooks() cert.Hooks {
+	return cert.Hooks{
+		CacheLookup: func(hit bool) {
+			result := "miss"
+			if hit {
+				result = "hit"
+			}
+			metrics.CertCacheLookups.WithLabelValues(result).Inc()
+		},
+		Generate: func(err error) {
+			result := "success"
+			if err != nil {
+				result = "error"
+			}
+			metrics.CertGenerations.WithLabelValues(result).Inc()
+		},
+	}
+}
+
+// 注册由各组件自行统计的指标
+func (c *Container) registerMetrics() {
+	filterrules.HitHook = func(module, rule string) {
+		metrics.RuleHits.WithLabelValues(module, rule).Inc()
+	}
+	metrics.MustRegister(
+		metrics.NewGaugeFunc("mars_client_connections", "正在处理的客户端连接数", func() float64 {
+			return float64(c.Proxy.ClientConnNum())
+		}),
+		metrics.NewGaugeFunc("mars_websocket_sessions", "流量审查页面的WebSocket连接数", func() float64 {
+			return float64(c.WebSocketOutput.SessionNum())
+		}),
+		metrics.NewCounterFunc("mars_websocket_broadcast_dropped_total", "因发送队列已满或已关闭未能推送的消息数", func() float64 {
+			return float64(c.WebSocketOutput.DroppedMessages())
+		}),
+	)
 }
 
 func (c *Container) createWebSocketOutput() {
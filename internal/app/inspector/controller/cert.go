@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+
+	"mars/goproxy/cert"
+)
+
+// 下载文件名与导出格式、Content-Type
+var certFiles = map[string]struct {
+	format      string
+	contentType string
+}{
+	"ca.crt":          {cert.FormatPEM, "application/x-x509-ca-cert"},
+	"ca.pem":          {cert.FormatPEM, "application/x-pem-file"},
+	"ca.der":          {cert.FormatDER, "application/x-x509-ca-cert"},
+	"ca.mobileconfig": {cert.FormatMobileConfig, "application/x-apple-aspen-config"},
+}
+
+var certPageTemplate = template.Must(template.New("cert").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>安装根证书</title>
+<style>
+body { font-family: sans-serif; max-width: 640px; margin: 20px auto; padding: 0 16px; color: #333; }
+a { color: #409eff; }
+code { word-break: break-all; }
+li { margin: 6px 0; }
+</style>
+</head>
+<body>
+<h2>安装根证书</h2>
+<p>手机扫描二维码下载根证书</p>
+<img src="/cert/qrcode.png" width="256" height="256" alt="{{.DownloadURL}}">
+<p><code>{{.DownloadURL}}</code></p>
+<h3>下载</h3>
+<ul>
+<li><a href="/cert/ca.crt">ca.crt</a> Android、Windows、Linux</li>
+<li><a href="/cert/ca.mobileconfig">ca.mobileconfig</a> iOS描述文件</li>
+<li><a href="/cert/ca.pem">ca.pem</a> <a href="/cert/ca.der">ca.der</a></li>
+</ul>
+<h3>证书信息</h3>
+<ul>
+<li>名称: {{.Name}}</li>
+<li>过期时间: {{.NotAfter}}</li>
+<li>SHA-256指纹: <code>{{.Fingerprint}}</code></li>
+</ul>
+<h3>说明</h3>
+<ul>
+<li>iOS: 安装描述文件后, 在 设置-通用-关于本机-证书信任设置 中启用完全信任</li>
+<li>Android 7+: 应用默认不信任用户安装的证书, 只有浏览器等信任用户证书的应用可以解密</li>
+</ul>
+</body>
+</html>
+`))
+
+// Cert 根证书下载
+type Cert struct {
+}
+
+// NewCert 创建Cert
+func NewCert() *Cert {
+	return &Cert{}
+}
+
+// Page 安装页面, 二维码指向根证书下载地址
+func (c *Cert) Page(resp http.ResponseWriter, req *http.Request) {
+	ca, err := cert.Root()
+	if err != nil {
+		c.rootError(resp, err)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = certPageTemplate.Execute(resp, map[string]string{
+		"DownloadURL": downloadURL(req),
+		"Name":        ca.Subject.CommonName,
+		"NotAfter":    ca.NotAfter.Local().Format("2006-01-02 15:04:05"),
+		"Fingerprint": cert.FingerprintSHA256(ca),
+	})
+	if err != nil {
+		log.Debugf("根证书安装页面输出错误: %s", err)
+	}
+}
+
+// QRCode 根证书下载地址的二维码
+func (c *Cert) QRCode(resp http.ResponseWriter, req *http.Request) {
+	png, err := qrcode.Encode(downloadURL(req), qrcode.Medium, 256)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "image/png")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Write(png)
+}
+
+// Download 下载根证书, 支持ca.crt、ca.pem、ca.der、ca.mobileconfig
+func (c *Cert) Download(resp http.ResponseWriter, req *http.Request) {
+	filename := path.Base(req.URL.Path)
+	file, ok := certFiles[filename]
+	if !ok {
+		http.NotFound(resp, req)
+		return
+	}
+	ca, err := cert.Root()
+	if err != nil {
+		c.rootError(resp, err)
+		return
+	}
+	data, err := cert.ExportCA(ca, nil, file.format, "")
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", file.contentType)
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=mars-%s", filename))
+	resp.Write(data)
+}
+
+func (c *Cert) rootError(resp http.ResponseWriter, err error) {
+	log.Warnf("加载根证书错误: %s", err)
+	http.Error(resp, "根证书不可用, 请确认已开启HTTPS解密", http.StatusServiceUnavailable)
+}
+
+// 根证书下载地址
+func downloadURL(req *http.Request) string {
+	host, port := externalHost(req)
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return fmt.Sprintf("http://%s/cert/ca.crt", host)
+}
+
+// 客户端访问流量审查server使用的地址, 浏览器通过回环地址访问时使用本机局域网IP, 以便手机等其他设备访问
+func externalHost(req *http.Request) (host, port string) {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, ""
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		if lan := lanIP(); lan != "" {
+			host = lan
+		}
+	}
+
+	return host, port
+}
+
+// 本机第一个非回环IPv4地址
+func lanIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"mars/filterrules"
+	"mars/internal/common/pac"
+)
+
+// PAC 代理自动配置文件
+type PAC struct {
+	proxyPort    int
+	mode         pac.Mode
+	decryptHTTPS bool
+}
+
+// NewPAC 创建PAC
+func NewPAC(proxyPort int, mode pac.Mode, decryptHTTPS bool) *PAC {
+	return &PAC{
+		proxyPort:    proxyPort,
+		mode:         mode,
+		decryptHTTPS: decryptHTTPS,
+	}
+}
+
+// File 根据当前规则生成PAC文件, 代理地址使用客户端访问流量审查server的地址
+func (p *PAC) File(resp http.ResponseWriter, req *http.Request) {
+	host, _ := externalHost(req)
+	data, err := pac.Generate(filterrules.Global(), pac.Options{
+		ProxyAddr:    net.JoinHostPort(host, strconv.Itoa(p.proxyPort)),
+		Mode:         p.mode,
+		DecryptHTTPS: p.decryptHTTPS,
+	})
+	if err != nil {
+		log.Warnf("生成PAC文件错误: %s", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Write(data)
+}
@@ -10,6 +10,8 @@ import (
 
 	"mars/internal/app/inject"
 	"mars/internal/app/inspector/controller"
+	"mars/internal/common/metrics"
+	"mars/internal/common/pac"
 	_ "mars/internal/statik"
 )
 
@@ -37,6 +39,22 @@ func (r *Router) Register() {
 	c := controller.NewInspector(r.container.WebSocketOutput, r.container.WebSocketSessionOpts)
 
 	r.mux.HandleFunc("/ws", c.WebSocket)
+
+	certController := controller.NewCert()
+	r.mux.HandleFunc("/cert", certController.Page)
+	r.mux.HandleFunc("/cert/qrcode.png", certController.QRCode)
+	r.mux.HandleFunc("/cert/", certController.Download)
+	r.mux.Handle("/metrics", metrics.Handler())
+
+	conf := r.container.Conf
+	pacMode, err := pac.ParseMode(conf.PAC.Mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pacController := controller.NewPAC(conf.App.ProxyPort, pacMode, conf.MITMProxy.DecryptHTTPS)
+	r.mux.HandleFunc("/proxy.pac", pacController.File)
+	// 兼容旧版页面的证书下载地址
+	r.mux.Handle(staticDir+"mitm-proxy.crt", http.RedirectHandler("/cert/ca.crt", http.StatusFound))
 }
 
 func (r *Router) registerStatic() {
@@ -0,0 +1,131 @@
+// Package account 代理认证账号
+package account
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mars/filterrules"
+	"mars/goproxy"
+)
+
+var _ goproxy.Authenticator = &Accounts{}
+
+// 用户不存在时用于比较的bcrypt哈希, 与用户存在时耗时相同, 避免通过响应时间枚举用户名
+var dummyHash = []byte("$2a$10$ehAWOjQy/y0xHRfyyYmO9uA3QY61NFbxu3PI3DcPArQdmNpw86uV2")
+
+// Accounts 代理账号集合, 账号文件每行格式为 用户名:bcrypt哈希, #开头为注释
+type Accounts struct {
+	users map[string]*account
+	// 已校验通过的凭证, 避免每个请求都执行bcrypt
+	verified sync.Map
+}
+
+type account struct {
+	hash []byte
+	user *goproxy.User
+}
+
+// New 创建空的账号集合
+func New() *Accounts {
+	return &Accounts{
+		users: make(map[string]*account),
+	}
+}
+
+// LoadFile 从账号文件加载
+func LoadFile(path string) (*Accounts, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := New()
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		segments := strings.SplitN(line, ":", 2)
+		if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+			return nil, fmt.Errorf("账号文件格式错误: [%s:%d]", path, lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(segments[1])); err != nil {
+			return nil, fmt.Errorf("账号文件密码不是bcrypt哈希: [%s:%d] %s", path, lineNo, err)
+		}
+		a.users[segments[0]] = &account{
+			hash: []byte(segments[1]),
+			user: &goproxy.User{Name: segments[0]},
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Add 添加明文密码账号, 如配置文件中的账号
+func (a *Accounts) Add(name, password string) error {
+	if name == "" {
+		return errors.New("用户名不能为空")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.users[name] = &account{
+		hash: hash,
+		user: &goproxy.User{Name: name},
+	}
+
+	return nil
+}
+
+// SetProfile 设置账号专属上级代理和过滤规则
+func (a *Accounts) SetProfile(name string, parentProxy *url.URL, rules *filterrules.Rules) error {
+	acc, ok := a.users[name]
+	if !ok {
+		return errors.New("账号不存在: " + name)
+	}
+	acc.user.ParentProxy = parentProxy
+	acc.user.Rules = rules
+
+	return nil
+}
+
+// Len 账号数量
+func (a *Accounts) Len() int {
+	return len(a.users)
+}
+
+// Authenticate 校验用户名密码
+func (a *Accounts) Authenticate(username, password string) (*goproxy.User, bool) {
+	acc, ok := a.users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, false
+	}
+	key := sha256.Sum256([]byte(username + ":" + password))
+	if _, ok := a.verified.Load(key); ok {
+		return acc.user, true
+	}
+	if bcrypt.CompareHashAndPassword(acc.hash, []byte(password)) != nil {
+		return nil, false
+	}
+	a.verified.Store(key, struct{}{})
+
+	return acc.user, true
+}
@@ -0,0 +1,63 @@
+package account
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAccounts(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "mars_account")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users")
+	content := "# 测试账号\nalice:" + string(hash) + "\n\n"
+	require.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+
+	a, err := LoadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, 1, a.Len())
+
+	user, ok := a.Authenticate("alice", "secret")
+	require.True(t, ok)
+	require.Equal(t, "alice", user.Name)
+	_, ok = a.Authenticate("alice", "secret")
+	require.True(t, ok)
+	_, ok = a.Authenticate("alice", "wrong")
+	require.False(t, ok)
+	_, ok = a.Authenticate("bob", "secret")
+	require.False(t, ok)
+	// 用户不存在时与有效哈希比较, 耗时与密码错误相同
+	cost, err := bcrypt.Cost(dummyHash)
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.DefaultCost, cost)
+
+	parent, _ := url.Parse("http://127.0.0.1:1080")
+	require.NoError(t, a.SetProfile("alice", parent, nil))
+	require.Equal(t, parent, user.ParentProxy)
+	require.Error(t, a.SetProfile("bob", parent, nil))
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("alice:plain"), 0600))
+	_, err = LoadFile(file)
+	require.Error(t, err)
+}
+
+func TestAccountsAdd(t *testing.T) {
+	a := New()
+	require.Error(t, a.Add("", "secret"))
+	require.NoError(t, a.Add("alice", "secret"))
+	require.Equal(t, 1, a.Len())
+
+	user, ok := a.Authenticate("alice", "secret")
+	require.True(t, ok)
+	require.Equal(t, "alice", user.Name)
+	_, ok = a.Authenticate("alice", "wrong")
+	require.False(t, ok)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+// 代理运行指标, 注册到Default
+var (
+	// Requests HTTP请求数
+	Requests = NewCounterVec("mars_http_requests_total", "HTTP请求数, status为0表示请求上游失败", "method", "status")
+	// UpstreamDuration 请求上游服务器到收到响应头的时间
+	UpstreamDuration = NewHistogramVec("mars_upstream_duration_seconds", "请求上游服务器到收到响应头的时间", nil)
+	// Tunnels 结束的隧道数
+	Tunnels = NewCounterVec("mars_tunnels_total", "结束的隧道数, reason为关闭原因", "reason")
+	// TunnelBytes 隧道转发的字节数
+	TunnelBytes = NewCounterVec("mars_tunnel_bytes_total", "隧道转发的字节数, direction为sent(客户端到服务器)或received", "direction")
+	// CertGenerations 生成的证书数
+	CertGenerations = NewCounterVec("mars_cert_generations_total", "解密HTTPS时生成的证书数", "result")
+	// CertCacheLookups 证书缓存查询数
+	CertCacheLookups = NewCounterVec("mars_cert_cache_lookups_total", "证书缓存查询数, result为hit或miss", "result")
+	// RuleHits 过滤规则命中数
+	RuleHits = NewCounterVec("mars_rule_hits_total", "过滤规则命中数, module为规则文件名称", "module", "rule")
+	// StoragePutErrors 保存流量失败数
+	StoragePutErrors = NewCounterVec("mars_storage_put_errors_total", "保存流量到数据库失败数")
+)
+
+func init() {
+	MustRegister(
+		Requests,
+		UpstreamDuration,
+		Tunnels,
+		TunnelBytes,
+		CertGenerations,
+		CertCacheLookups,
+		RuleHits,
+		StoragePutErrors,
+	)
+	// 未记录数据时也输出0
+	UpstreamDuration.WithLabelValues()
+	StoragePutErrors.WithLabelValues()
+	for _, result := range []string{"hit", "miss"} {
+		CertCacheLookups.WithLabelValues(result)
+	}
+	for _, result := range []string{"success", "error"} {
+		CertGenerations.WithLabelValues(result)
+	}
+}
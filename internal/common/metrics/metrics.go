@@ -0,0 +1,46 @@
+// Package metrics 运行指标, 以Prometheus文本格式输出
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Default 默认指标集合, 包含Go运行时及进程指标
+var Default = prometheus.NewRegistry()
+
+func init() {
+	Default.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// MustRegister 注册到默认指标集合, 名称重复时panic
+func MustRegister(cs ...prometheus.Collector) {
+	Default.MustRegister(cs...)
+}
+
+// Handler 默认指标集合的http.Handler
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Default, promhttp.HandlerOpts{})
+}
+
+// NewCounterVec 创建计数器
+func NewCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+// NewHistogramVec 创建直方图, buckets为nil时使用默认分桶
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+}
+
+// NewGaugeFunc 创建取值时调用fn的仪表
+func NewGaugeFunc(name, help string, fn func() float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn)
+}
+
+// NewCounterFunc 创建取值时调用fn的计数器, fn返回值只增不减
+func NewCounterFunc(name, help string, fn func() float64) prometheus.CounterFunc {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, fn)
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	sessions := NewGaugeFunc("test_sessions", "连接数", func() float64 {
+		return 3
+	})
+	MustRegister(sessions)
+	defer Default.Unregister(sessions)
+	require.Panics(t, func() {
+		MustRegister(NewCounterVec("mars_storage_put_errors_total", "重复"))
+	})
+
+	Requests.WithLabelValues("GET", "200").Inc()
+	Requests.WithLabelValues("GET", "200").Add(2)
+	UpstreamDuration.WithLabelValues().Observe(0.05)
+
+	resp := httptest.NewRecorder()
+	Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, resp.Header().Get("Content-Type"), "text/plain")
+	require.Contains(t, string(body), "# TYPE mars_http_requests_total counter\n"+
+		`mars_http_requests_total{method="GET",status="200"} 3`)
+	require.Contains(t, string(body), "mars_upstream_duration_seconds_count 1\n")
+	require.Contains(t, string(body), "mars_storage_put_errors_total 0\n")
+	require.Contains(t, string(body), `mars_cert_cache_lookups_total{result="miss"} 0`)
+	require.Contains(t, string(body), "test_sessions 3\n")
+	require.Contains(t, string(body), "go_goroutines ")
+}
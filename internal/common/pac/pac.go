@@ -0,0 +1,149 @@
+// Package pac 根据过滤规则生成代理自动配置(PAC)文件
+package pac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"mars/filterrules"
+)
+
+// Mode 没有规则的Host的代理方式
+type Mode string
+
+const (
+	// ModeProxy 所有请求都经过代理
+	ModeProxy Mode = "proxy"
+	// ModeDirect 只有需要解密、重写的Host经过代理, 其他直连
+	ModeDirect Mode = "direct"
+)
+
+// ParseMode 解析代理方式, 为空时使用ModeProxy
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeProxy:
+		return ModeProxy, nil
+	case ModeDirect:
+		return ModeDirect, nil
+	}
+
+	return "", fmt.Errorf("PAC代理方式错误: %s, 可选值 proxy、direct", s)
+}
+
+// Options 生成PAC的参数
+type Options struct {
+	// ProxyAddr 客户端可访问的代理地址 host:port
+	ProxyAddr string
+	// Mode 白名单及没有规则的Host的代理方式
+	Mode Mode
+	// DecryptHTTPS 是否解密HTTPS, 开启时不在白名单中的HTTPS请求都需要经过代理
+	DecryptHTTPS bool
+}
+
+var pacTemplate = template.Must(template.New("pac").Parse(`// 由mars根据过滤规则生成, 规则: {{.Name}}
+var proxy = {{.Proxy}};
+var fallback = {{.Fallback}};
+var decryptHTTPS = {{.DecryptHTTPS}};
+// 需要重写、屏蔽或指定上级代理的Host
+var ruleHosts = {{.RuleHosts}};
+// 不解密的Host
+var whitelist = {{.Whitelist}};
+
+function matchHost(patterns, host, hostPort) {
+  for (var i = 0; i < patterns.length; i++) {
+    var re = new RegExp(patterns[i]);
+    if (re.test(host) || re.test(hostPort)) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function FindProxyForURL(url, host) {
+  var https = url.substring(0, 6) === "https:";
+  var port = https ? "443" : "80";
+  var m = /^[a-z]+:\/\/(\[[^\]]*\]|[^\/:]*)(:(\d+))?/i.exec(url);
+  if (m && m[3]) {
+    port = m[3];
+  }
+  var hostPort = host + ":" + port;
+  if (matchHost(ruleHosts, host, hostPort)) {
+    return proxy;
+  }
+  // 只有HTTPS需要代理解密, 没有规则的HTTP请求按fallback处理
+  if (decryptHTTPS && https && !matchHost(whitelist, host, hostPort)) {
+    return proxy;
+  }
+  return fallback;
+}
+`))
+
+// Generate 生成PAC文件, 规则为Go正则表达式, 转换为等价的JS正则表达式, 无法转换的规则会被忽略
+func Generate(rules *filterrules.Rules, opts Options) ([]byte, error) {
+	proxy := "PROXY " + opts.ProxyAddr
+	fallback := proxy
+	if opts.Mode == ModeDirect {
+		fallback = "DIRECT"
+	}
+	ruleHosts := make([]string, 0, len(rules.Blacklist)+len(rules.ParentProxy))
+	for _, p := range rules.Blacklist {
+		ruleHosts = append(ruleHosts, hostPattern(p))
+	}
+	for _, rule := range rules.ParentProxy {
+		ruleHosts = append(ruleHosts, rule["url"])
+	}
+
+	var buf bytes.Buffer
+	err := pacTemplate.Execute(&buf, map[string]interface{}{
+		"Name":         strings.NewReplacer("\r", " ", "\n", " ").Replace(rules.Name),
+		"Proxy":        jsString(proxy),
+		"Fallback":     jsString(fallback),
+		"DecryptHTTPS": opts.DecryptHTTPS,
+		"RuleHosts":    jsPatterns(ruleHosts),
+		"Whitelist":    jsPatterns(rules.Whitelist),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// HOSTS屏蔽规则在Blacklist中保留了前缀||, 作为正则时||匹配任意字符串, 去掉前缀及路径只保留Host部分
+func hostPattern(p string) string {
+	p = strings.TrimPrefix(p, "||")
+	if i := strings.Index(p, "/"); i >= 0 {
+		p = p[:i]
+	}
+
+	return p
+}
+
+// 去重并转换为JS正则表达式字符串数组
+func jsPatterns(patterns []string) string {
+	seen := make(map[string]bool, len(patterns))
+	list := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		js, err := jsRegExp(p)
+		if err != nil {
+			continue
+		}
+		list = append(list, js)
+	}
+	data, _ := json.Marshal(list)
+
+	return string(data)
+}
+
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+
+	return string(data)
+}
@@ -0,0 +1,82 @@
+package pac
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+)
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("")
+	require.NoError(t, err)
+	require.Equal(t, ModeProxy, mode)
+	mode, err = ParseMode("direct")
+	require.NoError(t, err)
+	require.Equal(t, ModeDirect, mode)
+	_, err = ParseMode("socks")
+	require.Error(t, err)
+}
+
+func TestGenerate(t *testing.T) {
+	rules := &filterrules.Rules{
+		Name:        "test",
+		Whitelist:   []string{`(?i)^.*google\.com$`},
+		Blacklist:   []string{`shaoxia\.xyz`, `shaoxia\.xyz`, `(?<=bad)`},
+		ParentProxy: []map[string]string{{"url": `corp\.local`, "proxy": "direct"}},
+	}
+	data, err := Generate(rules, Options{ProxyAddr: "192.168.1.2:8888", Mode: ModeDirect, DecryptHTTPS: true})
+	require.NoError(t, err)
+	pac := string(data)
+	require.Contains(t, pac, `var proxy = "PROXY 192.168.1.2:8888";`)
+	require.Contains(t, pac, `var fallback = "DIRECT";`)
+	require.Contains(t, pac, `var decryptHTTPS = true;`)
+	require.Contains(t, pac, `var ruleHosts = ["shaoxia\\.xyz","corp\\.local"];`)
+	require.Contains(t, pac, `var whitelist = ["^[^\\n]*[Gg][Oo][Oo][Gg][Ll][Ee]\\.[Cc][Oo][Mm]$"];`)
+	require.Contains(t, pac, `decryptHTTPS && https &&`)
+	require.Contains(t, pac, "function FindProxyForURL(url, host)")
+
+	data, err = Generate(&filterrules.Rules{}, Options{ProxyAddr: "10.0.0.1:8888", Mode: ModeProxy})
+	require.NoError(t, err)
+	require.Contains(t, string(data), `var fallback = "PROXY 10.0.0.1:8888";`)
+	require.Contains(t, string(data), `var ruleHosts = [];`)
+}
+
+func TestGenerateHostlist(t *testing.T) {
+	file, err := ioutil.TempFile("", "mars-rules-")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("@@.*google.com\n||shaoxia.xyz/post/.*\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	rules, err := filterrules.ParseFile(file.Name())
+	require.NoError(t, err)
+
+	// HOSTS屏蔽规则只保留Host, 不能生成匹配所有Host的正则
+	data, err := Generate(rules, Options{ProxyAddr: "192.168.1.2:8888", Mode: ModeDirect})
+	require.NoError(t, err)
+	require.Contains(t, string(data), `var ruleHosts = ["shaoxia[^\\n]xyz"];`)
+}
+
+func TestJSRegExp(t *testing.T) {
+	for pattern, want := range map[string]string{
+		`shaoxia\.xyz`:               `shaoxia\.xyz`,
+		`\Aapi\.(?P<env>dev|test)\z`: `^api\.(dev|test)$`,
+		`(?i)ab+`:                    `[Aa][Bb]+`,
+		`[[:digit:]]{2,}\.example/`:  `[0-9]{2,}\.example\/`,
+		`(?:ab)*?c?`:                 `(?:ab)*?c?`,
+		`\Qa.b\E|x{1,3}`:             `a\.b|x{1,3}`,
+		`[^a]`:                       "[\\u0000-`b-\\uffff]",
+		`(?s).`:                      `[\s\S]`,
+		"\u00e9\\.com":               `\u00e9\.com`,
+	} {
+		js, err := jsRegExp(pattern)
+		require.NoError(t, err, pattern)
+		require.Equal(t, want, js, pattern)
+	}
+	_, err := jsRegExp(`(?<=bad)`)
+	require.Error(t, err)
+}
@@ -0,0 +1,193 @@
+package pac
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// jsRegExp 将Go正则表达式转换为语义相同的JS RegExp源码.
+// 规则按Go(RE2)语法匹配, JS不支持(?i)、(?P<name>)、\A、\z、[[:alpha:]]、\pL等写法,
+// 因此先解析为语法树再逐节点生成JS源码, 忽略大小写展开为字符集, 不依赖JS的标志位.
+// 字符集只保留BMP范围, Host不含BMP以外的字符
+func jsRegExp(pattern string) (string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = writeJSRegExp(&b, re)
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func writeJSRegExp(b *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		b.WriteString(`[^\s\S]`)
+	case syntax.OpEmptyMatch:
+		b.WriteString(`(?:)`)
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && r <= 0xffff && unicode.SimpleFold(r) != r {
+				b.WriteByte('[')
+				for f := r; ; {
+					writeJSRune(b, f, true)
+					f = unicode.SimpleFold(f)
+					if f == r {
+						break
+					}
+				}
+				b.WriteByte(']')
+				continue
+			}
+			writeJSRune(b, r, false)
+		}
+	case syntax.OpCharClass:
+		writeJSClass(b, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		b.WriteString(`[^\n]`)
+	case syntax.OpAnyChar:
+		b.WriteString(`[\s\S]`)
+	// Host不含换行, 行首行尾与文本首尾相同
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		b.WriteByte('^')
+	case syntax.OpEndLine, syntax.OpEndText:
+		b.WriteByte('$')
+	case syntax.OpWordBoundary:
+		b.WriteString(`\b`)
+	case syntax.OpNoWordBoundary:
+		b.WriteString(`\B`)
+	case syntax.OpCapture:
+		b.WriteByte('(')
+		err := writeJSRegExp(b, re.Sub[0])
+		if err != nil {
+			return err
+		}
+		b.WriteByte(')')
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		err := writeJSGroup(b, re.Sub[0])
+		if err != nil {
+			return err
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			b.WriteByte('*')
+		case syntax.OpPlus:
+			b.WriteByte('+')
+		case syntax.OpQuest:
+			b.WriteByte('?')
+		default:
+			b.WriteString("{" + strconv.Itoa(re.Min) + ",")
+			if re.Max >= 0 {
+				b.WriteString(strconv.Itoa(re.Max))
+			}
+			b.WriteByte('}')
+		}
+		if re.Flags&syntax.NonGreedy != 0 {
+			b.WriteByte('?')
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			var err error
+			if sub.Op == syntax.OpAlternate {
+				err = writeJSGroup(b, sub)
+			} else {
+				err = writeJSRegExp(b, sub)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteByte('|')
+			}
+			err := writeJSRegExp(b, sub)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("不支持的正则表达式: %s", re)
+	}
+
+	return nil
+}
+
+// 加非捕获分组, 重复的多字符字面量(含BMP以外的字符)、拼接、选择分支需要分组
+func writeJSGroup(b *strings.Builder, re *syntax.Regexp) error {
+	multi := re.Op == syntax.OpLiteral && (len(re.Rune) > 1 || re.Rune[0] > 0xffff)
+	if multi || re.Op == syntax.OpAlternate ||
+		re.Op == syntax.OpConcat || re.Op == syntax.OpEmptyMatch {
+		b.WriteString("(?:")
+		err := writeJSRegExp(b, re)
+		if err != nil {
+			return err
+		}
+		b.WriteByte(')')
+		return nil
+	}
+
+	return writeJSRegExp(b, re)
+}
+
+// 字符集, ranges为成对的起止字符
+func writeJSClass(b *strings.Builder, ranges []rune) {
+	var bmp []rune
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo > 0xffff {
+			continue
+		}
+		if hi > 0xffff {
+			hi = 0xffff
+		}
+		bmp = append(bmp, lo, hi)
+	}
+	switch {
+	case len(bmp) == 0:
+		b.WriteString(`[^\s\S]`)
+		return
+	case len(bmp) == 2 && bmp[0] == 0 && bmp[1] == 0xffff:
+		b.WriteString(`[\s\S]`)
+		return
+	}
+	b.WriteByte('[')
+	for i := 0; i < len(bmp); i += 2 {
+		writeJSRune(b, bmp[i], true)
+		if bmp[i+1] != bmp[i] {
+			b.WriteByte('-')
+			writeJSRune(b, bmp[i+1], true)
+		}
+	}
+	b.WriteByte(']')
+}
+
+// 写入单个字符, 特殊字符转义, 非ASCII可打印字符使用\u转义
+func writeJSRune(b *strings.Builder, r rune, inClass bool) {
+	special := `\^$.|?*+()[]{}/`
+	if inClass {
+		special = `\^-[]/`
+	}
+	switch {
+	case r < utf8.RuneSelf && r >= ' ' && r != 0x7f:
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	case r > 0xffff:
+		r1, r2 := utf16.EncodeRune(r)
+		fmt.Fprintf(b, `\u%04x\u%04x`, r1, r2)
+	default:
+		fmt.Fprintf(b, `\u%04x`, r)
+	}
+}
@@ -0,0 +1,306 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// object 保持字段顺序的JSON对象
+type object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newObject() *object {
+	return &object{values: make(map[string]interface{})}
+}
+
+func (o *object) set(key string, v interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+// 添加到数组字段
+func (o *object) append(key string, v ...interface{}) {
+	list, _ := o.values[key].([]interface{})
+	o.set(key, append(list, v...))
+}
+
+// MarshalJSON 按字段出现的顺序输出
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// Decode 按消息类型全名解码为JSON, 字段名使用json_name, 64位整数输出为字符串
+func (r *Registry) Decode(msgType string, data []byte) ([]byte, error) {
+	v, err := r.decode(msgType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func (r *Registry) decode(msgType string, data []byte) (*object, error) {
+	if r == nil {
+		return nil, fmt.Errorf("未加载protobuf描述文件: %s", msgType)
+	}
+	msg, ok := r.messages[msgType]
+	if !ok {
+		return nil, fmt.Errorf("未知的protobuf消息类型: %s", msgType)
+	}
+
+	return r.decodeMessage(msg, data, 0)
+}
+
+func (r *Registry) decodeMessage(msg *descriptor.DescriptorProto, data []byte, depth int) (*object, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("protobuf消息嵌套超过%d层", maxDepth)
+	}
+	fields := make(map[int32]*descriptor.FieldDescriptorProto, len(msg.GetField()))
+	for _, fd := range msg.GetField() {
+		fields[fd.GetNumber()] = fd
+	}
+	obj := newObject()
+	err := readFields(data, func(f field) error {
+		fd, ok := fields[f.num]
+		if !ok {
+			// 描述文件中没有的字段忽略
+			return nil
+		}
+		key := fd.GetJsonName()
+		if key == "" {
+			key = fd.GetName()
+		}
+		if fd.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED {
+			if entry := r.mapEntry(fd); entry != nil {
+				return r.decodeMapEntry(obj, key, entry, f, depth)
+			}
+			if f.wireType == wireBytes && isPackable(fd.GetType()) {
+				values, err := r.decodePacked(fd, f.bytes)
+				if err != nil {
+					return fmt.Errorf("%s: %s", fd.GetName(), err)
+				}
+				obj.append(key, values...)
+				return nil
+			}
+		}
+		v, err := r.decodeValue(fd, f, depth)
+		if err != nil {
+			return fmt.Errorf("%s: %s", fd.GetName(), err)
+		}
+		if fd.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED {
+			obj.append(key, v)
+		} else if sub, ok := v.(*object); ok {
+			// 非repeated的消息字段出现多次时合并
+			if old, ok := obj.values[key].(*object); ok {
+				for _, k := range sub.keys {
+					old.set(k, sub.values[k])
+				}
+				return nil
+			}
+			obj.set(key, v)
+		} else {
+			obj.set(key, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// map字段对应的entry消息类型, 不是map字段返回nil
+func (r *Registry) mapEntry(fd *descriptor.FieldDescriptorProto) *descriptor.DescriptorProto {
+	if fd.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		return nil
+	}
+	msg := r.messages[strings.TrimPrefix(fd.GetTypeName(), ".")]
+	if msg == nil || !msg.GetOptions().GetMapEntry() {
+		return nil
+	}
+
+	return msg
+}
+
+// map的每个entry作为对象的一个key
+func (r *Registry) decodeMapEntry(obj *object, key string, entry *descriptor.DescriptorProto, f field, depth int) error {
+	if f.wireType != wireBytes {
+		return fmt.Errorf("%s: map字段线路类型错误", key)
+	}
+	e, err := r.decodeMessage(entry, f.bytes, depth+1)
+	if err != nil {
+		return err
+	}
+	m, ok := obj.values[key].(*object)
+	if !ok {
+		m = newObject()
+		obj.set(key, m)
+	}
+	k := ""
+	if len(e.keys) > 0 && e.keys[0] == "key" {
+		k = fmt.Sprint(e.values["key"])
+	}
+	m.set(k, e.values["value"])
+
+	return nil
+}
+
+// 解码packed编码的repeated标量
+func (r *Registry) decodePacked(fd *descriptor.FieldDescriptorProto, data []byte) ([]interface{}, error) {
+	wireType := scalarWireType(fd.GetType())
+	var values []interface{}
+	for len(data) > 0 {
+		f := field{num: fd.GetNumber(), wireType: wireType}
+		switch wireType {
+		case wireVarint:
+			v, n, err := readVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			f.varint = v
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, errTruncated
+			}
+			f.varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, errTruncated
+			}
+			f.varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		}
+		v, err := r.decodeValue(fd, f, 0)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// 按字段类型转换为JSON值
+func (r *Registry) decodeValue(fd *descriptor.FieldDescriptorProto, f field, depth int) (interface{}, error) {
+	t := fd.GetType()
+	expect := scalarWireType(t)
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		expect = wireBytes
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		expect = wireStartGroup
+	}
+	if f.wireType != expect {
+		return nil, fmt.Errorf("线路类型错误: %d", f.wireType)
+	}
+
+	v := f.varint
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return jsonFloat(math.Float64frombits(v)), nil
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return jsonFloat(float64(math.Float32frombits(uint32(v)))), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return strconv.FormatInt(int64(v), 10), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return strconv.FormatUint(v, 10), nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return int32(uint32(v)>>1) ^ -int32(v&1), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return v != 0, nil
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if name, ok := r.enums[strings.TrimPrefix(fd.GetTypeName(), ".")][int32(v)]; ok {
+			return name, nil
+		}
+		return int32(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return string(f.bytes), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return f.bytes, nil
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_GROUP:
+		msg, ok := r.messages[strings.TrimPrefix(fd.GetTypeName(), ".")]
+		if !ok {
+			return nil, fmt.Errorf("未知的protobuf消息类型: %s", fd.GetTypeName())
+		}
+		return r.decodeMessage(msg, f.bytes, depth+1)
+	}
+
+	return nil, fmt.Errorf("未知的字段类型: %s", t)
+}
+
+// 标量类型对应的线路类型
+func scalarWireType(t descriptor.FieldDescriptorProto_Type) int {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return wireFixed64
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT, descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return wireFixed32
+	}
+
+	return wireVarint
+}
+
+// 数值类型的repeated字段可以packed编码
+func isPackable(t descriptor.FieldDescriptorProto_Type) bool {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+
+	return true
+}
+
+// NaN、Infinity无法编码为JSON数字, 与protojson一样输出为字符串
+func jsonFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	return f
+}
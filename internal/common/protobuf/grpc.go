@@ -0,0 +1,172 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// gRPC内容类型, 可带 +proto、+json 后缀
+const (
+	contentTypeGRPC        = "application/grpc"
+	contentTypeGRPCWeb     = "application/grpc-web"
+	contentTypeGRPCWebText = "application/grpc-web-text"
+)
+
+const (
+	// 长度前缀: 1字节标志 + 4字节长度
+	frameHeaderLen = 5
+	// 消息已压缩
+	flagCompressed = 0x01
+	// grpc-web中body末尾的trailer
+	flagTrailer = 0x80
+)
+
+// Frame gRPC长度前缀消息
+type Frame struct {
+	// Compressed 是否按grpc-encoding压缩
+	Compressed bool
+	// Trailer grpc-web中以body形式发送的trailer
+	Trailer bool
+	Data    []byte
+}
+
+// 拆分内容类型和后缀
+func splitContentType(contentType string) (string, string) {
+	i := strings.IndexByte(contentType, '+')
+	if i < 0 {
+		return contentType, ""
+	}
+
+	return contentType[:i], contentType[i+1:]
+}
+
+// IsGRPC 是否是gRPC或grpc-web内容类型, contentType不含参数
+func IsGRPC(contentType string) bool {
+	base, _ := splitContentType(contentType)
+	switch base {
+	case contentTypeGRPC, contentTypeGRPCWeb, contentTypeGRPCWebText:
+		return true
+	}
+
+	return false
+}
+
+// SplitMethod 从请求path解析服务全名和方法名, 如 /helloworld.Greeter/SayHello
+func SplitMethod(path string) (service string, method string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// SplitFrames 按长度前缀拆分gRPC body, grpc-web-text先base64解码
+func SplitFrames(contentType string, body []byte) ([]Frame, error) {
+	base, _ := splitContentType(contentType)
+	if base == contentTypeGRPCWebText {
+		var err error
+		body, err = decodeBase64Chunks(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var frames []Frame
+	for len(body) > 0 {
+		if len(body) < frameHeaderLen {
+			return frames, fmt.Errorf("gRPC消息头不完整: %d字节", len(body))
+		}
+		flag := body[0]
+		l := binary.BigEndian.Uint32(body[1:frameHeaderLen])
+		body = body[frameHeaderLen:]
+		if uint64(len(body)) < uint64(l) {
+			return frames, fmt.Errorf("gRPC消息不完整: 长度%d, 剩余%d字节", l, len(body))
+		}
+		frames = append(frames, Frame{
+			Compressed: flag&flagCompressed != 0,
+			Trailer:    flag&flagTrailer != 0,
+			Data:       body[:l],
+		})
+		body = body[l:]
+	}
+
+	return frames, nil
+}
+
+// DecodeGRPC 将gRPC body中的消息解码为JSON数组, encoding为grpc-encoding头, 没有消息时返回nil
+func (r *Registry) DecodeGRPC(contentType, encoding, msgType string, body []byte) ([]byte, error) {
+	frames, err := SplitFrames(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	_, subtype := splitContentType(contentType)
+	messages := make([]json.RawMessage, 0, len(frames))
+	for _, frame := range frames {
+		if frame.Trailer {
+			continue
+		}
+		data := frame.Data
+		if frame.Compressed {
+			data, err = decompress(encoding, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if subtype == "json" {
+			if !json.Valid(data) {
+				return nil, fmt.Errorf("gRPC消息不是合法的JSON")
+			}
+			messages = append(messages, data)
+			continue
+		}
+		data, err = r.Decode(msgType, data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, data)
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(messages)
+}
+
+// 按grpc-encoding解压消息
+func decompress(encoding string, data []byte) ([]byte, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("不支持的gRPC压缩格式: %q", encoding)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// grpc-web-text的每个消息单独base64编码后拼接, 按4字节一组解码
+func decodeBase64Chunks(body []byte) ([]byte, error) {
+	body = bytes.Join(bytes.Fields(body), nil)
+	if len(body)%4 != 0 {
+		return nil, fmt.Errorf("grpc-web-text base64长度错误: %d", len(body))
+	}
+	out := make([]byte, 0, base64.StdEncoding.DecodedLen(len(body)))
+	buf := make([]byte, 3)
+	for i := 0; i < len(body); i += 4 {
+		n, err := base64.StdEncoding.Decode(buf, body[i:i+4])
+		if err != nil {
+			return nil, fmt.Errorf("grpc-web-text base64解码错误: %s", err)
+		}
+		out = append(out, buf[:n]...)
+	}
+
+	return out, nil
+}
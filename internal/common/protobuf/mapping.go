@@ -0,0 +1,64 @@
+package protobuf
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var protobufContentTypes = []string{
+	"application/x-protobuf", "application/protobuf",
+	"application/x-google-protobuf", "application/vnd.google.protobuf",
+}
+
+// IsProtobuf 是否是protobuf内容类型, 不含gRPC, contentType不含参数
+func IsProtobuf(contentType string) bool {
+	for _, item := range protobufContentTypes {
+		if item == contentType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Mapping URL对应的protobuf消息类型, 用于非gRPC的protobuf接口
+type Mapping struct {
+	// URL 正则表达式, 匹配host+path
+	URL string
+	// Request 请求消息类型全名, 为空时按字段编号和线路类型解码
+	Request string
+	// Response 响应消息类型全名, 为空时按字段编号和线路类型解码
+	Response string
+	re       *regexp.Regexp
+}
+
+// AddMapping 添加URL映射, 按添加顺序匹配第一条, 消息类型需已从描述文件加载
+func (r *Registry) AddMapping(m Mapping) error {
+	re, err := regexp.Compile(m.URL)
+	if err != nil {
+		return fmt.Errorf("protobuf映射url错误: [%s] %s", m.URL, err)
+	}
+	for _, msgType := range []string{m.Request, m.Response} {
+		if _, ok := r.messages[msgType]; msgType != "" && !ok {
+			return fmt.Errorf("未知的protobuf消息类型: [url: %s] %s", m.URL, msgType)
+		}
+	}
+	m.re = re
+	r.mappings = append(r.mappings, &m)
+
+	return nil
+}
+
+// Match 按host+path匹配URL映射, 未匹配返回nil
+func (r *Registry) Match(hostPath string) *Mapping {
+	if r == nil {
+		return nil
+	}
+	for _, m := range r.mappings {
+		if m.re.MatchString(hostPath) {
+			return m
+		}
+	}
+
+	return nil
+}
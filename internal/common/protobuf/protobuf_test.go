@@ -0,0 +1,283 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/stretchr/testify/require"
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, num int, wireType int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wireType))
+}
+
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+
+	return append(b, data...)
+}
+
+func grpcFrame(flag byte, data []byte) []byte {
+	header := make([]byte, frameHeaderLen)
+	header[0] = flag
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+
+	return append(header, data...)
+}
+
+func newField(name string, num int32, t descriptor.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptor.FieldDescriptorProto {
+	label := descriptor.FieldDescriptorProto_LABEL_OPTIONAL
+	if repeated {
+		label = descriptor.FieldDescriptorProto_LABEL_REPEATED
+	}
+	fd := &descriptor.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(num),
+		Label:    label.Enum(),
+		Type:     t.Enum(),
+	}
+	if typeName != "" {
+		fd.TypeName = proto.String(typeName)
+	}
+
+	return fd
+}
+
+// demo.proto: Greeter.SayHello(HelloRequest) returns (Item)
+func writeDescriptorSet(t *testing.T) string {
+	file := &descriptor.FileDescriptorProto{
+		Name:    proto.String("demo.proto"),
+		Package: proto.String("demo"),
+		EnumType: []*descriptor.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptor.EnumValueDescriptorProto{
+				{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("OK"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Item"),
+				Field: []*descriptor.FieldDescriptorProto{
+					newField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+					newField("delta", 2, descriptor.FieldDescriptorProto_TYPE_SINT32, "", false),
+				},
+			},
+			{
+				Name: proto.String("HelloRequest"),
+				Field: []*descriptor.FieldDescriptorProto{
+					newField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+					newField("id", 2, descriptor.FieldDescriptorProto_TYPE_INT64, "", false),
+					newField("nums", 3, descriptor.FieldDescriptorProto_TYPE_INT32, "", true),
+					newField("status", 4, descriptor.FieldDescriptorProto_TYPE_ENUM, ".demo.Status", false),
+					newField("item", 5, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".demo.Item", false),
+					newField("tags", 6, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".demo.HelloRequest.TagsEntry", true),
+				},
+				NestedType: []*descriptor.DescriptorProto{{
+					Name: proto.String("TagsEntry"),
+					Field: []*descriptor.FieldDescriptorProto{
+						newField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+						newField("value", 2, descriptor.FieldDescriptorProto_TYPE_INT32, "", false),
+					},
+					Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptor.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".demo.HelloRequest"),
+				OutputType: proto.String(".demo.Item"),
+			}},
+		}},
+	}
+	data, err := proto.Marshal(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{file}})
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "mars_protoset")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	require.NoError(t, err)
+
+	return f.Name()
+}
+
+func helloRequest() []byte {
+	var b []byte
+	b = appendBytes(b, 1, []byte("mars"))
+	b = appendTag(b, 2, wireVarint)
+	b = appendVarint(b, 1<<40)
+	// packed
+	b = appendBytes(b, 3, appendVarint(appendVarint(nil, 1), 2))
+	// 非packed
+	b = appendTag(b, 3, wireVarint)
+	b = appendVarint(b, 3)
+	b = appendTag(b, 4, wireVarint)
+	b = appendVarint(b, 1)
+	item := appendBytes(nil, 1, []byte("apple"))
+	item = appendTag(item, 2, wireVarint)
+	item = appendVarint(item, 3) // zigzag -2
+	b = appendBytes(b, 5, item)
+	entry := appendTag(appendBytes(nil, 1, []byte("a")), 2, wireVarint)
+	b = appendBytes(b, 6, appendVarint(entry, 7))
+	// 描述文件中没有的字段
+	b = appendTag(b, 99, wireVarint)
+	b = appendVarint(b, 1)
+
+	return b
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.Error(t, r.LoadDescriptorSet(filepath.Join(os.TempDir(), "not-exist.protoset")))
+	filename := writeDescriptorSet(t)
+	defer os.Remove(filename)
+	require.NoError(t, r.LoadDescriptorSet(filename))
+
+	m := r.Method("demo.Greeter", "SayHello")
+	require.NotNil(t, m)
+	require.Equal(t, "demo.HelloRequest", m.Input)
+	require.Equal(t, "demo.Item", m.Output)
+	require.Nil(t, r.Method("demo.Greeter", "SayBye"))
+	require.Nil(t, (*Registry)(nil).Method("demo.Greeter", "SayHello"))
+
+	data, err := r.Decode(m.Input, helloRequest())
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"mars","id":"1099511627776","nums":[1,2,3],"status":"OK",
+		"item":{"name":"apple","delta":-2},"tags":{"a":7}}`, string(data))
+	require.True(t, bytes.HasPrefix(data, []byte(`{"name":"mars","id"`)))
+
+	_, err = r.Decode("demo.Unknown", nil)
+	require.Error(t, err)
+	_, err = r.Decode(m.Input, []byte{0x0a, 0x05, 'm'})
+	require.Error(t, err)
+}
+
+func TestSplitMethod(t *testing.T) {
+	service, method, ok := SplitMethod("/demo.Greeter/SayHello")
+	require.True(t, ok)
+	require.Equal(t, "demo.Greeter", service)
+	require.Equal(t, "SayHello", method)
+	_, _, ok = SplitMethod("/index.html")
+	require.False(t, ok)
+	_, _, ok = SplitMethod("/a/b/c")
+	require.False(t, ok)
+}
+
+func TestDecodeGRPC(t *testing.T) {
+	require.True(t, IsGRPC("application/grpc"))
+	require.True(t, IsGRPC("application/grpc+proto"))
+	require.True(t, IsGRPC("application/grpc-web-text+proto"))
+	require.False(t, IsGRPC("application/json"))
+
+	r := NewRegistry()
+	filename := writeDescriptorSet(t)
+	defer os.Remove(filename)
+	require.NoError(t, r.LoadDescriptorSet(filename))
+	item := appendBytes(nil, 1, []byte("apple"))
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(item)
+	w.Close()
+	body := append(grpcFrame(0, item), grpcFrame(flagCompressed, gz.Bytes())...)
+	data, err := r.DecodeGRPC("application/grpc", "gzip", "demo.Item", body)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"name":"apple"},{"name":"apple"}]`, string(data))
+
+	_, err = r.DecodeGRPC("application/grpc", "snappy", "demo.Item", body)
+	require.Error(t, err)
+	_, err = r.DecodeGRPC("application/grpc", "", "demo.Item", body[:3])
+	require.Error(t, err)
+
+	// 没有消息, 如只返回trailer的错误响应
+	data, err = r.DecodeGRPC("application/grpc", "", "demo.Item", nil)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// grpc-web-text每个消息单独base64编码, trailer不作为消息
+	trailer := grpcFrame(flagTrailer, []byte("grpc-status:0\r\n"))
+	text := base64.StdEncoding.EncodeToString(grpcFrame(0, item)) + base64.StdEncoding.EncodeToString(trailer)
+	frames, err := SplitFrames("application/grpc-web-text", []byte(text))
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+	require.True(t, frames[1].Trailer)
+	data, err = r.DecodeGRPC("application/grpc-web-text", "", "demo.Item", []byte(text))
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"name":"apple"}]`, string(data))
+
+	data, err = (*Registry)(nil).DecodeGRPC("application/grpc+json", "", "", grpcFrame(0, []byte(`{"name":"apple"}`)))
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"name":"apple"}]`, string(data))
+}
+
+func TestDecodeRaw(t *testing.T) {
+	var b []byte
+	b = appendBytes(b, 1, []byte("mars"))
+	b = appendTag(b, 2, wireVarint)
+	b = appendVarint(b, 18)
+	b = appendTag(b, 2, wireVarint)
+	b = appendVarint(b, 1<<60)
+	nested := appendTag(nil, 1, wireFixed32)
+	nested = append(nested, 7, 0, 0, 0)
+	b = appendBytes(b, 3, nested)
+	b = appendBytes(b, 4, []byte{0xff, 0x00})
+	b = appendTag(b, 5, wireStartGroup)
+	b = appendTag(b, 1, wireVarint)
+	b = appendVarint(b, 1)
+	b = appendTag(b, 5, wireEndGroup)
+
+	data, err := DecodeRaw(b)
+	require.NoError(t, err)
+	require.Equal(t, `{"1:bytes":"mars","2:varint":[18,"1152921504606846976"],"3:bytes":{"1:fixed32":7},`+
+		`"4:bytes":"/wA=","5:group":{"1:varint":1}}`, string(data))
+
+	_, err = DecodeRaw([]byte{0x0a, 0x05, 'm'})
+	require.Error(t, err)
+	_, err = DecodeRaw(appendTag(nil, 1, wireEndGroup))
+	require.Error(t, err)
+}
+
+func TestMapping(t *testing.T) {
+	require.True(t, IsProtobuf("application/x-protobuf"))
+	require.False(t, IsProtobuf("application/grpc"))
+
+	r := NewRegistry()
+	filename := writeDescriptorSet(t)
+	defer os.Remove(filename)
+	require.NoError(t, r.LoadDescriptorSet(filename))
+
+	require.Error(t, r.AddMapping(Mapping{URL: `(`}))
+	require.Error(t, r.AddMapping(Mapping{URL: `api\.example\.com`, Response: "demo.Unknown"}))
+	require.NoError(t, r.AddMapping(Mapping{URL: `api\.example\.com/v1/hello`, Request: "demo.HelloRequest", Response: "demo.Item"}))
+	require.NoError(t, r.AddMapping(Mapping{URL: `api\.example\.com/`}))
+
+	m := r.Match("api.example.com/v1/hello")
+	require.NotNil(t, m)
+	require.Equal(t, "demo.Item", m.Response)
+	m = r.Match("api.example.com/v2")
+	require.NotNil(t, m)
+	require.Empty(t, m.Response)
+	require.Nil(t, r.Match("example.com/"))
+	require.Nil(t, (*Registry)(nil).Match("api.example.com/"))
+}
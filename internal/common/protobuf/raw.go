@@ -0,0 +1,112 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// JSON数字能精确表示的最大整数, 超过时输出为字符串
+const maxSafeInteger = 1<<53 - 1
+
+var wireTypeNames = map[int]string{
+	wireVarint:     "varint",
+	wireFixed64:    "fixed64",
+	wireBytes:      "bytes",
+	wireStartGroup: "group",
+	wireFixed32:    "fixed32",
+}
+
+// repeated 同一字段编号出现多次时的值
+type repeated []interface{}
+
+// 添加字段值, 同一key出现多次时转为数组
+func (o *object) add(key string, v interface{}) {
+	switch old := o.values[key].(type) {
+	case nil:
+		o.set(key, v)
+	case repeated:
+		o.set(key, append(old, v))
+	default:
+		o.set(key, repeated{old, v})
+	}
+}
+
+// DecodeRaw 没有描述文件时按字段编号和线路类型解码为JSON, key为"字段编号:线路类型",
+// bytes字段依次尝试解码为可打印字符串、嵌套消息, 都不是时输出base64
+func DecodeRaw(data []byte) ([]byte, error) {
+	obj, err := decodeRaw(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(obj)
+}
+
+func decodeRaw(data []byte, depth int) (*object, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("protobuf消息嵌套超过%d层", maxDepth)
+	}
+	obj := newObject()
+	err := readFields(data, func(f field) error {
+		key := strconv.Itoa(int(f.num)) + ":" + wireTypeNames[f.wireType]
+		switch f.wireType {
+		case wireVarint, wireFixed64:
+			obj.add(key, rawInteger(f.varint))
+		case wireFixed32:
+			obj.add(key, uint32(f.varint))
+		case wireBytes:
+			obj.add(key, rawBytes(f.bytes, depth))
+		case wireStartGroup:
+			group, err := decodeRaw(f.bytes, depth+1)
+			if err != nil {
+				return err
+			}
+			obj.add(key, group)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// 超过JSON安全整数范围时输出为字符串
+func rawInteger(v uint64) interface{} {
+	if v > maxSafeInteger {
+		return strconv.FormatUint(v, 10)
+	}
+
+	return v
+}
+
+// 无法区分string、bytes、嵌套消息, 可打印字符串优先, 短字符串也常能按消息解析
+func rawBytes(b []byte, depth int) interface{} {
+	if isPrintable(b) {
+		return string(b)
+	}
+	if len(b) > 0 {
+		if msg, err := decodeRaw(b, depth+1); err == nil {
+			return msg
+		}
+	}
+
+	return b
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,162 @@
+package protobuf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Method gRPC方法
+type Method struct {
+	// Service 服务全名, 含包名
+	Service string
+	// Name 方法名
+	Name string
+	// Input 请求消息类型全名
+	Input string
+	// Output 响应消息类型全名
+	Output string
+}
+
+// Registry 从描述文件加载的消息类型、gRPC方法及URL映射, 启动时加载, 之后只读
+type Registry struct {
+	messages map[string]*descriptor.DescriptorProto
+	enums    map[string]map[int32]string
+	methods  map[string]*Method
+	mappings []*Mapping
+}
+
+// NewRegistry 创建Registry
+func NewRegistry() *Registry {
+	r := &Registry{
+		messages: make(map[string]*descriptor.DescriptorProto),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]*Method),
+	}
+
+	return r
+}
+
+// LoadDescriptorSet 加载FileDescriptorSet, 可由 protoc --include_imports --descriptor_set_out 生成
+func (r *Registry) LoadDescriptorSet(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	set := &descriptor.FileDescriptorSet{}
+	err = proto.Unmarshal(data, set)
+	if err != nil {
+		return fmt.Errorf("解析FileDescriptorSet错误: [%s] %s", filename, err)
+	}
+	for _, file := range set.GetFile() {
+		r.addFile(file)
+	}
+
+	return nil
+}
+
+// LoadProtoDir 调用protoc编译目录下所有.proto文件后加载, 需要PATH中有protoc
+func (r *Registry) LoadProtoDir(dir string) error {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".proto" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("目录中没有.proto文件: %s", dir)
+	}
+
+	out, err := ioutil.TempFile("", "mars-*.protoset")
+	if err != nil {
+		return err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := append([]string{"--include_imports", "--descriptor_set_out=" + out.Name(), "-I" + dir}, files...)
+	output, err := exec.Command("protoc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("protoc编译.proto文件错误: %s %s", err, bytes.TrimSpace(output))
+	}
+
+	return r.LoadDescriptorSet(out.Name())
+}
+
+// Method 获取gRPC方法, 未加载时返回nil
+func (r *Registry) Method(service, name string) *Method {
+	if r == nil {
+		return nil
+	}
+
+	return r.methods[service+"/"+name]
+}
+
+// 添加文件中的消息类型、枚举及服务
+func (r *Registry) addFile(file *descriptor.FileDescriptorProto) {
+	prefix := file.GetPackage()
+	for _, msg := range file.GetMessageType() {
+		r.addMessage(prefix, msg)
+	}
+	for _, enum := range file.GetEnumType() {
+		r.addEnum(prefix, enum)
+	}
+	for _, svc := range file.GetService() {
+		service := fullName(prefix, svc.GetName())
+		for _, m := range svc.GetMethod() {
+			r.methods[service+"/"+m.GetName()] = &Method{
+				Service: service,
+				Name:    m.GetName(),
+				Input:   strings.TrimPrefix(m.GetInputType(), "."),
+				Output:  strings.TrimPrefix(m.GetOutputType(), "."),
+			}
+		}
+	}
+}
+
+func (r *Registry) addMessage(prefix string, msg *descriptor.DescriptorProto) {
+	name := fullName(prefix, msg.GetName())
+	r.messages[name] = msg
+	for _, nested := range msg.GetNestedType() {
+		r.addMessage(name, nested)
+	}
+	for _, enum := range msg.GetEnumType() {
+		r.addEnum(name, enum)
+	}
+}
+
+func (r *Registry) addEnum(prefix string, enum *descriptor.EnumDescriptorProto) {
+	values := make(map[int32]string, len(enum.GetValue()))
+	for _, v := range enum.GetValue() {
+		values[v.GetNumber()] = v.GetName()
+	}
+	r.enums[fullName(prefix, enum.GetName())] = values
+}
+
+// 消息类型全名, 不含开头的"."
+func fullName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
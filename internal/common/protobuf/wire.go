@@ -0,0 +1,147 @@
+// Package protobuf 解码protobuf消息及gRPC body, 有描述文件时按消息类型解码, 否则按字段编号和线路类型解码
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 线路类型
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+const (
+	// 嵌套消息最大解码深度
+	maxDepth = 64
+	// 最大字段编号
+	maxFieldNumber = 1<<29 - 1
+)
+
+var errTruncated = errors.New("protobuf数据不完整")
+
+// field 一个字段的原始数据
+type field struct {
+	num      int32
+	wireType int
+	// varint wireVarint、wireFixed32、wireFixed64的值
+	varint uint64
+	// bytes wireBytes的内容, wireStartGroup时为group内的字段
+	bytes []byte
+}
+
+// 读取varint, 返回值及占用的字节数
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+
+	return 0, 0, errTruncated
+}
+
+// 读取一个字段, 返回剩余数据
+func nextField(b []byte) (field, []byte, error) {
+	var f field
+	tag, n, err := readVarint(b)
+	if err != nil {
+		return f, nil, err
+	}
+	b = b[n:]
+	if tag>>3 == 0 || tag>>3 > maxFieldNumber {
+		return f, nil, fmt.Errorf("protobuf字段编号错误: %d", tag>>3)
+	}
+	f.num = int32(tag >> 3)
+	f.wireType = int(tag & 7)
+	switch f.wireType {
+	case wireVarint:
+		f.varint, n, err = readVarint(b)
+		if err != nil {
+			return f, nil, err
+		}
+		b = b[n:]
+	case wireFixed64:
+		if len(b) < 8 {
+			return f, nil, errTruncated
+		}
+		f.varint = binary.LittleEndian.Uint64(b)
+		b = b[8:]
+	case wireFixed32:
+		if len(b) < 4 {
+			return f, nil, errTruncated
+		}
+		f.varint = uint64(binary.LittleEndian.Uint32(b))
+		b = b[4:]
+	case wireBytes:
+		var l uint64
+		l, n, err = readVarint(b)
+		if err != nil {
+			return f, nil, err
+		}
+		b = b[n:]
+		if uint64(len(b)) < l {
+			return f, nil, errTruncated
+		}
+		f.bytes = b[:l]
+		b = b[l:]
+	case wireStartGroup:
+		f.bytes, b, err = readGroup(b, f.num)
+		if err != nil {
+			return f, nil, err
+		}
+	case wireEndGroup:
+	default:
+		return f, nil, fmt.Errorf("protobuf线路类型错误: %d", f.wireType)
+	}
+
+	return f, b, nil
+}
+
+// 读取group内容直到对应的结束标记
+func readGroup(b []byte, num int32) ([]byte, []byte, error) {
+	rest := b
+	for len(rest) > 0 {
+		f, next, err := nextField(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f.wireType == wireEndGroup {
+			if f.num != num {
+				return nil, nil, fmt.Errorf("protobuf group结束标记不匹配: %d", f.num)
+			}
+			return b[:len(b)-len(rest)], next, nil
+		}
+		rest = next
+	}
+
+	return nil, nil, errTruncated
+}
+
+// 依次读取消息中的字段
+func readFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		f, rest, err := nextField(b)
+		if err != nil {
+			return err
+		}
+		if f.wireType == wireEndGroup {
+			return fmt.Errorf("protobuf group结束标记不匹配: %d", f.num)
+		}
+		err = fn(f)
+		if err != nil {
+			return err
+		}
+		b = rest
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package recorder
+
+import (
+	"net"
+	"time"
+
+	"mars/goproxy"
+)
+
+const blockedErr = "请求被过滤规则或拦截器中断"
+
+// NewBlockedTransaction 请求在Recorder之前被过滤规则或拦截器中断时, 记录中断时的请求
+func NewBlockedTransaction(ctx *goproxy.Context) *Transaction {
+	tx := NewTransaction()
+	tx.ClientIP, _, _ = net.SplitHostPort(ctx.Req.RemoteAddr)
+	if ctx.User != nil {
+		tx.User = ctx.User.Name
+	}
+	tx.StartTime = time.Now()
+	tx.DumpRequest(ctx.Req)
+	tx.block()
+
+	return tx
+}
+
+// 标记为已中断, 没有响应
+func (tx *Transaction) block() {
+	tx.Blocked = true
+	tx.Resp.Err = blockedErr
+	if !tx.StartTime.IsZero() {
+		tx.Duration = time.Now().Sub(tx.StartTime)
+	}
+}
@@ -2,6 +2,7 @@ package recorder
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 )
@@ -12,6 +13,10 @@ type Body struct {
 	Len         int    `json:"len"`
 	ContentType string `json:"content_type"`
 	Content     []byte `json:"content"`
+	// Decoded 解码后的JSON, 如gRPC消息, 原始内容仍在Content中用于回放
+	Decoded json.RawMessage `json:"decoded,omitempty"`
+	// DecodeErr 解码错误
+	DecodeErr string `json:"decode_err,omitempty"`
 }
 
 // NewBody 创建Body
@@ -29,6 +34,15 @@ func (b *Body) setContent(contentType string, content []byte) {
 	b.ContentType = contentType
 }
 
+// 设置解码结果
+func (b *Body) setDecoded(decoded []byte, err error) {
+	b.Decoded = decoded
+	b.DecodeErr = ""
+	if err != nil {
+		b.DecodeErr = err.Error()
+	}
+}
+
 // body内容封装成ReadCloser
 func (b *Body) readCloser() io.ReadCloser {
 	return ioutil.NopCloser(bytes.NewReader(b.Content))
@@ -0,0 +1,30 @@
+package recorder
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"mars/goproxy"
+)
+
+// NewDeniedTransaction 客户端IP不允许使用代理时, 记录被拒绝的请求, 不读取请求body
+func NewDeniedTransaction(ctx *goproxy.Context) *Transaction {
+	tx := NewTransaction()
+	tx.Type = TransactionTypeDenied
+	tx.ClientIP, _, _ = net.SplitHostPort(ctx.Req.RemoteAddr)
+	tx.StartTime = time.Now()
+
+	tx.Req.Method = ctx.Req.Method
+	tx.Req.Proto = ctx.Req.Proto
+	tx.Req.Host = ctx.Req.Host
+	tx.Req.Path = ctx.Req.URL.Path
+	tx.Req.URL = ctx.Req.URL.String()
+	tx.Req.Header = goproxy.CloneHeader(ctx.Req.Header)
+	// 代理认证信息不保存
+	tx.Req.Header.Del("Proxy-Authorization")
+	tx.Resp.StatusCode = http.StatusForbidden
+	tx.Resp.Err = "客户端IP不允许使用代理"
+
+	return tx
+}
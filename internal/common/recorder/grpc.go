@@ -0,0 +1,71 @@
+package recorder
+
+import (
+	"fmt"
+	"net/http"
+
+	"mars/internal/common/protobuf"
+)
+
+// GRPC gRPC调用信息, 由请求path解析
+type GRPC struct {
+	// Service 服务全名, 含包名
+	Service string `json:"service"`
+	// Method 方法名
+	Method string `json:"method"`
+}
+
+// 识别gRPC请求, 转发请求body时复制, 读取结束后按描述文件解码请求消息
+func (r *Recorder) streamGRPCRequest(req *http.Request, tx *Transaction) {
+	if !protobuf.IsGRPC(tx.Req.Body.ContentType) {
+		return
+	}
+	var msgType string
+	service, method, ok := protobuf.SplitMethod(tx.Req.Path)
+	if ok {
+		tx.GRPC = &GRPC{Service: service, Method: method}
+		if m := r.registry.Method(service, method); m != nil {
+			msgType = m.Input
+		}
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	body := tx.Req.Body
+	encoding := tx.Req.Header.Get("Grpc-Encoding")
+	req.Body = tx.stream(req.Body, func(content []byte, n int) {
+		r.decodeGRPC(body, encoding, msgType, content, n)
+	})
+}
+
+// 转发gRPC响应body时复制, 读取结束后按描述文件解码响应消息
+func (r *Recorder) streamGRPCResponse(resp *http.Response, tx *Transaction) {
+	if tx.Resp.Err != "" || !protobuf.IsGRPC(tx.Resp.Body.ContentType) || resp.Body == nil {
+		return
+	}
+	var msgType string
+	if tx.GRPC != nil {
+		if m := r.registry.Method(tx.GRPC.Service, tx.GRPC.Method); m != nil {
+			msgType = m.Output
+		}
+	}
+	body := tx.Resp.Body
+	encoding := tx.Resp.Header.Get("Grpc-Encoding")
+	resp.Body = tx.stream(resp.Body, func(content []byte, n int) {
+		r.decodeGRPC(body, encoding, msgType, content, n)
+	})
+}
+
+// 设置复制的body内容, 有消息类型时解码, 超过记录上限的body不完整, 不解码
+func (r *Recorder) decodeGRPC(body *Body, encoding, msgType string, content []byte, n int) {
+	body.setContent(body.ContentType, content)
+	body.Len = n
+	if msgType == "" {
+		return
+	}
+	if n > len(content) {
+		body.setDecoded(nil, fmt.Errorf("body长度%d超过%d字节, 只记录了前%d字节, 未解码", n, maxStreamBodySize, len(content)))
+		return
+	}
+	body.setDecoded(r.registry.DecodeGRPC(body.ContentType, encoding, msgType, content))
+}
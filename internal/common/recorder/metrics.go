@@ -0,0 +1,24 @@
+package recorder
+
+import (
+	"strconv"
+
+	"mars/internal/common/metrics"
+)
+
+// 记录请求、隧道的运行指标
+func observe(tx *Transaction) {
+	if tx.Type == TransactionTypeTunnel {
+		if tx.Tunnel == nil {
+			return
+		}
+		metrics.Tunnels.WithLabelValues(tx.Tunnel.CloseReason).Inc()
+		metrics.TunnelBytes.WithLabelValues("sent").Add(float64(tx.Tunnel.BytesSent))
+		metrics.TunnelBytes.WithLabelValues("received").Add(float64(tx.Tunnel.BytesReceived))
+		return
+	}
+	metrics.Requests.WithLabelValues(tx.Req.Method, strconv.Itoa(tx.Resp.StatusCode)).Inc()
+	if tx.Resp.Err == "" && tx.Duration > 0 {
+		metrics.UpstreamDuration.WithLabelValues().Observe(tx.Duration.Seconds())
+	}
+}
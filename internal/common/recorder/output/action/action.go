@@ -16,7 +16,8 @@ const (
 	TypeResponseReplay      message.Type = 2001
 	TypeResponseTransaction message.Type = 2002
 
-	TypePushTransaction message.Type = 3000
+	TypePushTransaction    message.Type = 3000
+	TypePushWebSocketFrame message.Type = 3001
 )
 
 type Empty struct {
@@ -41,6 +42,8 @@ type ResponseTransaction struct {
 
 type PushTransaction struct {
 	Id string `json:"id"`
+	// Type 类型, http、tunnel
+	Type string `json:"type"`
 	// Method 请求方法
 	Method string `json:"method"`
 	// Host 请求主机名
@@ -49,6 +52,8 @@ type PushTransaction struct {
 	Path string `json:"path"`
 	// Duration 耗时
 	Duration time.Duration `json:"duration"`
+	// User 代理认证用户名
+	User string `json:"user"`
 	// ResponseStatusCode 响应状态码
 	ResponseStatusCode int `json:"response_status_code"`
 	// Err 错误信息
@@ -57,4 +62,16 @@ type PushTransaction struct {
 	ResponseContentType string `json:"response_content_type"`
 	// ResponseLen 响应长度
 	ResponseLen int `json:"response_len"`
+	// GRPCService gRPC服务全名, 仅gRPC请求有值
+	GRPCService string `json:"grpc_service,omitempty"`
+	// GRPCMethod gRPC方法名
+	GRPCMethod string `json:"grpc_method,omitempty"`
+	// Tunnel 隧道信息, 仅隧道有值
+	Tunnel *recorder.Tunnel `json:"tunnel,omitempty"`
+}
+
+type PushWebSocketFrame struct {
+	// TxId WebSocket握手对应的transaction id
+	TxId string `json:"tx_id"`
+	*recorder.WebSocketFrame
 }
@@ -48,6 +48,9 @@ func (c *Console) writeRequest(tx *recorder.Transaction) {
 	c.builder.WriteString("  ")
 	c.builder.WriteString(tx.Req.URL)
 	c.builder.WriteString("\n")
+	if tx.GRPC != nil {
+		c.builder.WriteString(fmt.Sprintf("gRPC: %s/%s\n", tx.GRPC.Service, tx.GRPC.Method))
+	}
 	c.builder.WriteString("Server-IP: ")
 	c.builder.WriteString(tx.ServerIP)
 	c.builder.WriteString("\n")
@@ -57,8 +60,7 @@ func (c *Console) writeRequest(tx *recorder.Transaction) {
 		c.builder.WriteString(strings.Join(values, ";"))
 		c.builder.WriteString("\n")
 	}
-	if !tx.Req.Body.IsBinary {
-		c.builder.Write(tx.Req.Body.Content)
+	if c.writeBody(tx.Req.Body) {
 		c.builder.WriteString("\n")
 	}
 }
@@ -76,7 +78,21 @@ func (c *Console) writeResponse(tx *recorder.Transaction) {
 		c.builder.WriteString(strings.Join(values, ";"))
 		c.builder.WriteString("\n")
 	}
-	if !tx.Resp.Body.IsBinary {
-		c.builder.Write(tx.Resp.Body.Content)
+	c.writeBody(tx.Resp.Body)
+}
+
+// 优先输出解码后的内容, 二进制内容不输出, 返回是否有输出
+func (c *Console) writeBody(body *recorder.Body) bool {
+	switch {
+	case body.Decoded != nil:
+		c.builder.Write(body.Decoded)
+	case body.DecodeErr != "":
+		c.builder.WriteString(body.DecodeErr)
+	case !body.IsBinary:
+		c.builder.Write(body.Content)
+	default:
+		return false
 	}
+
+	return true
 }
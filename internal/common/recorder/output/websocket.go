@@ -1,6 +1,8 @@
 package output
 
 import (
+	"context"
+
 	"mars/internal/common/recorder"
 	"mars/internal/common/recorder/output/action"
 	"mars/internal/common/socket"
@@ -52,10 +54,17 @@ func (w *WebSocket) OnError(session *socket.Session, err error) {
 func (w *WebSocket) Write(tx *recorder.Transaction) error {
 	push := &action.PushTransaction{
 		Id:       tx.Id,
+		Type:     tx.Type,
 		Method:   tx.Req.Method,
 		Host:     tx.Req.Host,
 		Path:     tx.Req.Path,
 		Duration: tx.Duration,
+		User:     tx.User,
+		Tunnel:   tx.Tunnel,
+	}
+	if tx.GRPC != nil {
+		push.GRPCService = tx.GRPC.Service
+		push.GRPCMethod = tx.GRPC.Method
 	}
 	if tx.Resp.Err != "" {
 		push.ResponseErr = tx.Resp.Err
@@ -69,6 +78,32 @@ func (w *WebSocket) Write(tx *recorder.Transaction) error {
 	return nil
 }
 
+// Shutdown 发送完待推送的消息后关闭所有WebSocket连接
+func (w *WebSocket) Shutdown(ctx context.Context) {
+	w.hub.Shutdown(ctx)
+}
+
+// SessionNum WebSocket连接数
+func (w *WebSocket) SessionNum() int32 {
+	return w.hub.Num()
+}
+
+// DroppedMessages 未能推送的消息数
+func (w *WebSocket) DroppedMessages() uint64 {
+	return w.hub.Dropped()
+}
+
+// WriteWebSocketFrame WebSocket帧写入WebSocket
+func (w *WebSocket) WriteWebSocketFrame(tx *recorder.Transaction, frame *recorder.WebSocketFrame) error {
+	push := &action.PushWebSocketFrame{
+		TxId:           tx.Id,
+		WebSocketFrame: frame,
+	}
+	w.broadcast(action.TypePushWebSocketFrame, push)
+
+	return nil
+}
+
 // 发送消息
 func (w *WebSocket) sendMessage(session *socket.Session, msgType message.Type, payload interface{}) {
 	data, err := w.marshalMessage(msgType, payload)
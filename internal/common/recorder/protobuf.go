@@ -0,0 +1,47 @@
+package recorder
+
+import (
+	"mars/internal/common/protobuf"
+)
+
+// 解码protobuf请求body
+func (r *Recorder) decodeProtobufRequest(tx *Transaction) {
+	var msgType string
+	if m := r.registry.Match(tx.Req.Host + tx.Req.Path); m != nil {
+		msgType = m.Request
+	}
+	r.decodeProtobuf(tx.Req.Body, msgType)
+}
+
+// 解码protobuf响应body
+func (r *Recorder) decodeProtobufResponse(tx *Transaction) {
+	if tx.Resp.Err != "" {
+		return
+	}
+	var msgType string
+	if m := r.registry.Match(tx.Req.Host + tx.Req.Path); m != nil {
+		msgType = m.Response
+	}
+	r.decodeProtobuf(tx.Resp.Body, msgType)
+}
+
+// URL有映射时按消息类型解码, 未映射或解码失败时按字段编号和线路类型解码
+func (r *Recorder) decodeProtobuf(body *Body, msgType string) {
+	if !protobuf.IsProtobuf(body.ContentType) || len(body.Content) == 0 {
+		return
+	}
+	if msgType != "" {
+		decoded, err := r.registry.Decode(msgType, body.Content)
+		if err == nil {
+			body.setDecoded(decoded, nil)
+			return
+		}
+		raw, rawErr := protobuf.DecodeRaw(body.Content)
+		if rawErr != nil {
+			raw = nil
+		}
+		body.setDecoded(raw, err)
+		return
+	}
+	body.setDecoded(protobuf.DecodeRaw(body.Content))
+}
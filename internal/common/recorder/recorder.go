@@ -1,6 +1,7 @@
 package recorder
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,6 +10,8 @@ import (
 	"time"
 
 	"mars/goproxy"
+	"mars/internal/common/metrics"
+	"mars/internal/common/protobuf"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,38 +27,15 @@ type Output interface {
 	Write(*Transaction) error
 }
 
-// Interceptor 拦截器
-type Interceptor interface {
-	// // Connect 收到客户端连接, 自定义response返回, 只支持HTTP
-	// Connect(ctx *goproxy.Context, rw http.ResponseWriter)
-	// // BeforeRequest 请求发送前, 修改request
-	// BeforeRequest(ctx *goproxy.Context)
-	// // BeforeResponse 响应发送前, 修改response
-	// BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error)
-	// Connect 收到客户端连接
-	Connect(ctx *goproxy.Context, rw http.ResponseWriter)
-	// Auth 代理身份认证
-	Auth(ctx *goproxy.Context, rw http.ResponseWriter)
-	// BeforeRequest HTTP请求前 设置X-Forwarded-For, 修改Header、Body
-	BeforeRequest(ctx *goproxy.Context)
-	// BeforeResponse 响应发送到客户端前, 修改Header、Body、Status Code
-	BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error)
-	// ParentProxy 上级代理
-	ParentProxy(*http.Request) (*url.URL, error)
-	// Finish 本次请求结束
-	Finish(ctx *goproxy.Context)
-	// 记录错误信息
-	ErrorLog(err error)
-}
-
 // Recorder 记录http transaction
 //proxy := goproxy.New(goproxy.WithDelegate(&EventHandler{}))
 type Recorder struct {
-	proxy       *goproxy.Proxy //  proxy := goproxy.New(goproxy.WithDelegate(&EventHandler{}))
-	storage     Storage
-	output      Output
-	interceptor Interceptor
-	// Delegate    *goproxy.Delegate
+	goproxy.NopDelegate
+	proxy   *goproxy.Proxy //  proxy := goproxy.New(goproxy.WithDelegate(&EventHandler{}))
+	storage Storage
+	output  Output
+	// 解码gRPC、protobuf消息的描述文件, 为nil时gRPC只记录服务名和方法名, protobuf按字段编号解码
+	registry *protobuf.Registry
 }
 
 // NewRecorder 创建recorder
@@ -82,9 +62,9 @@ func (r *Recorder) SetOutput(o Output) {
 	r.output = o
 }
 
-// SetInterceptor 设置拦截器
-func (r *Recorder) SetInterceptor(i Interceptor) {
-	r.interceptor = i
+// SetProtobufRegistry 设置解码gRPC、protobuf消息的描述文件及URL映射
+func (r *Recorder) SetProtobufRegistry(registry *protobuf.Registry) {
+	r.registry = registry
 }
 
 // Storage 获取存储
@@ -92,16 +72,6 @@ func (r *Recorder) Storage() Storage {
 	return r.storage
 }
 
-// Connect 收到客户端连接
-func (r *Recorder) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
-	if r.interceptor != nil {
-		r.interceptor.Connect(ctx, rw)
-	}
-}
-
-// Auth 代理身份认证
-func (r *Recorder) Auth(ctx *goproxy.Context, rw http.ResponseWriter) {}
-
 // BeforeRequest 请求发送前处理
 func (r *Recorder) BeforeRequest(ctx *goproxy.Context) {
 	if host := ctx.Req.Header.Get("X-Mars-Host"); host != "" {
@@ -109,18 +79,30 @@ func (r *Recorder) BeforeRequest(ctx *goproxy.Context) {
 	}
 	ctx.Req.Header.Del("X-Mars-Host")
 	ctx.Req.Header.Del("X-Mars-Debug")
-	if r.interceptor != nil {
-		r.interceptor.BeforeRequest(ctx)
-	}
 	tx := NewTransaction()
 	tx.ClientIP, _, _ = net.SplitHostPort(ctx.Req.RemoteAddr)
+	if ctx.User != nil {
+		tx.User = ctx.User.Name
+	}
+	if ctx.Req.TLS != nil {
+		tx.Protocol = ctx.Req.TLS.NegotiatedProtocol
+		if tx.Protocol == "" {
+			tx.Protocol = "http/1.1"
+		}
+	}
 	tx.StartTime = time.Now()
 
 	tx.DumpRequest(ctx.Req)
+	r.streamGRPCRequest(ctx.Req, tx)
+	r.decodeProtobufRequest(tx)
 
 	trace := &httptrace.ClientTrace{
 		GotConn: func(info httptrace.GotConnInfo) {
 			tx.ServerIP, _, _ = net.SplitHostPort(info.Conn.RemoteAddr().String())
+			tx.ConnReused = info.Reused
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			tx.UpstreamTLS = newUpstreamTLS(state, err)
 		},
 	}
 	ctx.Req = ctx.Req.WithContext(httptrace.WithClientTrace(ctx.Req.Context(), trace))
@@ -130,13 +112,44 @@ func (r *Recorder) BeforeRequest(ctx *goproxy.Context) {
 
 // BeforeResponse 响应发送前处理
 func (r *Recorder) BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error) {
-	if r.interceptor != nil {
-		r.interceptor.BeforeResponse(ctx, resp, err)
-	}
 	tx := ctx.Data["tx"].(*Transaction)
 	tx.Duration = time.Now().Sub(tx.StartTime)
+	tx.Synthetic = ctx.IsResponded()
+	if ctx.Fault != nil {
+		tx.Fault = &Fault{Type: ctx.Fault.Type, Rule: ctx.Fault.Rule}
+	}
+
+	if tx.UpstreamTLS == nil && err == nil && resp.TLS != nil {
+		// 重用连接时没有TLS握手, 使用响应中的连接信息
+		tx.UpstreamTLS = newUpstreamTLS(*resp.TLS, nil)
+	}
 
 	tx.DumpResponse(resp, err)
+	r.streamGRPCResponse(resp, tx)
+	r.decodeProtobufResponse(tx)
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		// WebSocket连接可能持续很久, 握手成功即保存输出, 连接结束时再保存帧记录
+		r.store(ctx, tx)
+		r.write(ctx, tx)
+	}
+}
+
+// WebSocketFrame 记录WebSocket帧
+func (r *Recorder) WebSocketFrame(ctx *goproxy.Context, frame *goproxy.WebSocketFrame) {
+	tx, ok := ctx.Data["tx"].(*Transaction)
+	if !ok {
+		return
+	}
+	f := newWebSocketFrame(frame)
+	if !tx.addWebSocketFrame(f) {
+		return
+	}
+	if o, ok := r.output.(FrameOutput); ok {
+		err := o.WriteWebSocketFrame(tx, f)
+		if err != nil {
+			log.Warnf("WebSocket#输出帧错误: [%s] %s", ctx.Req.URL.String(), err)
+		}
+	}
 }
 
 // ParentProxy 设置上级代理
@@ -146,20 +159,61 @@ func (r *Recorder) ParentProxy(req *http.Request) (*url.URL, error) {
 
 // Finish 请求结束
 func (r *Recorder) Finish(ctx *goproxy.Context) {
+	if ctx.Denied {
+		tx := NewDeniedTransaction(ctx)
+		r.store(ctx, tx)
+		r.write(ctx, tx)
+		return
+	}
 	value, ok := ctx.Data["tx"]
 	if !ok {
+		var tx *Transaction
+		switch {
+		case ctx.Blocked:
+			// 在Recorder之前被中断, 没有经过BeforeRequest
+			tx = NewBlockedTransaction(ctx)
+		case ctx.Tunnel != nil:
+			// 未解密的隧道没有经过BeforeRequest
+			tx = NewTunnelTransaction(ctx)
+		default:
+			return
+		}
+		observe(tx)
+		r.store(ctx, tx)
+		r.write(ctx, tx)
 		return
 	}
 	tx, ok := value.(*Transaction)
 	if !ok {
 		return
 	}
+	if ctx.Blocked && !tx.Blocked {
+		// 在BeforeResponse中被中断, 没有经过Recorder的BeforeResponse
+		tx.block()
+	}
+	// 响应已转发完, 仍未读完的流式body只记录已读取的部分
+	tx.finishStreams()
+	observe(tx)
+	r.store(ctx, tx)
+	if !tx.written {
+		r.write(ctx, tx)
+	}
+}
+
+// 保存transaction
+func (r *Recorder) store(ctx *goproxy.Context, tx *Transaction) {
 	if r.storage != nil {
 		err := r.storage.Put(tx)
 		if err != nil {
+			metrics.StoragePutErrors.WithLabelValues().Inc()
 			log.Warnf("请求结束#保存transaction错误: [%s] %s", ctx.Req.URL.String(), err)
 		}
 	}
+}
+
+// 输出transaction
+func (r *Recorder) write(ctx *goproxy.Context, tx *Transaction) {
+	tx.written = true
 	if r.output != nil {
 		err := r.output.Write(tx)
 		if err != nil {
@@ -180,6 +234,9 @@ func (r *Recorder) Replay(txId string) error {
 	if err != nil {
 		return fmt.Errorf("回放#获取transaction错误: [txId: %s] %s", txId, err)
 	}
+	if tx.Type == TransactionTypeTunnel || tx.Type == TransactionTypeDenied {
+		return fmt.Errorf("回放#%s类型不支持回放: [txId: %s]", tx.Type, txId)
+	}
 	newReq, err := tx.Req.Restore()
 	if err != nil {
 		return fmt.Errorf("回放#创建请求错误: [txId: %s] %s", txId, err)
@@ -0,0 +1,272 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/stretchr/testify/require"
+
+	"mars/filterrules"
+	"mars/goproxy"
+	"mars/goproxy/cert"
+	"mars/internal/common"
+	"mars/internal/common/protobuf"
+)
+
+// memOutput 输出到channel
+type memOutput struct {
+	txs chan *Transaction
+}
+
+func (o *memOutput) Write(tx *Transaction) error {
+	o.txs <- tx
+
+	return nil
+}
+
+func newMemOutput() *memOutput {
+	return &memOutput{txs: make(chan *Transaction, 10)}
+}
+
+// abortResponseDelegate 在BeforeResponse中中断请求
+type abortResponseDelegate struct {
+	goproxy.NopDelegate
+}
+
+func (d *abortResponseDelegate) BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error) {
+	if ctx.Req.URL.Path == "/abort-response" {
+		ctx.Abort()
+	}
+}
+
+func TestRecordBlocked(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	r := NewRecorder()
+	out := newMemOutput()
+	r.SetOutput(out)
+	chain := goproxy.Chain{&goproxy.RulesDelegate{}, &abortResponseDelegate{}, r}
+	p := goproxy.New(goproxy.WithDelegates(chain...))
+	rules := &filterrules.Rules{Hostlist: []string{`/blocked`}}
+	do := func(path string) *Transaction {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+path, nil)
+		ctx := &goproxy.Context{Req: req, User: &goproxy.User{Name: "mars", Rules: rules}}
+		p.DoRequest(ctx, func(resp *http.Response, err error) {
+			require.NoError(t, err)
+			resp.Body.Close()
+		})
+		chain.Finish(ctx)
+		return <-out.txs
+	}
+
+	// 过滤规则屏蔽的请求没有经过Recorder的BeforeRequest, 在Finish中记录
+	tx := do("/blocked")
+	require.True(t, tx.Blocked)
+	require.Equal(t, TransactionTypeHTTP, tx.Type)
+	require.Equal(t, "/blocked", tx.Req.Path)
+	require.Equal(t, "mars", tx.User)
+	require.Equal(t, blockedErr, tx.Resp.Err)
+
+	// 拦截器在BeforeResponse中中断, 请求已记录, 没有响应
+	tx = do("/abort-response")
+	require.True(t, tx.Blocked)
+	require.Equal(t, "/abort-response", tx.Req.Path)
+	require.Zero(t, tx.Resp.StatusCode)
+	require.Equal(t, blockedErr, tx.Resp.Err)
+
+	tx = do("/ok")
+	require.False(t, tx.Blocked)
+	require.Equal(t, http.StatusOK, tx.Resp.StatusCode)
+	require.Equal(t, "hello", string(tx.Resp.Body.Content))
+}
+
+// 重用连接时没有TLS握手, 仍记录与服务端的TLS信息
+func TestRecordConnReused(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	r := NewRecorder()
+	out := newMemOutput()
+	r.SetOutput(out)
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.CloseIdleConnections()
+	p := goproxy.New(goproxy.WithDelegate(r), goproxy.WithTransport(transport))
+	do := func() *Transaction {
+		ctx := &goproxy.Context{Req: httptest.NewRequest(http.MethodGet, upstream.URL+"/", nil)}
+		p.DoRequest(ctx, func(resp *http.Response, err error) {
+			require.NoError(t, err)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		})
+		r.Finish(ctx)
+		return <-out.txs
+	}
+
+	for i, reused := range []bool{false, true} {
+		tx := do()
+		require.Equal(t, reused, tx.ConnReused, i)
+		require.NotNil(t, tx.UpstreamTLS, i)
+		require.Equal(t, TLSVerifySkipped, tx.UpstreamTLS.Verify)
+		require.NotEmpty(t, tx.UpstreamTLS.Version)
+	}
+}
+
+// gRPC消息帧, 消息只有字段1
+func grpcFrame(s string) []byte {
+	msg := append([]byte{0x0a, byte(len(s))}, s...)
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+
+	return append(frame, msg...)
+}
+
+// demo.proto: Greeter.SayHello(HelloRequest{name}) returns (stream HelloReply{msg})
+func loadTestRegistry(t *testing.T) *protobuf.Registry {
+	field := func(name string) []*descriptor.FieldDescriptorProto {
+		return []*descriptor.FieldDescriptorProto{{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(1),
+			Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+		}}
+	}
+	file := &descriptor.FileDescriptorProto{
+		Name:    proto.String("demo.proto"),
+		Package: proto.String("demo"),
+		MessageType: []*descriptor.DescriptorProto{
+			{Name: proto.String("HelloRequest"), Field: field("name")},
+			{Name: proto.String("HelloReply"), Field: field("msg")},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptor.MethodDescriptorProto{{
+				Name:            proto.String("SayHello"),
+				InputType:       proto.String(".demo.HelloRequest"),
+				OutputType:      proto.String(".demo.HelloReply"),
+				ServerStreaming: proto.Bool(true),
+			}},
+		}},
+	}
+	data, err := proto.Marshal(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{file}})
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "mars_protoset")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	require.NoError(t, err)
+	registry := protobuf.NewRegistry()
+	require.NoError(t, registry.LoadDescriptorSet(f.Name()))
+
+	return registry
+}
+
+// 服务端流式响应经HTTP/2解密转发时边收边转发, 转发结束后解码全部消息
+func TestRecordGRPCStream(t *testing.T) {
+	ca, key, err := cert.LoadCA("../../../conf/private/base.key.pem", "../../../conf/private/ca.key.pem")
+	require.NoError(t, err)
+	cert.RootCA, cert.RootKey = ca, key
+
+	next := make(chan struct{})
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcFrame("first"))
+		w.(http.Flusher).Flush()
+		// 客户端收到第一个消息后才发送第二个消息
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write(grpcFrame("second"))
+	}))
+	defer upstream.Close()
+
+	r := NewRecorder()
+	out := newMemOutput()
+	r.SetOutput(out)
+	r.SetProtobufRegistry(loadTestRegistry(t))
+	p := goproxy.New(
+		goproxy.WithDecryptHTTPS(NewCertCache(common.NewQueue(10))),
+		goproxy.WithTransport(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}),
+		goproxy.WithDelegates(&goproxy.RulesDelegate{}, r),
+	)
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	proxyURL, err := url.Parse(ps.URL)
+	require.NoError(t, err)
+	// 代理缓冲整个响应时, 上游等待超时前客户端收不到响应
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, upstream.URL+"/demo.Greeter/SayHello", bytes.NewReader(grpcFrame("mars")))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 2, resp.ProtoMajor)
+	first := make([]byte, len(grpcFrame("first")))
+	_, err = io.ReadFull(resp.Body, first)
+	require.NoError(t, err)
+	require.Equal(t, grpcFrame("first"), first)
+	close(next)
+	rest, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, grpcFrame("second"), rest)
+
+	tx := <-out.txs
+	require.Equal(t, "h2", tx.Protocol)
+	require.Equal(t, &GRPC{Service: "demo.Greeter", Method: "SayHello"}, tx.GRPC)
+	require.JSONEq(t, `[{"name":"mars"}]`, string(tx.Req.Body.Decoded))
+	require.Equal(t, append(grpcFrame("first"), grpcFrame("second")...), tx.Resp.Body.Content)
+	require.Equal(t, len(tx.Resp.Body.Content), tx.Resp.Body.Len)
+	require.JSONEq(t, `[{"msg":"first"},{"msg":"second"}]`, string(tx.Resp.Body.Decoded))
+}
+
+func TestStreamBody(t *testing.T) {
+	var calls, total int
+	var content []byte
+	data := bytes.Repeat([]byte("a"), maxStreamBodySize+10)
+	s := newStreamBody(ioutil.NopCloser(bytes.NewReader(data)), func(c []byte, n int) {
+		calls++
+		content, total = c, n
+	})
+	b, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+	require.NoError(t, s.Close())
+	require.Equal(t, 1, calls)
+	require.Len(t, content, maxStreamBodySize)
+	require.Equal(t, len(data), total)
+
+	r := NewRecorder()
+	body := &Body{ContentType: "application/grpc"}
+	r.decodeGRPC(body, "", "demo.HelloReply", content, total)
+	require.Equal(t, len(data), body.Len)
+	require.Nil(t, body.Decoded)
+	require.NotEmpty(t, body.DecodeErr)
+}
@@ -68,3 +68,8 @@ func (l *LevelDB) Put(tx *recorder.Transaction) error {
 
 	return err
 }
+
+// Close 关闭数据库
+func (l *LevelDB) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,81 @@
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// 流式body最多记录的字节数, 与gRPC默认的最大消息长度相同
+const maxStreamBodySize = 4 << 20
+
+// streamBody 转发流式body的同时复制前maxStreamBodySize字节, 不等待读完整个body.
+// 读取结束、关闭或请求结束时回调, 只回调一次, 之后读取的内容只转发不记录
+type streamBody struct {
+	io.ReadCloser
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	n    int
+	done bool
+	// onDone 回调复制的内容及body总长度
+	onDone func(content []byte, n int)
+}
+
+func newStreamBody(rc io.ReadCloser, onDone func(content []byte, n int)) *streamBody {
+	return &streamBody{ReadCloser: rc, onDone: onDone}
+}
+
+// Read 读取body并复制
+func (s *streamBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.mu.Lock()
+	if !s.done && n > 0 {
+		s.n += n
+		if room := maxStreamBodySize - s.buf.Len(); room > 0 {
+			if room > n {
+				room = n
+			}
+			s.buf.Write(p[:room])
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.finish()
+	}
+
+	return n, err
+}
+
+// Close 关闭body
+func (s *streamBody) Close() error {
+	err := s.ReadCloser.Close()
+	s.finish()
+
+	return err
+}
+
+// 停止复制并回调
+func (s *streamBody) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.onDone(s.buf.Bytes(), s.n)
+}
+
+// 转发时复制流式body
+func (tx *Transaction) stream(rc io.ReadCloser, onDone func(content []byte, n int)) io.ReadCloser {
+	s := newStreamBody(rc, onDone)
+	tx.streams = append(tx.streams, s)
+
+	return s
+}
+
+// 请求结束时停止复制, 仍在转发的body只记录已读取的部分
+func (tx *Transaction) finishStreams() {
+	for _, s := range tx.streams {
+		s.finish()
+	}
+}
@@ -4,17 +4,20 @@ package recorder
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gogf/gf/text/gregex"
 	uuid "github.com/satori/go.uuid"
 
 	"mars/goproxy"
+	"mars/internal/common/protobuf"
 )
 
 const (
@@ -28,10 +31,22 @@ var textMimeTypes = []string{
 	"application/x-javascript",
 }
 
+// Transaction 类型
+const (
+	// TransactionTypeHTTP HTTP请求
+	TransactionTypeHTTP = "http"
+	// TransactionTypeTunnel 未解密的隧道
+	TransactionTypeTunnel = "tunnel"
+	// TransactionTypeDenied 客户端IP不允许使用代理, 被拒绝的请求
+	TransactionTypeDenied = "denied"
+)
+
 // Transaction HTTP事务
 type Transaction struct {
 	// Id 唯一id
 	Id string `json:"id"`
+	// Type 类型, TransactionTypeHTTP、TransactionTypeTunnel、TransactionTypeDenied
+	Type string `json:"type"`
 	// Req 请求
 	Req *Request `json:"request"`
 	// Resp 响应
@@ -40,16 +55,98 @@ type Transaction struct {
 	ClientIP string `json:"client_ip"`
 	// ServerIP 服务端IP
 	ServerIP string `json:"server_ip"`
+	// User 代理认证用户名
+	User string `json:"user"`
+	// Protocol 与客户端协商的应用层协议(ALPN), 如h2、http/1.1, 未经TLS为空
+	Protocol string `json:"protocol"`
+	// UpstreamTLS 与服务端的TLS握手信息, 未经TLS时为nil, 重用连接时取自响应的TLS连接状态
+	UpstreamTLS *UpstreamTLS `json:"upstream_tls,omitempty"`
+	// ConnReused 是否重用了与服务端的已有连接, 重用时耗时不含建立TCP、TLS连接的时间
+	ConnReused bool `json:"conn_reused"`
 	// StartTime 开始时间
 	StartTime time.Time `json:"start_time"`
 	// Duration 持续时间
 	Duration time.Duration `json:"duration"`
+	// Tunnel 隧道信息, 仅隧道有值
+	Tunnel *Tunnel `json:"tunnel,omitempty"`
+	// Synthetic 响应由拦截器通过ctx.Respond返回, 未请求上游服务器或替换了上游服务器的响应
+	Synthetic bool `json:"synthetic"`
+	// Blocked 请求被过滤规则或拦截器中断, 没有返回响应
+	Blocked bool `json:"blocked"`
+	// Fault 注入的故障, 未命中故障注入规则时为nil
+	Fault *Fault `json:"fault,omitempty"`
+	// GRPC gRPC调用信息, 仅gRPC请求有值
+	GRPC *GRPC `json:"grpc,omitempty"`
+	// WebSocketFrames WebSocket帧, 仅WebSocket握手有值
+	WebSocketFrames []*WebSocketFrame `json:"websocket_frames,omitempty"`
+	framesMu        sync.Mutex
+	// 转发时复制的流式body
+	streams []*streamBody
+	// 是否已输出, WebSocket握手成功时提前输出
+	written bool
+}
+
+// Fault 注入的故障, 便于对照客户端的表现
+type Fault struct {
+	// Type 故障类型 reset、timeout、truncate或5xx状态码
+	Type string `json:"type"`
+	// Rule 命中规则的url
+	Rule string `json:"rule"`
+}
+
+// 服务端证书校验结果
+const (
+	// TLSVerifyOK 校验通过
+	TLSVerifyOK = "verified"
+	// TLSVerifySkipped 配置跳过校验
+	TLSVerifySkipped = "skipped"
+	// TLSVerifyFailed 握手或校验失败
+	TLSVerifyFailed = "failed"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// UpstreamTLS 与服务端的TLS握手信息
+type UpstreamTLS struct {
+	// Version TLS版本
+	Version string `json:"version"`
+	// ServerName 发送的SNI
+	ServerName string `json:"server_name"`
+	// Verify 证书校验结果
+	Verify string `json:"verify"`
+	// Err 握手错误
+	Err string `json:"err"`
+}
+
+// 根据握手结果创建UpstreamTLS
+func newUpstreamTLS(state tls.ConnectionState, err error) *UpstreamTLS {
+	t := &UpstreamTLS{
+		Version:    tlsVersionNames[state.Version],
+		ServerName: state.ServerName,
+	}
+	switch {
+	case err != nil:
+		t.Verify = TLSVerifyFailed
+		t.Err = err.Error()
+	case len(state.VerifiedChains) == 0:
+		t.Verify = TLSVerifySkipped
+	default:
+		t.Verify = TLSVerifyOK
+	}
+
+	return t
 }
 
 // NewTransaction 创建HTTP事务
 func NewTransaction() *Transaction {
 	tx := &Transaction{
 		Id:   uuid.NewV4().String(),
+		Type: TransactionTypeHTTP,
 		Req:  NewRequest(),
 		Resp: NewResponse(),
 	}
@@ -74,10 +171,15 @@ func (tx *Transaction) DumpRequest(req *http.Request) {
 	tx.Req.Path = req.URL.Path
 	tx.Req.QueryParam = req.URL.RawQuery
 
+	contentType := getContentType(req.Header)
+	if protobuf.IsGRPC(contentType) {
+		// gRPC可能是客户端流或双向流, 不能读完body再转发, 由Recorder在转发时复制
+		tx.Req.Body.setContent(contentType, nil)
+		return
+	}
 	var err error
 	var body []byte
 	req.Body, body, err = goproxy.CloneBody(req.Body)
-	contentType := getContentType(req.Header)
 	tx.Req.Body.setContent(contentType, body)
 	if err != nil {
 		body = []byte(fmt.Sprintf("复制request body错误: %s", err))
@@ -97,6 +199,11 @@ func (tx *Transaction) DumpResponse(resp *http.Response, e error) {
 	tx.Resp.StatusCode = resp.StatusCode
 
 	contentType := getContentType(resp.Header)
+	if protobuf.IsGRPC(contentType) {
+		// gRPC可能是服务端流或双向流, 不能读完body再转发, 由Recorder在转发时复制
+		tx.Resp.Body.setContent(contentType, nil)
+		return
+	}
 	if !shouldReadBody(contentType) {
 		tx.Resp.Body.setContent(contentTypeBinary, nil)
 		return
@@ -156,7 +263,8 @@ func IsBinaryBody(contentType string) bool {
 
 // 是否应该读取Body内容
 func shouldReadBody(contentType string) bool {
-	return strings.HasPrefix(contentType, "image/") || !IsBinaryBody(contentType)
+	return strings.HasPrefix(contentType, "image/") || protobuf.IsProtobuf(contentType) ||
+		!IsBinaryBody(contentType)
 }
 
 // 获取body类型
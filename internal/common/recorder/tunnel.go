@@ -0,0 +1,64 @@
+package recorder
+
+import (
+	"net"
+	"time"
+
+	"mars/goproxy"
+)
+
+// Tunnel 未解密的隧道
+type Tunnel struct {
+	// Target 目标地址 host:port
+	Target string `json:"target"`
+	// ServerName TLS ClientHello中的SNI
+	ServerName string `json:"server_name"`
+	// BytesSent 客户端发往目标的字节数
+	BytesSent int64 `json:"bytes_sent"`
+	// BytesReceived 目标发往客户端的字节数
+	BytesReceived int64 `json:"bytes_received"`
+	// EndTime 结束时间
+	EndTime time.Time `json:"end_time"`
+	// CloseReason 关闭原因
+	CloseReason string `json:"close_reason"`
+	// Err 错误信息
+	Err string `json:"err"`
+}
+
+// NewTunnelTransaction 根据隧道转发结果创建transaction
+func NewTunnelTransaction(ctx *goproxy.Context) *Transaction {
+	stats := ctx.Tunnel
+	tx := NewTransaction()
+	tx.Type = TransactionTypeTunnel
+	tx.ClientIP, _, _ = net.SplitHostPort(ctx.Req.RemoteAddr)
+	tx.ServerIP, _, _ = net.SplitHostPort(stats.ServerAddr)
+	if ctx.User != nil {
+		tx.User = ctx.User.Name
+	}
+	tx.StartTime = stats.StartTime
+	endTime := stats.EndTime
+	// 连接目标成功但未开始转发
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	tx.Duration = endTime.Sub(stats.StartTime)
+
+	target := ctx.Req.URL.Host
+	tx.Req.Method = ctx.Req.Method
+	tx.Req.Proto = ctx.Req.Proto
+	tx.Req.Host = target
+	tx.Req.URL = target
+	tx.Req.Header = goproxy.CloneHeader(ctx.Req.Header)
+	tx.Resp.Err = stats.Err
+	tx.Tunnel = &Tunnel{
+		Target:        target,
+		ServerName:    stats.ServerName,
+		BytesSent:     stats.Sent(),
+		BytesReceived: stats.Received(),
+		EndTime:       endTime,
+		CloseReason:   stats.CloseReason,
+		Err:           stats.Err,
+	}
+
+	return tx
+}
@@ -0,0 +1,78 @@
+package recorder
+
+import (
+	"time"
+
+	"mars/goproxy"
+)
+
+const (
+	// 单帧记录的最大payload长度, 超出部分截断
+	maxRecordFramePayload = 64 << 10
+	// 单个WebSocket连接最多记录的帧数
+	maxRecordFrames = 1000
+)
+
+// WebSocket帧方向
+const (
+	FrameDirectionSend    = "send"
+	FrameDirectionReceive = "receive"
+)
+
+// WebSocketFrame WebSocket帧记录
+type WebSocketFrame struct {
+	// Direction 方向, send: 客户端发往服务端, receive: 服务端发往客户端
+	Direction string `json:"direction"`
+	// Opcode 操作码
+	Opcode int `json:"opcode"`
+	// Time 收到时间
+	Time time.Time `json:"time"`
+	// Len payload实际长度
+	Len int `json:"len"`
+	// Payload 数据, 超过上限时截断
+	Payload []byte `json:"payload"`
+	// Truncated payload是否被截断
+	Truncated bool `json:"truncated"`
+	// Dropped 是否被规则或拦截器丢弃
+	Dropped bool `json:"dropped"`
+}
+
+// FrameOutput 输出WebSocket帧接口, Output可选实现
+type FrameOutput interface {
+	WriteWebSocketFrame(tx *Transaction, frame *WebSocketFrame) error
+}
+
+// 创建帧记录
+func newWebSocketFrame(frame *goproxy.WebSocketFrame) *WebSocketFrame {
+	f := &WebSocketFrame{
+		Direction: FrameDirectionReceive,
+		Opcode:    int(frame.Opcode),
+		Time:      frame.Time,
+		Len:       len(frame.Payload),
+		Dropped:   frame.IsDropped(),
+	}
+	if frame.FromClient {
+		f.Direction = FrameDirectionSend
+	}
+	payload := frame.Payload
+	if len(payload) > maxRecordFramePayload {
+		payload = payload[:maxRecordFramePayload]
+		f.Truncated = true
+	}
+	f.Payload = make([]byte, len(payload))
+	copy(f.Payload, payload)
+
+	return f
+}
+
+// 添加帧记录, 超过上限后不再记录
+func (tx *Transaction) addWebSocketFrame(f *WebSocketFrame) bool {
+	tx.framesMu.Lock()
+	defer tx.framesMu.Unlock()
+	if len(tx.WebSocketFrames) >= maxRecordFrames {
+		return false
+	}
+	tx.WebSocketFrames = append(tx.WebSocketFrames, f)
+
+	return true
+}
@@ -26,6 +26,9 @@ type Conn interface {
 	// ReadMessage 读取消息
 	ReadMessage() (p []byte, err error)
 
+	// CloseGracefully 通知对方后关闭连接
+	CloseGracefully() error
+
 	io.Writer
 	io.Closer
 }
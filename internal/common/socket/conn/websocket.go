@@ -7,6 +7,9 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// 发送关闭帧超时时间
+const closeFrameTimeout = time.Second
+
 // WebSocket webSocket连接
 type WebSocket struct {
 	msgType int
@@ -47,6 +50,14 @@ func (w *WebSocket) Close() error {
 	return w.conn.Close()
 }
 
+// CloseGracefully 发送关闭帧后关闭连接
+func (w *WebSocket) CloseGracefully() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	w.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeFrameTimeout))
+
+	return w.conn.Close()
+}
+
 // SetWriteDeadline 设置写入超时时间
 func (w *WebSocket) SetWriteDeadline(t time.Time) error {
 	return w.conn.SetWriteDeadline(t)
@@ -1,6 +1,7 @@
 package socket
 
 import (
+	"context"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -8,15 +9,27 @@ import (
 
 // Hub session管理
 type Hub struct {
+	// dropped 未能写入session的广播消息数, 放在最前保证32位平台上原子操作对齐
+	dropped   uint64
 	sessions  sync.Map
 	broadcast chan []byte
 	num       int32
+	// mu 保护closed, 关闭broadcast后不能再发送
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// 支持优雅关闭的session
+type shutdowner interface {
+	Shutdown(ctx context.Context)
 }
 
 // NewHub 创建session集合实例
 func NewHub(broadcastQueueSize int) *Hub {
 	h := &Hub{
 		broadcast: make(chan []byte, broadcastQueueSize),
+		done:      make(chan struct{}),
 	}
 
 	go h.run()
@@ -49,16 +62,54 @@ func (ch *Hub) Delete(sessionID string) {
 	atomic.AddInt32(&ch.num, -1)
 }
 
-// Broadcast 广播
+// Broadcast 广播, Shutdown后丢弃
 func (ch *Hub) Broadcast(data []byte) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if ch.closed {
+		atomic.AddUint64(&ch.dropped, 1)
+		return
+	}
 	ch.broadcast <- data
 }
 
+// Shutdown 停止广播, 队列中的消息发送完后关闭所有session, ctx超时则直接关闭
+func (ch *Hub) Shutdown(ctx context.Context) {
+	ch.mu.Lock()
+	if !ch.closed {
+		ch.closed = true
+		close(ch.broadcast)
+	}
+	ch.mu.Unlock()
+	select {
+	case <-ch.done:
+	case <-ctx.Done():
+	}
+
+	var wg sync.WaitGroup
+	ch.sessions.Range(func(key, value interface{}) bool {
+		if s, ok := value.(shutdowner); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Shutdown(ctx)
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+}
+
 // Num session数量
 func (ch *Hub) Num() int32 {
 	return atomic.LoadInt32(&ch.num)
 }
 
+// Dropped 未能写入session的广播消息数
+func (ch *Hub) Dropped() uint64 {
+	return atomic.LoadUint64(&ch.dropped)
+}
+
 // Range 遍历session
 func (ch *Hub) Range(f func(key, value interface{}) bool) {
 	ch.sessions.Range(f)
@@ -66,10 +117,13 @@ func (ch *Hub) Range(f func(key, value interface{}) bool) {
 
 // 运行
 func (ch *Hub) run() {
+	defer close(ch.done)
 	for data := range ch.broadcast {
 		ch.sessions.Range(func(key, value interface{}) bool {
 			w := value.(io.Writer)
-			w.Write(data)
+			if _, err := w.Write(data); err != nil {
+				atomic.AddUint64(&ch.dropped, 1)
+			}
 			return true
 		})
 	}
@@ -1,7 +1,9 @@
 package socket
 
 import (
+	"context"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -38,3 +40,37 @@ func TestHub(t *testing.T) {
 	time.Sleep(1 * time.Millisecond)
 	require.Equal(t, int32(0), hub.Num())
 }
+
+type testShutdownSession struct {
+	received int32
+	shutdown int32
+}
+
+func (tc *testShutdownSession) Write(p []byte) (n int, err error) {
+	atomic.AddInt32(&tc.received, 1)
+	return len(p), nil
+}
+
+func (tc *testShutdownSession) Shutdown(ctx context.Context) {
+	atomic.StoreInt32(&tc.shutdown, 1)
+}
+
+func TestHubShutdown(t *testing.T) {
+	hub := NewHub(50)
+	s := &testShutdownSession{}
+	hub.Add("1", s)
+	for i := 0; i < 10; i++ {
+		hub.Broadcast([]byte("session broadcast"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hub.Shutdown(ctx)
+	require.Equal(t, int32(10), atomic.LoadInt32(&s.received))
+	require.Equal(t, int32(1), atomic.LoadInt32(&s.shutdown))
+
+	// 关闭后广播被丢弃
+	hub.Broadcast([]byte("session broadcast"))
+	hub.Shutdown(ctx)
+	require.Equal(t, int32(10), atomic.LoadInt32(&s.received))
+}
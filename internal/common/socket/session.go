@@ -1,6 +1,8 @@
 package socket
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -37,6 +39,9 @@ var defaultSessionOptions = options{
 	heartBeatTimeoutTimes: 2,
 }
 
+// ErrSendQueueFull 发送队列已满, 消息被丢弃并关闭连接
+var ErrSendQueueFull = errors.New("session send queue full")
+
 // SessionOption 可选项
 type SessionOption func(*options)
 
@@ -109,6 +114,8 @@ type Session struct {
 	sendChan       chan []byte
 	closeChan      chan struct{}
 	closeOnce      sync.Once
+	shutdownChan   chan struct{}
+	shutdownOnce   sync.Once
 	closed         atomic.Value
 	heartBeatTimer *time.Ticker
 	opts           options
@@ -133,6 +140,7 @@ func NewSession(conn conn.Conn, handler SessionHandler, opt ...SessionOption) *S
 		receiveChan:    make(chan []byte, opts.receiveQueueSize),
 		sendChan:       make(chan []byte, opts.sendQueueSize),
 		closeChan:      make(chan struct{}),
+		shutdownChan:   make(chan struct{}),
 		heartBeatTimer: time.NewTicker(opts.heartBeatTimeout),
 	}
 	s.lastActiveTime.Store(time.Now())
@@ -151,12 +159,13 @@ func (s *Session) Run() {
 	s.handler.OnConnect(s)
 }
 
-// Write 写入数据
+// Write 写入数据, 发送队列已满时丢弃消息并关闭连接
 func (s *Session) Write(data []byte) (n int, err error) {
 	select {
 	case s.sendChan <- data:
 	default:
 		s.Close()
+		return 0, ErrSendQueueFull
 	}
 
 	return len(data), nil
@@ -188,6 +197,18 @@ func (s *Session) Close() {
 	})
 }
 
+// Shutdown 发送完队列中的消息及关闭帧后关闭连接, ctx超时则直接关闭
+func (s *Session) Shutdown(ctx context.Context) {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdownChan)
+	})
+	select {
+	case <-s.closeChan:
+	case <-ctx.Done():
+		s.Close()
+	}
+}
+
 // 处理消息
 func (s *Session) handleMessage() {
 	for data := range s.receiveChan {
@@ -202,17 +223,43 @@ func (s *Session) sendMessage() {
 		select {
 		case <-s.closeChan:
 			return
+		case <-s.shutdownChan:
+			s.flush()
+			return
+		case data := <-s.sendChan:
+			if !s.write(data) {
+				return
+			}
+		}
+	}
+}
+
+// 发送队列中剩余的消息后通知对方关闭
+func (s *Session) flush() {
+	for {
+		select {
 		case data := <-s.sendChan:
-			s.conn.SetWriteDeadline(time.Now().Add(s.opts.writeTimeout))
-			_, err := s.conn.Write(data)
-			if err != nil {
-				s.handler.OnError(s, err)
+			if !s.write(data) {
 				return
 			}
+		default:
+			s.conn.CloseGracefully()
+			return
 		}
 	}
 }
 
+func (s *Session) write(data []byte) bool {
+	s.conn.SetWriteDeadline(time.Now().Add(s.opts.writeTimeout))
+	_, err := s.conn.Write(data)
+	if err != nil {
+		s.handler.OnError(s, err)
+		return false
+	}
+
+	return true
+}
+
 // 接收消息
 func (s *Session) receiveMessage() {
 	defer func() {
@@ -1,33 +1,35 @@
 package shadowsocks
 
 import (
-	
+	"net"
+
 	"github.com/Yee2/shadowsocks-go"
 	log "github.com/sirupsen/logrus"
-	"net"
 )
 
-func ShadowsocksMain() {
-	tunnel, err := shadowsocks.NewTunnel("aes-256-gcm","123456")
-	if err != nil {
-		println(err)
-	}
-	listener, err := net.Listen("tcp", "0.0.0.0:8388")
+// Addr shadowsocks监听地址
+const Addr = "0.0.0.0:8388"
+
+// ShadowsocksMain 处理listener上的shadowsocks连接, listener关闭后返回
+func ShadowsocksMain(listener net.Listener) error {
+	tunnel, err := shadowsocks.NewTunnel("aes-256-gcm", "123456")
 	if err != nil {
-		println(err)
+		return err
 	}
 	defer listener.Close()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			println(err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
 		}
 		go func() {
 			defer conn.Close()
 			surface, err := tunnel.Shadow(conn)
 			if err != nil {
-				println(err)
+				log.Debugf("shadowsocks握手错误 %s", err)
 				return
 			}
 			err = shadowsocks.Handle(surface)
@@ -35,6 +37,5 @@ func ShadowsocksMain() {
 				log.Infof("Handle 错误 %s", err)
 			}
 		}()
-
 	}
-}
\ No newline at end of file
+}